@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/miekg/dns"
 	"github.com/woshikedayaa/traffics/networks/constant"
+	"github.com/woshikedayaa/traffics/networks/dialer"
 	"github.com/woshikedayaa/traffics/networks/resolver"
+	"github.com/woshikedayaa/traffics/networks/sockopt"
 	"net/netip"
 	"net/url"
 	"strconv"
@@ -14,9 +17,11 @@ import (
 )
 
 type Config struct {
-	Binds  []BindConfig   `json:"binds,omitempty"`
-	Remote []RemoteConfig `json:"remotes,omitempty"`
-	Log    LogConfig      `json:"log,omitempty"`
+	Binds    []BindConfig   `json:"binds,omitempty"`
+	Remote   []RemoteConfig `json:"remotes,omitempty"`
+	Hosts    HostsConfig    `json:"hosts,omitempty"`
+	DNSCache DNSCacheConfig `json:"dns_cache,omitempty"`
+	Log      LogConfig      `json:"log,omitempty"`
 }
 
 func NewConfig() Config {
@@ -27,6 +32,49 @@ func NewConfig() Config {
 	}
 }
 
+// HostsConfig is consulted before any dns query of every remote.
+type HostsConfig struct {
+	// File is a hosts file in /etc/hosts format, reloaded when it changes
+	File   string   `json:"file,omitempty"`
+	Static HostsMap `json:"static,omitempty"`
+}
+
+// DNSCacheConfig is the cache of dns answers, remotes with the same dns servers share one cache.
+type DNSCacheConfig struct {
+	// Size is the max number of cached answers
+	Size int `json:"size,omitempty"`
+	// MinTTL and MaxTTL bound how long an answer is cached
+	MinTTL time.Duration `json:"min_ttl,omitempty"`
+	MaxTTL time.Duration `json:"max_ttl,omitempty"`
+	// StaleTTL is how long an expired answer is still served while the dns servers fail
+	StaleTTL time.Duration `json:"stale_ttl,omitempty"`
+	// Prefetch refreshes popular answers before they expire
+	Prefetch bool `json:"prefetch,omitempty"`
+}
+
+func (c *DNSCacheConfig) valid() error {
+	if c.Size < 0 {
+		return errors.New("dns cache: negative size")
+	}
+	if c.MinTTL < 0 || c.MaxTTL < 0 || c.StaleTTL < 0 {
+		return errors.New("dns cache: negative ttl")
+	}
+	if c.MaxTTL > 0 && c.MinTTL > c.MaxTTL {
+		return errors.New("dns cache: min ttl is greater than max ttl")
+	}
+	return nil
+}
+
+func (c *DNSCacheConfig) Options() resolver.CacheOptions {
+	return resolver.CacheOptions{
+		Size:     c.Size,
+		MinTTL:   c.MinTTL,
+		MaxTTL:   c.MaxTTL,
+		StaleTTL: c.StaleTTL,
+		Prefetch: c.Prefetch,
+	}
+}
+
 type LogConfig struct {
 	Disable bool   `json:"disable,omitempty"`
 	Level   string `json:"level,omitempty"`
@@ -42,21 +90,38 @@ type BindConfig struct {
 	// metadata(optional)
 	Name    string            `json:"name,omitempty"`
 	Network constant.Protocol `json:"network,omitempty"`
+	Mode    constant.BindMode `json:"mode,omitempty"`
+	// DNSRules sends the queries of names under a domain to another remote, in dns mode
+	DNSRules DNSRules `json:"dns_rules,omitempty"`
 
 	// below is configured by args
 	Family    string `json:"family,omitempty"`
 	Interface string `json:"interface,omitempty"`
 	ReuseAddr bool   `json:"reuse_addr,omitempty"`
+	SocketConfig
+
+	// workers
+	Workers     int  `json:"workers,omitempty"`
+	CPUAffinity bool `json:"cpu_affinity,omitempty"`
 
 	// tcp
 	TFO bool `json:"tfo,omitempty"`
 	// Redirect bool `json:"redirect,omitempty"`
-	MPTCP bool `json:"mptcp,omitempty"`
+	MPTCP            bool          `json:"mptcp,omitempty"`
+	TCPIdleTimeout   time.Duration `json:"tcp_idle_timeout,omitempty"`
+	TCPMaxLifetime   time.Duration `json:"tcp_max_lifetime,omitempty"`
+	TCPLifetimeGrace time.Duration `json:"tcp_lifetime_grace,omitempty"`
 
 	// udp configuration
 	UDPKeepaliveTTL time.Duration `json:"udp_ttl,omitempty"`
 	UDPBufferSize   int           `json:"udp_buffer_size,omitempty"` // byte
+	UDPBatchSize    int           `json:"udp_batch_size,omitempty"`
 	UDPFragment     bool          `json:"udp_fragment,omitempty"`
+	// UDPFilter makes udp sessions use unconnected sockets,
+	// empty means a connected socket which only accepts replies from the remote
+	UDPFilter constant.UDPFilter `json:"udp_filter,omitempty"`
+	// UDPNAT is a preset of UDPFilter
+	UDPNAT constant.UDPNAT `json:"udp_nat,omitempty"`
 }
 
 type _BindConfig BindConfig
@@ -90,6 +155,44 @@ func (c *BindConfig) valid() error {
 	if c.Port == 0 {
 		return errors.New("bind: no port specified")
 	}
+	if c.Workers < 0 {
+		return errors.New("bind: negative workers")
+	}
+	if err := c.SocketConfig.valid(); err != nil {
+		return fmt.Errorf("bind: %w", err)
+	}
+	if c.UDPBatchSize < 0 {
+		return errors.New("bind: negative udp batch size")
+	}
+	switch c.Mode {
+	case "", constant.BindModeForward, constant.BindModeDNS:
+	default:
+		return fmt.Errorf("bind: unknown mode: %s", c.Mode)
+	}
+	if len(c.DNSRules) > 0 && c.Mode != constant.BindModeDNS {
+		return errors.New("bind: dns rules need dns mode")
+	}
+	for domain, remote := range c.DNSRules {
+		if _, ok := dns.IsDomainName(domain); !ok || remote == "" {
+			return fmt.Errorf("bind: bad dns rule: %s=%s", domain, remote)
+		}
+	}
+	filter, ok := c.UDPNAT.Filter()
+	if !ok {
+		return fmt.Errorf("bind: unknown udp nat: %s", c.UDPNAT)
+	}
+	if c.UDPNAT != "" {
+		if c.UDPFilter != "" && c.UDPFilter != filter {
+			return fmt.Errorf("bind: udp filter %s conflicts with udp nat %s", c.UDPFilter, c.UDPNAT)
+		}
+		c.UDPFilter = filter
+	}
+	switch c.UDPFilter {
+	case "", constant.UDPFilterEndpointIndependent, constant.UDPFilterAddressDependent,
+		constant.UDPFilterAddressPortDependent:
+	default:
+		return fmt.Errorf("bind: unknown udp filter: %s", c.UDPFilter)
+	}
 	return nil
 }
 
@@ -131,6 +234,13 @@ func (c *BindConfig) Parse(s string) error {
 		pick := len(v) - 1
 		var val = v[pick]
 
+		if ok, err := c.SocketConfig.parse("bind", k, val); ok || err != nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		switch k {
 		case "family":
 			c.Family = val
@@ -144,6 +254,18 @@ func (c *BindConfig) Parse(s string) error {
 			c.ReuseAddr = ok
 		case "name":
 			c.Name = val
+		case "workers":
+			workers, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("parse bind(workers): %w", err)
+			}
+			c.Workers = workers
+		case "cpu_affinity":
+			ok, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("parse bind(cpu_affinity): expected bool, got %s", val)
+			}
+			c.CPUAffinity = ok
 		case "tfo":
 			ok, err := strconv.ParseBool(val)
 			if err != nil {
@@ -158,24 +280,60 @@ func (c *BindConfig) Parse(s string) error {
 			c.UDPKeepaliveTTL = duration
 		case "remote":
 			c.Remote = val
+		case "mode":
+			c.Mode = constant.BindMode(val)
+		case "dns_rules":
+			rules, err := parseDNSRules(val)
+			if err != nil {
+				return fmt.Errorf("parse bind(dns_rules): %w", err)
+			}
+			c.DNSRules = rules
 		case "udp_buffer_size":
 			size, err := strconv.Atoi(val)
 			if err != nil {
 				return fmt.Errorf("parse bind(udp_buffer_size): %w", err)
 			}
 			c.UDPBufferSize = size
+		case "udp_batch_size":
+			size, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("parse bind(udp_batch_size): %w", err)
+			}
+			c.UDPBatchSize = size
 		case "udp_fragment":
 			ok, err := strconv.ParseBool(val)
 			if err != nil {
 				return fmt.Errorf("parse bind(udp_fragment): expected bool, got %s", val)
 			}
 			c.UDPFragment = ok
+		case "udp_filter":
+			c.UDPFilter = constant.UDPFilter(val)
+		case "udp_nat":
+			c.UDPNAT = constant.UDPNAT(val)
 		case "mptcp":
 			ok, err := strconv.ParseBool(val)
 			if err != nil {
 				return fmt.Errorf("parse bind(mptcp): expected bool, got %s", val)
 			}
 			c.MPTCP = ok
+		case "tcp_idle_timeout":
+			duration, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse bind(tcp_idle_timeout): %w", err)
+			}
+			c.TCPIdleTimeout = duration
+		case "tcp_max_lifetime":
+			duration, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse bind(tcp_max_lifetime): %w", err)
+			}
+			c.TCPMaxLifetime = duration
+		case "tcp_lifetime_grace":
+			duration, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse bind(tcp_lifetime_grace): %w", err)
+			}
+			c.TCPLifetimeGrace = duration
 		default:
 			return fmt.Errorf("parse bind: unknown option: %s", k)
 		}
@@ -208,20 +366,52 @@ type RemoteConfig struct {
 	Name   string `json:"name,omitempty"`
 	Server string `json:"server,omitempty"`
 	Port   uint16 `json:"port,omitempty"`
+	// SRV is a name such as _service._proto.example.com, the targets of its SRV records
+	// are the backends of the remote instead of server and port
+	SRV string `json:"srv,omitempty"`
 
 	// optional
-	DNS             string            `json:"dns,omitempty"`
-	ResolveStrategy resolver.Strategy `json:"strategy,omitempty"`
-	Timeout         time.Duration     `json:"timeout,omitempty"`
-	ReuseAddr       bool              `json:"reuse_addr,omitempty"`
-	Interface       string            `json:"interface,omitempty"`
-	BindAddress4    netip.Addr        `json:"bind_address4,omitempty"`
-	BindAddress6    netip.Addr        `json:"bind_address6,omitempty"`
-	FwMark          uint32            `json:"fwmark,omitempty"`
+	DNS             ServerList             `json:"dns,omitempty"`
+	DNSMode         resolver.MultiMode     `json:"dns_mode,omitempty"`
+	DNSUDPSize      uint16                 `json:"dns_udp_size,omitempty"`
+	DNSTransport    constant.DNSTransport  `json:"dns_transport,omitempty"`
+	Hosts           HostsMap               `json:"hosts,omitempty"`
+	DNS64           bool                   `json:"dns64,omitempty"`
+	NAT64           bool                   `json:"nat64,omitempty"`
+	NAT64Prefix     netip.Prefix           `json:"nat64_prefix,omitempty"`
+	ResolveStrategy resolver.Strategy      `json:"strategy,omitempty"`
+	Timeout         time.Duration          `json:"timeout,omitempty"`
+	ReuseAddr       bool                   `json:"reuse_addr,omitempty"`
+	Interface       string                 `json:"interface,omitempty"`
+	BindAddress4    netip.Addr             `json:"bind_address4,omitempty"`
+	BindAddress6    netip.Addr             `json:"bind_address6,omitempty"`
+	BindAddresses4  PrefixList             `json:"bind_addresses4,omitempty"`
+	BindAddresses6  PrefixList             `json:"bind_addresses6,omitempty"`
+	BindSelect      dialer.SourceSelection `json:"bind_select,omitempty"`
+	FwMark          uint32                 `json:"fwmark,omitempty"`
+	SocketConfig
+
+	// happy eyeballs
+	AttemptDelay    time.Duration       `json:"attempt_delay,omitempty"`
+	ResolutionDelay time.Duration       `json:"resolution_delay,omitempty"`
+	MaxAttempts     int                 `json:"max_concurrent_attempts,omitempty"`
+	AddressOrder    dialer.AddressOrder `json:"address_order,omitempty"`
+
+	// retry
+	Retries         int           `json:"retries,omitempty"`
+	AttemptTimeout  time.Duration `json:"attempt_timeout,omitempty"`
+	RetryBackoff    time.Duration `json:"retry_backoff,omitempty"`
+	RetryBackoffMax time.Duration `json:"retry_backoff_max,omitempty"`
 
 	// tcp
-	TFO   bool `json:"tfo,omitempty"`
-	MPTCP bool `json:"mptcp,omitempty"`
+	TFO             bool          `json:"tfo,omitempty"`
+	MPTCP           bool          `json:"mptcp,omitempty"`
+	PoolSize        int           `json:"pool_size,omitempty"`
+	PoolIdleTimeout time.Duration `json:"pool_idle_timeout,omitempty"`
+
+	// backends
+	Backends            bool          `json:"backends,omitempty"`
+	HealthCheckInterval time.Duration `json:"health_check_interval,omitempty"`
 
 	// udp
 	UDPFragment bool `json:"udp_fragment,omitempty"`
@@ -239,12 +429,75 @@ func (c *RemoteConfig) valid() error {
 	//if c.Name == "" {
 	//	return errors.New("dialer: no name specified")
 	//}
-	if c.Server == "" {
+	if c.SRV != "" && (c.Server != "" || c.Port != 0) {
+		return errors.New("remote: srv and server are exclusive")
+	}
+	if c.Server == "" && c.SRV == "" {
 		return errors.New("remote: no server specified")
 	}
-	if c.Port == 0 {
+	if c.Port == 0 && c.SRV == "" {
 		return errors.New("remote: no server port specified")
 	}
+	if err := c.SocketConfig.valid(); err != nil {
+		return fmt.Errorf("remote: %w", err)
+	}
+	if c.AttemptDelay != 0 && c.AttemptDelay < constant.HappyEyeballsMinAttemptDelay {
+		return fmt.Errorf("remote: attempt delay must be at least %s", constant.HappyEyeballsMinAttemptDelay)
+	}
+	if c.ResolutionDelay < 0 {
+		return errors.New("remote: negative resolution delay")
+	}
+	if c.MaxAttempts < 0 {
+		return errors.New("remote: negative max concurrent attempts")
+	}
+	if c.Retries < 0 {
+		return errors.New("remote: negative retries")
+	}
+	if _, ok := c.Hosts[""]; ok {
+		return errors.New("remote: empty name in hosts")
+	}
+	if !c.DNSMode.IsValid() {
+		return fmt.Errorf("remote: unknown dns mode: %s", c.DNSMode)
+	}
+	if c.DNSUDPSize != 0 && c.DNSUDPSize < 512 {
+		return errors.New("remote: dns udp size must be at least 512")
+	}
+	if c.NAT64Prefix.IsValid() && !resolver.ValidNAT64Prefix(c.NAT64Prefix) {
+		return fmt.Errorf("remote: bad nat64 prefix: %s", c.NAT64Prefix)
+	}
+	switch c.DNSTransport {
+	case "", constant.DNSTransportUDP, constant.DNSTransportTCP, constant.DNSTransportTLS, constant.DNSTransportHTTPS:
+	default:
+		return fmt.Errorf("remote: unknown dns transport: %s", c.DNSTransport)
+	}
+	for _, prefix := range c.BindAddresses4 {
+		if !prefix.Addr().Is4() {
+			return fmt.Errorf("remote: bind_addresses4 contains a non ipv4 address: %s", prefix)
+		}
+	}
+	for _, prefix := range c.BindAddresses6 {
+		if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			return fmt.Errorf("remote: bind_addresses6 contains a non ipv6 address: %s", prefix)
+		}
+	}
+	if c.BindAddress4.IsValid() && len(c.BindAddresses4) > 0 || c.BindAddress6.IsValid() && len(c.BindAddresses6) > 0 {
+		return errors.New("remote: bind_address and bind_addresses of the same family are exclusive")
+	}
+	if !c.BindSelect.IsValid() {
+		return fmt.Errorf("remote: unknown bind select: %s", c.BindSelect)
+	}
+	if !c.AddressOrder.IsValid() {
+		return fmt.Errorf("remote: unknown address order: %s", c.AddressOrder)
+	}
+	if c.PoolSize < 0 || c.PoolIdleTimeout < 0 {
+		return errors.New("remote: negative pool size or idle timeout")
+	}
+	if c.HealthCheckInterval < 0 {
+		return errors.New("remote: negative health check interval")
+	}
+	if c.AttemptTimeout < 0 || c.RetryBackoff < 0 || c.RetryBackoffMax < 0 {
+		return errors.New("remote: negative retry duration")
+	}
 
 	return nil
 }
@@ -262,6 +515,10 @@ func (c *RemoteConfig) Parse(s string) error {
 	c.Raw = s
 	c.Server = uu.Hostname()
 	c.Name = uu.Scheme
+	if uu.Scheme == "srv" && strings.HasPrefix(c.Server, "_") {
+		// srv://_service._proto.example.com, name it with the name option
+		c.SRV, c.Server = c.Server, ""
+	}
 
 	if uu.Port() != "" {
 		pp, err := strconv.ParseUint(uu.Port(), 10, 16)
@@ -278,9 +535,54 @@ func (c *RemoteConfig) Parse(s string) error {
 		pick := len(v) - 1
 		var val = v[pick]
 
+		if ok, err := c.SocketConfig.parse("remote", k, val); ok || err != nil {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		switch k {
 		case "dns":
-			c.DNS = val
+			servers, err := parseServerList(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(dns): %w", err)
+			}
+			c.DNS = servers
+		case "hosts":
+			hosts, err := parseHostsMap(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(hosts): %w", err)
+			}
+			c.Hosts = hosts
+		case "dns_mode":
+			c.DNSMode = resolver.MultiMode(val)
+		case "dns64":
+			ok, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(dns64): expected bool, got %s", val)
+			}
+			c.DNS64 = ok
+		case "nat64":
+			ok, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(nat64): expected bool, got %s", val)
+			}
+			c.NAT64 = ok
+		case "nat64_prefix":
+			prefix, err := netip.ParsePrefix(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(nat64_prefix): %w", err)
+			}
+			c.NAT64Prefix = prefix
+		case "dns_transport":
+			c.DNSTransport = constant.DNSTransport(val)
+		case "dns_udp_size":
+			size, err := strconv.ParseUint(val, 10, 16)
+			if err != nil {
+				return fmt.Errorf("parse remote(dns_udp_size): %w", err)
+			}
+			c.DNSUDPSize = uint16(size)
 		case "strategy":
 			strategy, ok := resolver.ParseStrategy(val)
 			if !ok {
@@ -337,6 +639,86 @@ func (c *RemoteConfig) Parse(s string) error {
 				return fmt.Errorf("parse remote(bind_address6): %w", err)
 			}
 			c.BindAddress6 = addr
+		case "bind_addresses4", "bind_addresses6":
+			list, err := parsePrefixList(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(%s): %w", k, err)
+			}
+			if k == "bind_addresses4" {
+				c.BindAddresses4 = list
+			} else {
+				c.BindAddresses6 = list
+			}
+		case "bind_select":
+			c.BindSelect = dialer.SourceSelection(val)
+		case "address_order":
+			c.AddressOrder = dialer.AddressOrder(val)
+		case "attempt_delay":
+			delay, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(attempt_delay): %w", err)
+			}
+			c.AttemptDelay = delay
+		case "resolution_delay":
+			delay, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(resolution_delay): %w", err)
+			}
+			c.ResolutionDelay = delay
+		case "max_concurrent_attempts":
+			attempts, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(max_concurrent_attempts): %w", err)
+			}
+			c.MaxAttempts = attempts
+		case "retries":
+			retries, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(retries): %w", err)
+			}
+			c.Retries = retries
+		case "attempt_timeout":
+			timeout, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(attempt_timeout): %w", err)
+			}
+			c.AttemptTimeout = timeout
+		case "retry_backoff":
+			backoff, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(retry_backoff): %w", err)
+			}
+			c.RetryBackoff = backoff
+		case "retry_backoff_max":
+			backoff, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(retry_backoff_max): %w", err)
+			}
+			c.RetryBackoffMax = backoff
+		case "pool_size":
+			size, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(pool_size): %w", err)
+			}
+			c.PoolSize = size
+		case "pool_idle_timeout":
+			timeout, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(pool_idle_timeout): %w", err)
+			}
+			c.PoolIdleTimeout = timeout
+		case "backends":
+			ok, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(backends): expected bool, got %s", val)
+			}
+			c.Backends = ok
+		case "health_check_interval":
+			interval, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse remote(health_check_interval): %w", err)
+			}
+			c.HealthCheckInterval = interval
 		case "name":
 			c.Name = val
 		default:
@@ -363,3 +745,202 @@ func (c *RemoteConfig) UnmarshalJSON(bs []byte) error {
 	}
 	return c.valid()
 }
+
+// ServerList is a list of servers, a single server is accepted in json too.
+type ServerList []string
+
+func (l *ServerList) UnmarshalJSON(bs []byte) error {
+	var single string
+	if err := json.Unmarshal(bs, &single); err == nil {
+		*l = ServerList{single}
+		return nil
+	}
+	return json.Unmarshal(bs, (*[]string)(l))
+}
+
+// HostsMap maps names to addresses, it overrides dns.
+type HostsMap map[string][]netip.Addr
+
+// parseHostsMap parses a comma separated list of name=address.
+func parseHostsMap(s string) (HostsMap, error) {
+	hosts := make(HostsMap)
+	for _, item := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name=address, got %s", item)
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, err
+		}
+		hosts[name] = append(hosts[name], addr)
+	}
+	return hosts, nil
+}
+
+// parseServerList parses a comma separated list of dns servers.
+func parseServerList(s string) ([]string, error) {
+	var servers []string
+	for _, item := range strings.Split(s, ",") {
+		server := strings.TrimSpace(item)
+		if server == "" {
+			return nil, fmt.Errorf("expected a server, got an empty item in %s", s)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// DNSRules maps domains to the remotes their names are forwarded to.
+type DNSRules map[string]string
+
+// parseDNSRules parses a comma separated list of domain=remote.
+func parseDNSRules(s string) (DNSRules, error) {
+	rules := make(DNSRules)
+	for _, item := range strings.Split(s, ",") {
+		domain, remote, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || domain == "" || remote == "" {
+			return nil, fmt.Errorf("expected domain=remote, got %s", item)
+		}
+		rules[domain] = remote
+	}
+	return rules, nil
+}
+
+// PrefixList is a list of addresses or prefixes, an address is a prefix of its full length.
+type PrefixList []netip.Prefix
+
+// parsePrefixList parses a comma separated list.
+func parsePrefixList(s string) (PrefixList, error) {
+	var list PrefixList
+	for _, item := range strings.Split(s, ",") {
+		prefix, err := parsePrefix(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, prefix)
+	}
+	return list, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (l *PrefixList) UnmarshalJSON(bs []byte) error {
+	var raw []string
+	if err := json.Unmarshal(bs, &raw); err != nil {
+		return err
+	}
+	list := make(PrefixList, 0, len(raw))
+	for _, item := range raw {
+		prefix, err := parsePrefix(item)
+		if err != nil {
+			return err
+		}
+		list = append(list, prefix)
+	}
+	*l = list
+	return nil
+}
+
+// SocketConfig is the socket tuning shared by binds and remotes.
+type SocketConfig struct {
+	TCPKeepAliveIdle     time.Duration `json:"tcp_keepalive_idle,omitempty"`
+	TCPKeepAliveInterval time.Duration `json:"tcp_keepalive_interval,omitempty"`
+	TCPKeepAliveCount    int           `json:"tcp_keepalive_count,omitempty"`
+	TCPNoDelay           *bool         `json:"tcp_nodelay,omitempty"`
+	TCPUserTimeout       time.Duration `json:"tcp_user_timeout,omitempty"`
+	TCPCongestion        string        `json:"tcp_congestion,omitempty"`
+	TCPNotSentLowat      int           `json:"tcp_notsent_lowat,omitempty"`
+	ReceiveBuffer        int           `json:"so_rcvbuf,omitempty"`
+	SendBuffer           int           `json:"so_sndbuf,omitempty"`
+	TOS                  int           `json:"tos,omitempty"`
+}
+
+func (c *SocketConfig) valid() error {
+	if c.TCPKeepAliveIdle < 0 || c.TCPKeepAliveInterval < 0 || c.TCPKeepAliveCount < 0 {
+		return errors.New("negative tcp keepalive")
+	}
+	if c.ReceiveBuffer < 0 || c.SendBuffer < 0 || c.TCPNotSentLowat < 0 {
+		return errors.New("negative socket buffer size")
+	}
+	if c.TOS < 0 || c.TOS > 255 {
+		return fmt.Errorf("tos out of range: %d", c.TOS)
+	}
+	return nil
+}
+
+// parse parses a socket option from url query, it reports false if k is not a socket option.
+func (c *SocketConfig) parse(prefix string, k string, val string) (bool, error) {
+	var (
+		duration = func(target *time.Duration) error {
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("parse %s(%s): %w", prefix, k, err)
+			}
+			*target = d
+			return nil
+		}
+		integer = func(target *int) error {
+			i, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("parse %s(%s): %w", prefix, k, err)
+			}
+			*target = i
+			return nil
+		}
+	)
+	switch k {
+	case "tcp_keepalive_idle":
+		return true, duration(&c.TCPKeepAliveIdle)
+	case "tcp_keepalive_interval":
+		return true, duration(&c.TCPKeepAliveInterval)
+	case "tcp_keepalive_count":
+		return true, integer(&c.TCPKeepAliveCount)
+	case "tcp_nodelay":
+		ok, err := strconv.ParseBool(val)
+		if err != nil {
+			return true, fmt.Errorf("parse %s(tcp_nodelay): expected bool, got %s", prefix, val)
+		}
+		c.TCPNoDelay = &ok
+		return true, nil
+	case "tcp_user_timeout":
+		return true, duration(&c.TCPUserTimeout)
+	case "tcp_congestion":
+		c.TCPCongestion = val
+		return true, nil
+	case "tcp_notsent_lowat":
+		return true, integer(&c.TCPNotSentLowat)
+	case "so_rcvbuf":
+		return true, integer(&c.ReceiveBuffer)
+	case "so_sndbuf":
+		return true, integer(&c.SendBuffer)
+	case "tos":
+		return true, integer(&c.TOS)
+	default:
+		return false, nil
+	}
+}
+
+func (c *SocketConfig) Options() sockopt.Options {
+	return sockopt.Options{
+		KeepAliveIdle:     c.TCPKeepAliveIdle,
+		KeepAliveInterval: c.TCPKeepAliveInterval,
+		KeepAliveCount:    c.TCPKeepAliveCount,
+		NoDelay:           c.TCPNoDelay,
+		ReceiveBuffer:     c.ReceiveBuffer,
+		SendBuffer:        c.SendBuffer,
+		UserTimeout:       c.TCPUserTimeout,
+		Congestion:        c.TCPCongestion,
+		NotSentLowat:      c.TCPNotSentLowat,
+		TOS:               c.TOS,
+	}
+}
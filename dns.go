@@ -0,0 +1,227 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"github.com/woshikedayaa/traffics/networks/listener"
+	"github.com/woshikedayaa/traffics/networks/resolver"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// dnsForwarder answers the dns queries of a bind from the cache of its remote,
+// or of the remote of the longest rule that matches the name.
+type dnsForwarder struct {
+	upstream resolver.Exchanger
+	rules    []dnsRule
+	inflight chan struct{}
+}
+
+type dnsRule struct {
+	domain   string
+	upstream resolver.Exchanger
+}
+
+// newDNSForwarder returns the forwarder of a bind in dns mode.
+func (t *Traffics) newDNSForwarder(config BindConfig) (*dnsForwarder, error) {
+	upstream, err := t.dnsUpstream(config.Remote)
+	if err != nil {
+		return nil, err
+	}
+	f := &dnsForwarder{upstream: upstream, inflight: make(chan struct{}, constant.DNSMaxInflight)}
+	for domain, remote := range config.DNSRules {
+		upstream, err := t.dnsUpstream(remote)
+		if err != nil {
+			return nil, err
+		}
+		f.rules = append(f.rules, dnsRule{domain: dns.CanonicalName(domain), upstream: upstream})
+	}
+	slices.SortFunc(f.rules, func(a, b dnsRule) int {
+		return dns.CountLabel(b.domain) - dns.CountLabel(a.domain)
+	})
+	return f, nil
+}
+
+// dnsUpstream returns the caching Exchanger of a remote, dns binds of the remote share it.
+// Queries are sent with the dialer of the remote, over its dns transport.
+func (t *Traffics) dnsUpstream(name string) (resolver.Exchanger, error) {
+	if upstream, ok := t.dnsUpstreams[name]; ok {
+		return upstream, nil
+	}
+	remote, ok := t.nameToDialer[name]
+	if !ok {
+		return nil, fmt.Errorf("no remote with name: %s", name)
+	}
+	index := slices.IndexFunc(t.config.Remote, func(r RemoteConfig) bool { return r.Name == name })
+	config := t.config.Remote[index]
+	if config.SRV != "" {
+		return nil, fmt.Errorf("remote %s: a srv remote can not serve dns binds", name)
+	}
+	transport := cmp.Or(config.DNSTransport, constant.DNSTransportUDP)
+	server := string(transport) + "://" + remote.address
+	if transport == constant.DNSTransportHTTPS {
+		server += "/dns-query"
+	}
+	client, err := resolver.NewClient(remote.dialer, server, config.DNSUDPSize)
+	if err != nil {
+		return nil, fmt.Errorf("remote %s: %w", name, err)
+	}
+	upstream := resolver.NewCachedExchanger(client, t.config.DNSCache.Options())
+	t.dnsUpstreams[name] = upstream
+	return upstream, nil
+}
+
+func (f *dnsForwarder) route(name string) resolver.Exchanger {
+	for _, rule := range f.rules {
+		if dns.IsSubDomain(rule.domain, name) {
+			return rule.upstream
+		}
+	}
+	return f.upstream
+}
+
+// exchange answers request, it always returns a reply. Queries that fail are answered with SERVFAIL.
+func (f *dnsForwarder) exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	if request.Response || len(request.Question) == 0 {
+		reply := new(dns.Msg)
+		reply.SetRcodeFormatError(request)
+		return reply, errors.New("not a query")
+	}
+	ctx, cancel := context.WithTimeout(ctx, constant.ResolverDefaultReadTimeout)
+	defer cancel()
+	reply, err := f.route(request.Question[0].Name).Exchange(ctx, request)
+	if reply == nil {
+		reply = new(dns.Msg)
+		reply.SetRcode(request, dns.RcodeServerFailure)
+	}
+	if opt := request.IsEdns0(); opt != nil {
+		if answerOpt := reply.IsEdns0(); answerOpt != nil {
+			// the payload size of the upstream does not apply to the client
+			answerOpt.SetUDPSize(constant.ResolverDefaultUDPSize)
+		} else {
+			reply.SetEdns0(constant.ResolverDefaultUDPSize, opt.Do())
+		}
+	}
+	return reply, err
+}
+
+func (f *dnsForwarder) log(logger *slog.Logger, client string, request *dns.Msg, reply *dns.Msg, err error) {
+	if err != nil {
+		logger.Warn("forward dns query failed", slog.String("source", client),
+			slog.String("question", questionString(request)), slog.String("error", err.Error()))
+		return
+	}
+	logger.Debug("dns query answered", slog.String("source", client),
+		slog.String("question", questionString(request)), slog.String("rcode", dns.RcodeToString[reply.Rcode]))
+}
+
+func questionString(msg *dns.Msg) string {
+	if len(msg.Question) == 0 {
+		return ""
+	}
+	q := msg.Question[0]
+	return q.Name + " " + dns.TypeToString[q.Qtype]
+}
+
+// DNSPacketHandler answers the dns queries received over udp. Answers larger than
+// the payload size of the client are truncated, so that it asks again over tcp.
+func (t *TrafficHandler) DNSPacketHandler(enable bool, logger *slog.Logger, forwarder *dnsForwarder) listener.PacketHandlerOOb {
+	if !enable {
+		return nil
+	}
+
+	return listener.FuncPacketHandlerOOb(func(oob []byte, p []byte, client netip.AddrPort, pw listener.PacketWriter) {
+		request := new(dns.Msg)
+		if err := request.Unpack(p); err != nil {
+			logger.DebugContext(t.ctx, "drop a bad dns message",
+				slog.String("source", client.String()), slog.String("error", err.Error()))
+			return
+		}
+		select {
+		case forwarder.inflight <- struct{}{}:
+		default:
+			logger.WarnContext(t.ctx, "too many dns queries in flight, drop query",
+				slog.String("source", client.String()))
+			return
+		}
+		// remember the local address the client targeted, to reply from it
+		info := listener.ParsePacketInfo(oob)
+		go func() {
+			defer func() { <-forwarder.inflight }()
+			reply, err := forwarder.exchange(t.ctx, request)
+			forwarder.log(logger, client.String(), request, reply, err)
+			size := dns.MinMsgSize
+			if opt := request.IsEdns0(); opt != nil {
+				size = max(int(opt.UDPSize()), dns.MinMsgSize)
+			}
+			reply.Truncate(size)
+			pack, err := reply.Pack()
+			if err != nil {
+				logger.ErrorContext(t.ctx, "pack dns message failed", slog.String("error", err.Error()))
+				return
+			}
+			writePackets(pw, [][]byte{pack}, client, info)
+		}()
+	})
+}
+
+// DNSConnHandler answers the dns queries received over tcp. Queries of a connection
+// are answered as soon as possible, not in order (RFC 7766 section 6.2.1.1).
+func (t *TrafficHandler) DNSConnHandler(enable bool, logger *slog.Logger, config BindConfig, forwarder *dnsForwarder) listener.ConnHandler {
+	if !enable {
+		return nil
+	}
+	idleTimeout := cmp.Or(config.TCPIdleTimeout, constant.DNSTCPIdleTimeout)
+
+	return listener.FuncConnHandler(func(ctx context.Context, local net.Conn) {
+		defer local.Close()
+		var (
+			conn        = &dns.Conn{Conn: local}
+			client      = local.RemoteAddr().String()
+			writeAccess sync.Mutex
+			wg          sync.WaitGroup
+		)
+		// answer the queries in flight before close
+		defer wg.Wait()
+		for {
+			_ = local.SetReadDeadline(time.Now().Add(idleTimeout))
+			request, err := conn.ReadMsg()
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+					logger.DebugContext(ctx, "read dns message failed",
+						slog.String("source", client), slog.String("error", err.Error()))
+				}
+				return
+			}
+			select {
+			case forwarder.inflight <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-forwarder.inflight }()
+				reply, err := forwarder.exchange(ctx, request)
+				forwarder.log(logger, client, request, reply, err)
+				writeAccess.Lock()
+				defer writeAccess.Unlock()
+				_ = local.SetWriteDeadline(time.Now().Add(constant.ResolverDefaultReadTimeout))
+				if err := conn.WriteMsg(reply); err != nil {
+					logger.DebugContext(ctx, "write dns message failed",
+						slog.String("source", client), slog.String("error", err.Error()))
+				}
+			}()
+		}
+	})
+}
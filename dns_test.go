@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"github.com/woshikedayaa/traffics/networks/resolver"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dnsExchanger answers A queries with 192.0.2.n, records many if count is set. Queries of
+// the names in hold wait for the channel to be closed.
+type dnsExchanger struct {
+	n     byte
+	count int
+	hold  map[string]chan struct{}
+
+	access  sync.Mutex
+	queries []*dns.Msg
+}
+
+func (e *dnsExchanger) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	e.access.Lock()
+	e.queries = append(e.queries, request)
+	e.access.Unlock()
+	if gate, ok := e.hold[request.Question[0].Name]; ok {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	reply := new(dns.Msg).SetReply(request)
+	// not the id of the query, the forwarder answers with the id of the client anyway
+	reply.Id = ^request.Id
+	for i := range max(e.count, 1) {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2+byte(i/256), e.n+byte(i)),
+		})
+	}
+	return reply, nil
+}
+
+func (e *dnsExchanger) queried() int {
+	e.access.Lock()
+	defer e.access.Unlock()
+	return len(e.queries)
+}
+
+// newTestForwarder caches the upstreams, as dnsUpstream does.
+func newTestForwarder(upstream resolver.Exchanger, inflight int, rules ...dnsRule) *dnsForwarder {
+	for i := range rules {
+		rules[i].upstream = resolver.NewCachedExchanger(rules[i].upstream, resolver.CacheOptions{})
+	}
+	return &dnsForwarder{
+		upstream: resolver.NewCachedExchanger(upstream, resolver.CacheOptions{}),
+		rules:    rules,
+		inflight: make(chan struct{}, inflight),
+	}
+}
+
+func firstA(reply *dns.Msg) netip.Addr {
+	if len(reply.Answer) == 0 {
+		return netip.Addr{}
+	}
+	addr, _ := netip.AddrFromSlice(reply.Answer[0].(*dns.A).A)
+	return addr.Unmap()
+}
+
+func TestDNSForwarderRoute(t *testing.T) {
+	var (
+		fallback = &dnsExchanger{n: 1}
+		corp     = &dnsExchanger{n: 2}
+		lab      = &dnsExchanger{n: 3}
+	)
+	// longest first, as newDNSForwarder sorts them
+	f := newTestForwarder(fallback, 1,
+		dnsRule{domain: "lab.corp.example.", upstream: lab},
+		dnsRule{domain: "corp.example.", upstream: corp},
+	)
+	tests := []struct {
+		name string
+		want byte
+	}{
+		{"www.example.", 1},
+		{"corp.example.", 2},
+		{"WWW.Corp.Example.", 2},
+		{"host.lab.corp.example.", 3},
+		{"notcorp.example.", 1},
+	}
+	for _, tt := range tests {
+		request := new(dns.Msg).SetQuestion(tt.name, dns.TypeA)
+		request.Id = 4242
+		reply, err := f.exchange(context.Background(), request)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if reply.Id != request.Id {
+			t.Errorf("%s: answered with the id %d, want %d", tt.name, reply.Id, request.Id)
+		}
+		if addr := firstA(reply); addr != netip.AddrFrom4([4]byte{192, 0, 2, tt.want}) {
+			t.Errorf("%s: answered with %s, want the upstream %d", tt.name, addr, tt.want)
+		}
+	}
+	// the cache sends queries upstream with an id of its own
+	for _, upstream := range []*dnsExchanger{fallback, corp, lab} {
+		for _, query := range upstream.queries {
+			if query.Id == 4242 {
+				t.Errorf("the id of the client was sent upstream")
+			}
+		}
+	}
+
+	reply, err := f.exchange(context.Background(), new(dns.Msg).SetReply(new(dns.Msg).SetQuestion("example.", dns.TypeA)))
+	if err == nil || reply.Rcode != dns.RcodeFormatError {
+		t.Errorf("answer to a response: %v, %v, want FORMERR", reply, err)
+	}
+}
+
+// chanWriter hands the packets written to the client to the test.
+type chanWriter chan []byte
+
+func (w chanWriter) WritePacket(bs []byte, remote netip.AddrPort) {
+	w <- append([]byte(nil), bs...)
+}
+
+// read returns the next answer and its size on the wire.
+func (w chanWriter) read(t *testing.T) (*dns.Msg, int) {
+	t.Helper()
+	select {
+	case p := <-w:
+		reply := new(dns.Msg)
+		if err := reply.Unpack(p); err != nil {
+			t.Fatal(err)
+		}
+		return reply, len(p)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no answer")
+		return nil, 0
+	}
+}
+
+func packQuery(t *testing.T, request *dns.Msg) []byte {
+	t.Helper()
+	pack, err := request.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pack
+}
+
+func TestDNSPacketHandlerTruncate(t *testing.T) {
+	h := newTestHandler(t)
+	f := newTestForwarder(&dnsExchanger{n: 1, count: 200}, 1)
+	handler := h.DNSPacketHandler(true, slog.New(slog.DiscardHandler), f)
+	client := netip.MustParseAddrPort("192.0.2.100:1000")
+	w := make(chanWriter, 1)
+
+	// without EDNS0 the answer is cut to 512 bytes
+	handler.HandlePacketOOb(nil, packQuery(t, new(dns.Msg).SetQuestion("many.example.", dns.TypeA)), client, w)
+	reply, size := w.read(t)
+	if !reply.Truncated || size > dns.MinMsgSize {
+		t.Errorf("truncated %v, %d bytes, want truncated to %d", reply.Truncated, size, dns.MinMsgSize)
+	}
+
+	// the payload size of the client applies
+	request := new(dns.Msg).SetQuestion("many.example.", dns.TypeA)
+	request.SetEdns0(4096, false)
+	handler.HandlePacketOOb(nil, packQuery(t, request), client, w)
+	reply, _ = w.read(t)
+	if reply.Truncated || len(reply.Answer) != 200 {
+		t.Errorf("truncated %v, %d records, want all 200", reply.Truncated, len(reply.Answer))
+	}
+	if opt := reply.IsEdns0(); opt == nil || opt.UDPSize() != constant.ResolverDefaultUDPSize {
+		t.Errorf("EDNS0 record %v, want the payload size %d", opt, constant.ResolverDefaultUDPSize)
+	}
+}
+
+func TestDNSPacketHandlerInflight(t *testing.T) {
+	h := newTestHandler(t)
+	gate := make(chan struct{})
+	upstream := &dnsExchanger{n: 1, hold: map[string]chan struct{}{"slow.example.": gate}}
+	handler := h.DNSPacketHandler(true, slog.New(slog.DiscardHandler), newTestForwarder(upstream, 2))
+	client := netip.MustParseAddrPort("192.0.2.100:1000")
+	w := make(chanWriter, 3)
+
+	query := packQuery(t, new(dns.Msg).SetQuestion("slow.example.", dns.TypeA))
+	for range 3 {
+		handler.HandlePacketOOb(nil, query, client, w)
+	}
+	waitFor(t, "the queries", func() bool { return upstream.queried() == 2 })
+	close(gate)
+	w.read(t)
+	w.read(t)
+	// the query beyond the limit was dropped
+	select {
+	case <-w:
+		t.Error("a query beyond the inflight limit was answered")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := upstream.queried(); n != 2 {
+		t.Errorf("%d queries forwarded, want 2", n)
+	}
+}
+
+// TestDNSConnHandlerPipeline sends two queries on one tcp connection, the second is
+// answered while the first waits for its upstream.
+func TestDNSConnHandlerPipeline(t *testing.T) {
+	h := newTestHandler(t)
+	gate := make(chan struct{})
+	upstream := &dnsExchanger{n: 1, hold: map[string]chan struct{}{"slow.example.": gate}}
+	handler := h.DNSConnHandler(true, slog.New(slog.DiscardHandler), BindConfig{}, newTestForwarder(upstream, 4))
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			handler.HandleConn(h.ctx, conn)
+		}
+	}()
+	conn, err := dns.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for i, name := range []string{"slow.example.", "fast.example."} {
+		request := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		request.Id = uint16(i + 1)
+		if err = conn.WriteMsg(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var answered []string
+	for range 2 {
+		reply, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := uint16(len(answered) + 1); reply.Id != 3-want {
+			t.Errorf("answer %d has the id %d, want %d", len(answered), reply.Id, 3-want)
+		}
+		answered = append(answered, reply.Question[0].Name)
+		if len(answered) == 1 {
+			close(gate)
+		}
+	}
+	if answered[0] != "fast.example." || answered[1] != "slow.example." {
+		t.Errorf("answered %v, want the fast query first", answered)
+	}
+}
@@ -3,12 +3,15 @@ module github.com/woshikedayaa/traffics
 go 1.24.0
 
 require (
-	github.com/metacubex/tfo-go v0.0.0-20250516165257-e29c16ae41d4 // indirect
-	github.com/miekg/dns v1.1.66 // indirect
-	github.com/sagernet/sing v0.6.11 // indirect
+	github.com/metacubex/tfo-go v0.0.0-20250516165257-e29c16ae41d4
+	github.com/miekg/dns v1.1.66
+	github.com/sagernet/sing v0.6.11
+	golang.org/x/sys v0.33.0
+)
+
+require (
 	golang.org/x/mod v0.25.0 // indirect
 	golang.org/x/net v0.41.0 // indirect
 	golang.org/x/sync v0.15.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
 )
@@ -116,7 +116,7 @@ func main() {
 		slog.Error("start traffics failed", slog.String("error", err.Error()))
 		return
 	}
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, unix.SIGINT, os.Interrupt, unix.SIGSTOP, unix.SIGKILL, unix.SIGTERM)
 
 	<-ch
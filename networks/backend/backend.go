@@ -0,0 +1,285 @@
+package backend
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"log/slog"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is an address of a Set with its health.
+type Backend struct {
+	Endpoint
+
+	failures  atomic.Int32
+	downUntil atomic.Int64 // unix nano
+}
+
+func (b *Backend) Healthy(now time.Time) bool {
+	return now.UnixNano() >= b.downUntil.Load()
+}
+
+// Report records the result of a connection to the backend. A failed backend is avoided
+// for a while, the while doubles on every failure in a row.
+func (b *Backend) Report(err error) {
+	if err == nil {
+		b.failures.Store(0)
+		b.downUntil.Store(0)
+		return
+	}
+	failures := b.failures.Add(1)
+	down := constant.BackendDownTime << min(failures-1, 6)
+	b.downUntil.Store(time.Now().Add(min(down, constant.BackendDownTimeMax)).UnixNano())
+}
+
+type Options struct {
+	Source Source
+	// Fallback dials the address as is while the Set has no backend,
+	// otherwise such dials fail.
+	Fallback bool
+	// HealthCheck is the interval of active health checks, 0 to only check passively by dials
+	HealthCheck time.Duration
+	// Check probes a backend for an active health check
+	Check func(ctx context.Context, addr netip.AddrPort) error
+	// OnChange is called after a re-resolution changed the backends
+	OnChange func(added []netip.AddrPort, removed []netip.AddrPort)
+	Logger   *slog.Logger
+}
+
+// Set is the backends of a Source. The source is looked up again when its answer expires,
+// or every constant.BackendResolveInterval if the ttl is unknown.
+type Set struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	options Options
+
+	backends atomic.Pointer[[]*Backend]
+	next     atomic.Uint64
+	wg       sync.WaitGroup
+	// ready is closed after the first lookup
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func New(ctx context.Context, options Options) *Set {
+	ctx, cancel := context.WithCancel(ctx)
+	if options.Logger == nil {
+		options.Logger = slog.New(slog.DiscardHandler)
+	}
+	s := &Set{ctx: ctx, cancel: cancel, options: options, ready: make(chan struct{})}
+	s.backends.Store(&[]*Backend{})
+	return s
+}
+
+// Start resolves the hostname in background, and starts the active health checks if enabled.
+func (s *Set) Start() {
+	s.wg.Add(1)
+	go s.loopResolve()
+	if s.options.HealthCheck > 0 && s.options.Check != nil {
+		s.wg.Add(1)
+		go s.loopCheck()
+	}
+}
+
+func (s *Set) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *Set) Backends() []*Backend {
+	return *s.backends.Load()
+}
+
+// Ready is closed once the source was looked up, successfully or not.
+func (s *Set) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Pick returns the next backend of the family of network, healthy backends first.
+// Among the backends of the lowest priority, it picks by weight (RFC 2782),
+// or by round robin if they have no weight.
+// Backends in exclude are skipped, it returns nil if there is no backend left.
+func (s *Set) Pick(network string, exclude []*Backend) *Backend {
+	var (
+		now       = time.Now()
+		healthy   []*Backend
+		unhealthy []*Backend
+	)
+	for _, b := range s.Backends() {
+		if slices.Contains(exclude, b) || !matchFamily(network, b.Addr.Addr()) {
+			continue
+		}
+		if b.Healthy(now) {
+			healthy = append(healthy, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = unhealthy
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	priority := slices.MinFunc(candidates, func(a, b *Backend) int { return cmp.Compare(a.Priority, b.Priority) }).Priority
+	candidates = slices.DeleteFunc(candidates, func(b *Backend) bool { return b.Priority != priority })
+	var total uint64
+	for _, b := range candidates {
+		total += uint64(b.Weight)
+	}
+	if total == 0 {
+		return candidates[(s.next.Add(1)-1)%uint64(len(candidates))]
+	}
+	// RFC 2782: backends of weight 0 go first and are picked only if the random number is 0
+	slices.SortStableFunc(candidates, func(a, b *Backend) int {
+		return cmp.Compare(min(a.Weight, 1), min(b.Weight, 1))
+	})
+	var (
+		n   = rand.Uint64N(total + 1)
+		sum uint64
+	)
+	for _, b := range candidates {
+		sum += uint64(b.Weight)
+		if sum >= n {
+			return b
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+func matchFamily(network string, addr netip.Addr) bool {
+	if network == "" {
+		return true
+	}
+	switch network[len(network)-1] {
+	case '4':
+		return addr.Is4()
+	case '6':
+		return addr.Is6()
+	default:
+		return true
+	}
+}
+
+func (s *Set) loopResolve() {
+	defer s.wg.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(s.resolve())
+	}
+}
+
+// resolve updates the backends and returns when to resolve again.
+// The backends are kept if the source fails to resolve, and cleared if it is unavailable.
+func (s *Set) resolve() time.Duration {
+	defer s.readyOnce.Do(func() { close(s.ready) })
+	ctx, cancel := context.WithTimeout(s.ctx, constant.ResolverDefaultReadTimeout)
+	defer cancel()
+	endpoints, ttl, err := s.options.Source.Lookup(ctx)
+	if err == nil && len(endpoints) == 0 {
+		err = errors.New("no address")
+	}
+	if errors.Is(err, ErrUnavailable) {
+		// an answer that there is no backend, unlike a failed lookup
+		endpoints, err = nil, nil
+	}
+	if err != nil {
+		if s.ctx.Err() == nil {
+			s.options.Logger.Warn("resolve backends failed, keep the last ones",
+				slog.String("source", s.options.Source.String()), slog.String("error", err.Error()))
+		}
+		return constant.BackendResolveRetry
+	}
+	added, removed := s.update(endpoints)
+	if len(added) > 0 || len(removed) > 0 {
+		s.options.Logger.Info("backends updated", slog.String("source", s.options.Source.String()),
+			slog.Any("added", added), slog.Any("removed", removed))
+		if s.options.OnChange != nil {
+			s.options.OnChange(added, removed)
+		}
+	}
+	if ttl == 0 {
+		return constant.BackendResolveInterval
+	}
+	return max(ttl, constant.BackendMinResolveInterval)
+}
+
+// update replaces the backends by endpoints, backends that stay keep their health.
+func (s *Set) update(endpoints []Endpoint) (added []netip.AddrPort, removed []netip.AddrPort) {
+	old := s.Backends()
+	backends := make([]*Backend, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		endpoint.Addr = netip.AddrPortFrom(endpoint.Addr.Addr().Unmap(), endpoint.Addr.Port())
+		if slices.ContainsFunc(backends, func(b *Backend) bool { return b.Addr == endpoint.Addr }) {
+			continue
+		}
+		index := slices.IndexFunc(old, func(b *Backend) bool { return b.Addr == endpoint.Addr })
+		if index >= 0 && old[index].Endpoint == endpoint {
+			backends = append(backends, old[index])
+			continue
+		}
+		if index >= 0 {
+			// priority or weight changed, keep the health
+			b := &Backend{Endpoint: endpoint}
+			b.failures.Store(old[index].failures.Load())
+			b.downUntil.Store(old[index].downUntil.Load())
+			backends = append(backends, b)
+			continue
+		}
+		backends = append(backends, &Backend{Endpoint: endpoint})
+		added = append(added, endpoint.Addr)
+	}
+	for _, b := range old {
+		if !slices.ContainsFunc(backends, func(n *Backend) bool { return n.Addr == b.Addr }) {
+			removed = append(removed, b.Addr)
+		}
+	}
+	s.backends.Store(&backends)
+	return added, removed
+}
+
+func (s *Set) loopCheck() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.options.HealthCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, b := range s.Backends() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(s.ctx, min(s.options.HealthCheck, constant.BackendHealthCheckTimeout))
+				defer cancel()
+				err := s.options.Check(ctx, b.Addr)
+				if s.ctx.Err() != nil {
+					return
+				}
+				if err != nil && b.Healthy(time.Now()) {
+					s.options.Logger.Warn("backend health check failed",
+						slog.String("backend", b.Addr.String()), slog.String("error", err.Error()))
+				}
+				b.Report(err)
+			}()
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// srvExchanger answers SRV queries with a record of each target.
+type srvExchanger struct {
+	targets []string
+}
+
+func (e *srvExchanger) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	reply := new(dns.Msg).SetReply(request)
+	for _, target := range e.targets {
+		reply.Answer = append(reply.Answer, &dns.SRV{
+			Hdr:    dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 60},
+			Port:   443,
+			Target: target,
+		})
+		if target != "." {
+			reply.Extra = append(reply.Extra, &dns.A{
+				Hdr: dns.RR_Header{Name: target, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, byte(len(reply.Extra)+1)),
+			})
+		}
+	}
+	return reply, nil
+}
+
+// TestSetUnavailable checks that a lone SRV target of "." clears the backends,
+// while a failed lookup keeps them.
+func TestSetUnavailable(t *testing.T) {
+	exchanger := &srvExchanger{targets: []string{"a.example.", "b.example."}}
+	s := New(context.Background(), Options{Source: &SRVSource{Name: "_svc._tcp.example.", Exchanger: exchanger}})
+	if next := s.resolve(); len(s.Backends()) != 2 || next != time.Minute {
+		t.Fatalf("%d backends, next lookup in %s, want 2 in 1m", len(s.Backends()), next)
+	}
+
+	exchanger.targets = nil
+	s.resolve()
+	if len(s.Backends()) != 2 {
+		t.Fatalf("an empty answer left %d backends, want the 2 last ones", len(s.Backends()))
+	}
+
+	exchanger.targets = []string{"."}
+	if next := s.resolve(); len(s.Backends()) != 0 || next != time.Minute {
+		t.Fatalf("target . left %d backends, next lookup in %s, want none in 1m", len(s.Backends()), next)
+	}
+	if b := s.Pick("tcp", nil); b != nil {
+		t.Errorf("picked %s from an unavailable service", b.Addr)
+	}
+}
+
+func TestSRVSourceProtocol(t *testing.T) {
+	for name, want := range map[string]string{
+		"_sip._tcp.example.com":  "tcp",
+		"_sip._UDP.example.com.": "udp",
+		"_sip._tls.example.com":  "tls",
+		"sip.example.com":        "",
+		"_sip":                   "",
+	} {
+		if protocol := (&SRVSource{Name: name}).Protocol(); protocol != want {
+			t.Errorf("protocol of %s is %q, want %q", name, protocol, want)
+		}
+	}
+}
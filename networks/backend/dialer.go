@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"github.com/woshikedayaa/traffics/networks/dialer"
+	"net"
+	"net/netip"
+)
+
+// Dialer dials address on the backends of a Set. A failed dial is tried on the next backend,
+// up to constant.BackendMaxAttempts backends. Dials wait for the first lookup of the Set,
+// if it has no backend then, address is dialed as is if the Set falls back, or the dial fails.
+// Other addresses are dialed by the underlying dialer as is.
+type Dialer struct {
+	dialer.Dialer
+	set     *Set
+	address string
+}
+
+var _ dialer.EarlyDataDialer = (*Dialer)(nil)
+
+func NewDialer(d dialer.Dialer, set *Set, address string) *Dialer {
+	return &Dialer{Dialer: d, set: set, address: address}
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dial(ctx, network, address, func(address string) (net.Conn, error) {
+		return d.Dialer.DialContext(ctx, network, address)
+	})
+}
+
+func (d *Dialer) TFO() bool {
+	early, ok := d.Dialer.(dialer.EarlyDataDialer)
+	return ok && early.TFO()
+}
+
+func (d *Dialer) DialContextEarly(ctx context.Context, network, address string, data []byte) (net.Conn, error) {
+	early, ok := d.Dialer.(dialer.EarlyDataDialer)
+	if !ok {
+		return d.DialContext(ctx, network, address)
+	}
+	return d.dial(ctx, network, address, func(address string) (net.Conn, error) {
+		return early.DialContextEarly(ctx, network, address, data)
+	})
+}
+
+func (d *Dialer) dial(ctx context.Context, network, address string, dial func(address string) (net.Conn, error)) (net.Conn, error) {
+	if address != d.address {
+		return dial(address)
+	}
+	if err := d.waitReady(ctx); err != nil {
+		return nil, err
+	}
+	var (
+		tried []*Backend
+		errs  []error
+	)
+	for len(tried) < constant.BackendMaxAttempts {
+		b := d.set.Pick(network, tried)
+		if b == nil {
+			break
+		}
+		tried = append(tried, b)
+		conn, err := dial(b.Addr.String())
+		if ctx.Err() != nil {
+			// canceled, not a fault of the backend
+			return conn, err
+		}
+		b.Report(err)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(tried) == 0 {
+		if !d.set.options.Fallback {
+			return nil, errNoBackend
+		}
+		return dial(address)
+	}
+	return nil, errors.Join(errs...)
+}
+
+var errNoBackend = errors.New("backend: no backend available")
+
+func (d *Dialer) waitReady(ctx context.Context) error {
+	select {
+	case <-d.set.Ready():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Resolve returns the next backend for address.
+func (d *Dialer) Resolve(ctx context.Context, network, address string) (netip.AddrPort, error) {
+	if address != d.address {
+		return d.Dialer.Resolve(ctx, network, address)
+	}
+	if err := d.waitReady(ctx); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if b := d.set.Pick(network, nil); b != nil {
+		return b.Addr, nil
+	}
+	if !d.set.options.Fallback {
+		return netip.AddrPort{}, errNoBackend
+	}
+	return d.Dialer.Resolve(ctx, network, address)
+}
@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/woshikedayaa/traffics/networks/resolver"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Endpoint is an address to connect to, with its SRV priority and weight.
+type Endpoint struct {
+	Addr     netip.AddrPort
+	Priority uint16
+	Weight   uint16
+}
+
+// ErrUnavailable is returned by a Source whose answer says there is no endpoint,
+// such as a lone SRV target of ".".
+var ErrUnavailable = errors.New("service is not available")
+
+// Source finds the endpoints of a Set.
+type Source interface {
+	// Lookup returns the endpoints and how long they are valid, 0 if unknown.
+	// It returns ErrUnavailable with the ttl if the answer clears the endpoints.
+	Lookup(ctx context.Context) ([]Endpoint, time.Duration, error)
+	String() string
+}
+
+// HostSource is every address of a hostname.
+type HostSource struct {
+	Host     string
+	Port     uint16
+	Resolver resolver.Resolver
+	Strategy resolver.Strategy
+}
+
+func (s *HostSource) Lookup(ctx context.Context) ([]Endpoint, time.Duration, error) {
+	A, AAAA, ttl, err := lookupTTL(ctx, s.Resolver, s.Host, s.Strategy)
+	if err != nil {
+		return nil, 0, err
+	}
+	endpoints := make([]Endpoint, 0, len(A)+len(AAAA))
+	for _, addresses := range [][]netip.Addr{A, AAAA} {
+		for _, addr := range addresses {
+			endpoints = append(endpoints, Endpoint{Addr: netip.AddrPortFrom(addr, s.Port)})
+		}
+	}
+	return endpoints, ttl, nil
+}
+
+func (s *HostSource) String() string {
+	return s.Host
+}
+
+// SRVSource is the targets of the SRV records of a name such as _service._proto.example.com.
+// SRV records are queried with Exchanger, targets without address records in the answer
+// are resolved with Resolver.
+type SRVSource struct {
+	Name      string
+	Exchanger resolver.Exchanger
+	Resolver  resolver.Resolver
+	Strategy  resolver.Strategy
+}
+
+func (s *SRVSource) Lookup(ctx context.Context) ([]Endpoint, time.Duration, error) {
+	request := new(dns.Msg)
+	request.SetQuestion(dns.Fqdn(s.Name), dns.TypeSRV)
+	answer, err := s.Exchanger.Exchange(ctx, request)
+	if err != nil {
+		return nil, 0, err
+	}
+	if answer.Rcode != dns.RcodeSuccess {
+		return nil, 0, resolver.RcodeError(answer.Rcode)
+	}
+
+	var (
+		records []*dns.SRV
+		ttl     time.Duration
+		glue    = make(map[string][]netip.Addr)
+	)
+	minTTL := func(t time.Duration) {
+		if ttl == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	for _, rr := range answer.Answer {
+		if srv, ok := rr.(*dns.SRV); ok {
+			records = append(records, srv)
+			minTTL(time.Duration(srv.Hdr.Ttl) * time.Second)
+		}
+	}
+	for _, rr := range answer.Extra {
+		switch record := rr.(type) {
+		case *dns.A:
+			if addr, ok := netip.AddrFromSlice(record.A); ok && s.Strategy != resolver.StrategyIPv6Only {
+				glue[dns.CanonicalName(record.Hdr.Name)] = append(glue[dns.CanonicalName(record.Hdr.Name)], addr.Unmap())
+			}
+		case *dns.AAAA:
+			if addr, ok := netip.AddrFromSlice(record.AAAA); ok && s.Strategy != resolver.StrategyIPv4Only {
+				glue[dns.CanonicalName(record.Hdr.Name)] = append(glue[dns.CanonicalName(record.Hdr.Name)], addr)
+			}
+		}
+	}
+	if len(records) == 1 && records[0].Target == "." {
+		// RFC 2782: the service is decidedly not available
+		return nil, ttl, ErrUnavailable
+	}
+
+	var (
+		endpoints []Endpoint
+		errs      []error
+	)
+	for _, srv := range records {
+		addresses := glue[dns.CanonicalName(srv.Target)]
+		if len(addresses) == 0 {
+			A, AAAA, targetTTL, err := lookupTTL(ctx, s.Resolver, srv.Target, s.Strategy)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", srv.Target, err))
+				continue
+			}
+			if targetTTL > 0 {
+				minTTL(targetTTL)
+			}
+			addresses = append(A, AAAA...)
+		}
+		for _, addr := range addresses {
+			endpoints = append(endpoints, Endpoint{
+				Addr:     netip.AddrPortFrom(addr, srv.Port),
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+			})
+		}
+	}
+	if len(endpoints) == 0 && len(errs) > 0 {
+		return nil, 0, errors.Join(errs...)
+	}
+	return endpoints, ttl, nil
+}
+
+// Protocol returns the protocol label of the name without its underscore, such as tcp or udp,
+// empty if the name has none.
+func (s *SRVSource) Protocol() string {
+	labels := dns.SplitDomainName(s.Name)
+	if len(labels) < 2 || !strings.HasPrefix(labels[1], "_") {
+		return ""
+	}
+	return strings.ToLower(labels[1][1:])
+}
+
+func (s *SRVSource) String() string {
+	return "srv://" + s.Name
+}
+
+func lookupTTL(ctx context.Context, r resolver.Resolver, host string, strategy resolver.Strategy) (
+	A []netip.Addr, AAAA []netip.Addr, ttl time.Duration, err error) {
+	if ttlResolver, ok := r.(resolver.TTLResolver); ok {
+		return ttlResolver.LookupTTL(ctx, host, strategy)
+	}
+	A, AAAA, err = r.Lookup(ctx, host, strategy)
+	return A, AAAA, 0, err
+}
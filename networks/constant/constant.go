@@ -7,11 +7,155 @@ const (
 	KeepAliveInterval   = 75 * time.Second
 	KeepAliveProbeCount = 16
 
-	DialerDefaultTimeout       = 5 * time.Second
+	DialerDefaultTimeout = 5 * time.Second
+	// DialRetryBackoff is the delay before the first retry of a failed dial,
+	// it doubles on every retry up to DialRetryBackoffMax.
+	DialRetryBackoff           = 100 * time.Millisecond
+	DialRetryBackoffMax        = 2 * time.Second
 	ResolverDefaultReadTimeout = 5 * time.Second
+	ResolvConfPath             = "/etc/resolv.conf"
+	// ResolverDefaultUDPSize is the EDNS0 udp payload size that avoids ip fragmentation (DNS Flag Day 2020).
+	ResolverDefaultUDPSize = 1232
+	// ResolverServerTimeout is how long a dns server is waited before the next one is tried,
+	// it is shortened to a few round trips once the latency of the server is known.
+	ResolverServerTimeout    = 2 * time.Second
+	ResolverServerMinTimeout = 500 * time.Millisecond
+	// ResolverServerDownTime is how long a failed dns server is skipped,
+	// it doubles on every failure in a row up to ResolverServerDownTimeMax.
+	ResolverServerDownTime    = 5 * time.Second
+	ResolverServerDownTimeMax = 2 * time.Minute
+	// ResolverCacheSize is the default number of answers a dns cache holds.
+	ResolverCacheSize = 1024
+	// ResolverCacheMaxTTL is the default longest time an answer is cached.
+	ResolverCacheMaxTTL = 24 * time.Hour
+	// ResolverNegativeMaxTTL is the longest time a negative answer is cached (RFC 2308 section 5).
+	ResolverNegativeMaxTTL = 3 * time.Hour
+	// ResolverStaleAnswerTTL is the ttl reported for a stale answer (RFC 8767 section 4).
+	ResolverStaleAnswerTTL = 30 * time.Second
+	// ResolverPrefetchHits is how many hits make an answer refreshed before it expires.
+	ResolverPrefetchHits = 8
+	// HostsCheckInterval is how often a hosts file is checked for changes.
+	HostsCheckInterval = 5 * time.Second
+
+	// DialerLatencyTableSize is the number of addresses whose connect time is remembered,
+	// for DialerLatencyMaxAge after their last connect.
+	DialerLatencyTableSize = 256
+	DialerLatencyMaxAge    = 10 * time.Minute
+	// DialerSourceCacheSize is the number of destinations whose source address is remembered
+	// for DialerSourceCacheTTL, to sort the addresses of a name without a syscall per address.
+	DialerSourceCacheSize = 256
+	DialerSourceCacheTTL  = 10 * time.Second
+
+	// BackendResolveInterval is how often the backends of a hostname are resolved
+	// if the resolver has no ttl, answers with a ttl are resolved again when they expire
+	// but not more often than BackendMinResolveInterval.
+	BackendResolveInterval    = 30 * time.Second
+	BackendMinResolveInterval = time.Second
+	// BackendResolveRetry is how long a failed resolution of backends is retried after.
+	BackendResolveRetry = 5 * time.Second
+	// BackendDownTime is how long a failed backend is avoided,
+	// it doubles on every failure in a row up to BackendDownTimeMax.
+	BackendDownTime           = 5 * time.Second
+	BackendDownTimeMax        = time.Minute
+	BackendHealthCheckTimeout = 3 * time.Second
+	// BackendMaxAttempts is the number of backends a dial tries.
+	BackendMaxAttempts = 3
+
+	// UDPSessionPendingSize is the max number of datagrams buffered for
+	// a udp session while its upstream connection is still being dialed.
+	UDPSessionPendingSize = 64
+
+	// TFOEarlyDataTimeout is how long an accepted connection is waited for
+	// its first bytes, which are sent in the SYN of the upstream connection.
+	TFOEarlyDataTimeout = 50 * time.Millisecond
+	TFOEarlyDataSize    = 1400
+
+	// PoolDefaultIdleTimeout is how long a pooled connection is kept idle,
+	// below the idle timeout of most servers and middleboxes.
+	PoolDefaultIdleTimeout = 30 * time.Second
+	// PoolStatsInterval is how often the stats of a connection pool are logged.
+	PoolStatsInterval = time.Minute
+
+	// DNSTCPIdleTimeout is how long a tcp connection of a dns bind is kept without query (RFC 7766 section 6.2.3).
+	DNSTCPIdleTimeout = 10 * time.Second
+	// DNSMaxInflight is the max number of queries a dns bind forwards at the same time,
+	// more udp queries are dropped.
+	DNSMaxInflight = 1024
+
+	// HappyEyeballsAttemptDelay and HappyEyeballsResolutionDelay are the defaults recommended by RFC 8305.
+	HappyEyeballsAttemptDelay    = 250 * time.Millisecond
+	HappyEyeballsResolutionDelay = 50 * time.Millisecond
+	// HappyEyeballsMinAttemptDelay is the lower bound of the connection attempt delay in RFC 8305 section 5.
+	HappyEyeballsMinAttemptDelay = 10 * time.Millisecond
 )
 
 const (
 	FamilyIPv4 = "4"
 	FamilyIPv6 = "6"
 )
+
+// UDPFilter decides which replies of an unconnected udp session are
+// relayed back to the client, see RFC 4787 section 5.
+type UDPFilter string
+
+const (
+	// UDPFilterEndpointIndependent relays replies from any address and port.
+	UDPFilterEndpointIndependent UDPFilter = "endpoint_independent"
+	// UDPFilterAddressDependent relays replies from any port of the remote address.
+	UDPFilterAddressDependent UDPFilter = "address_dependent"
+	// UDPFilterAddressPortDependent relays replies from the remote address and port only.
+	UDPFilterAddressPortDependent UDPFilter = "address_port_dependent"
+)
+
+// UDPNAT is the nat behaviour of udp sessions, named after RFC 3489.
+// All but symmetric keep an endpoint-independent mapping: a client is seen
+// from the same upstream address and port for the whole session, whoever it talks to.
+type UDPNAT string
+
+const (
+	// UDPNATSymmetric uses a connected socket per session.
+	UDPNATSymmetric UDPNAT = "symmetric"
+	// UDPNATFullCone is endpoint-independent mapping and filtering.
+	UDPNATFullCone UDPNAT = "full_cone"
+	// UDPNATRestrictedCone is endpoint-independent mapping and address-dependent filtering.
+	UDPNATRestrictedCone UDPNAT = "restricted_cone"
+	// UDPNATPortRestrictedCone is endpoint-independent mapping and address and port-dependent filtering.
+	UDPNATPortRestrictedCone UDPNAT = "port_restricted_cone"
+)
+
+// Filter returns the filtering behaviour of n, it is empty for a connected socket.
+func (n UDPNAT) Filter() (UDPFilter, bool) {
+	switch n {
+	case "", UDPNATSymmetric:
+		return "", true
+	case UDPNATFullCone:
+		return UDPFilterEndpointIndependent, true
+	case UDPNATRestrictedCone:
+		return UDPFilterAddressDependent, true
+	case UDPNATPortRestrictedCone:
+		return UDPFilterAddressPortDependent, true
+	default:
+		return "", false
+	}
+}
+
+// BindMode is how a bind handles its traffic.
+type BindMode string
+
+const (
+	// BindModeForward relays the traffic to the remote as is.
+	BindModeForward BindMode = "forward"
+	// BindModeDNS answers dns queries from a cache and forwards the misses to the remote.
+	BindModeDNS BindMode = "dns"
+)
+
+// DNSTransport is how a dns bind sends queries to a remote.
+type DNSTransport string
+
+const (
+	// DNSTransportUDP is plain dns over udp, truncated answers are queried again over tcp.
+	DNSTransportUDP   DNSTransport = "udp"
+	DNSTransportTCP   DNSTransport = "tcp"
+	DNSTransportTLS   DNSTransport = "tls"
+	DNSTransportHTTPS DNSTransport = "https"
+)
@@ -0,0 +1,222 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// RFC 6724 destination address selection.
+
+type policy struct {
+	prefix     netip.Prefix
+	precedence uint8
+	label      uint8
+}
+
+// policyTable is the default policy table of RFC 6724 section 2.1,
+// sorted by prefix length in descending order so that the first match is the longest.
+var policyTable = []policy{
+	{netip.MustParsePrefix("::1/128"), 50, 0},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 35, 4},
+	{netip.MustParsePrefix("::/96"), 1, 3},
+	{netip.MustParsePrefix("2001::/32"), 5, 5},
+	{netip.MustParsePrefix("2002::/16"), 30, 2},
+	{netip.MustParsePrefix("3ffe::/16"), 1, 12},
+	{netip.MustParsePrefix("fec0::/10"), 1, 11},
+	{netip.MustParsePrefix("fc00::/7"), 3, 13},
+	{netip.MustParsePrefix("::/0"), 40, 1},
+}
+
+func classify(addr netip.Addr) policy {
+	if addr.Is4() {
+		addr = netip.AddrFrom16(addr.As16())
+	}
+	for _, p := range policyTable {
+		if p.prefix.Contains(addr) {
+			return p
+		}
+	}
+	return policy{}
+}
+
+const (
+	scopeLinkLocal = 0x2
+	scopeSiteLocal = 0x5
+	scopeGlobal    = 0xe
+)
+
+var siteLocalPrefix = netip.MustParsePrefix("fec0::/10")
+
+func scope(addr netip.Addr) uint8 {
+	addr = addr.Unmap()
+	if addr.Is4() {
+		// RFC 6724 section 3.2
+		if addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+			return scopeLinkLocal
+		}
+		return scopeGlobal
+	}
+	switch {
+	case addr.IsMulticast():
+		return addr.As16()[1] & 0xf
+	case addr.IsLoopback(), addr.IsLinkLocalUnicast():
+		return scopeLinkLocal
+	case siteLocalPrefix.Contains(addr):
+		return scopeSiteLocal
+	default:
+		return scopeGlobal
+	}
+}
+
+func commonPrefixLen(a, b netip.Addr) int {
+	as, bs := a.As16(), b.As16()
+	n := 0
+	for i := range as {
+		x := as[i] ^ bs[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// sourceAddress returns the address the kernel would send from to reach addr,
+// with the bind settings of the dialer. Connecting a udp socket sends nothing,
+// the answer is cached for a short time as routes rarely change.
+func (d *DefaultDialer) sourceAddress(ctx context.Context, addr netip.Addr) netip.Addr {
+	if source, ok := d.sources.Load(addr); ok {
+		return source
+	}
+	source := d.lookupSource(ctx, addr)
+	if ctx.Err() == nil {
+		d.sources.Store(addr, source)
+	}
+	return source
+}
+
+func (d *DefaultDialer) lookupSource(ctx context.Context, addr netip.Addr) netip.Addr {
+	udpDialer := &d.udpDialer6
+	if addr.Is4() {
+		udpDialer = &d.udpDialer4
+	}
+	conn, err := udpDialer.DialContext(ctx, "udp", netip.AddrPortFrom(addr, 9).String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	defer conn.Close()
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return netip.Addr{}
+	}
+	return local.AddrPort().Addr().Unmap()
+}
+
+// sortAddresses sorts addresses with the destination address selection rules of RFC 6724 section 6.
+// Rules about deprecated, home and native transport addresses are not applied.
+func (d *DefaultDialer) sortAddresses(ctx context.Context, addresses []netip.Addr) []netip.Addr {
+	if len(addresses) < 2 {
+		return addresses
+	}
+	type candidate struct {
+		addr   netip.Addr
+		source netip.Addr
+		policy policy
+		scope  uint8
+	}
+	candidates := make([]candidate, len(addresses))
+	for i, addr := range addresses {
+		addr = addr.Unmap()
+		candidates[i] = candidate{
+			addr:   addr,
+			source: d.sourceAddress(ctx, addr),
+			policy: classify(addr),
+			scope:  scope(addr),
+		}
+	}
+
+	// each rule returns -1 if a is preferred, 1 if b is preferred and 0 to check the next rule
+	prefer := func(ok bool) int {
+		if ok {
+			return -1
+		}
+		return 1
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		// rule 1: avoid unusable destinations
+		if a.source.IsValid() != b.source.IsValid() {
+			return prefer(a.source.IsValid())
+		}
+		if !a.source.IsValid() {
+			return 0
+		}
+		// rule 2: prefer matching scope
+		aMatch, bMatch := a.scope == scope(a.source), b.scope == scope(b.source)
+		if aMatch != bMatch {
+			return prefer(aMatch)
+		}
+		// rule 5: prefer matching label
+		aMatch, bMatch = a.policy.label == classify(a.source).label, b.policy.label == classify(b.source).label
+		if aMatch != bMatch {
+			return prefer(aMatch)
+		}
+		// rule 6: prefer higher precedence
+		if a.policy.precedence != b.policy.precedence {
+			return prefer(a.policy.precedence > b.policy.precedence)
+		}
+		// rule 8: prefer smaller scope
+		if a.scope != b.scope {
+			return prefer(a.scope < b.scope)
+		}
+		// rule 9: use longest matching prefix, only between ipv6 addresses as most implementations do
+		if a.addr.Is6() && b.addr.Is6() {
+			aLen, bLen := commonPrefixLen(a.addr, a.source), commonPrefixLen(b.addr, b.source)
+			if aLen != bLen {
+				return prefer(aLen > bLen)
+			}
+		}
+		// rule 10: otherwise, leave the order unchanged
+		return 0
+	})
+
+	sorted := make([]netip.Addr, len(candidates))
+	for i, c := range candidates {
+		sorted[i] = c.addr
+	}
+	return sorted
+}
+
+// interleave alternates the address families, starting with ipv4 if first4 is true (RFC 8305 section 4).
+func interleave(addresses []netip.Addr, first4 bool) []netip.Addr {
+	var ipv4, ipv6 []netip.Addr
+	for _, addr := range addresses {
+		if addr.Is4() {
+			ipv4 = append(ipv4, addr)
+		} else {
+			ipv6 = append(ipv6, addr)
+		}
+	}
+	first, second := ipv6, ipv4
+	if first4 {
+		first, second = ipv4, ipv6
+	}
+	result := make([]netip.Addr, 0, len(addresses))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			result = append(result, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			result = append(result, second[0])
+			second = second[1:]
+		}
+	}
+	return result
+}
@@ -7,22 +7,36 @@ import (
 	"fmt"
 	"github.com/metacubex/tfo-go"
 	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/cache"
 	"github.com/sagernet/sing/common/control"
 	"github.com/sagernet/sing/common/metadata"
 	"github.com/woshikedayaa/traffics/networks/constant"
 	"github.com/woshikedayaa/traffics/networks/resolver"
+	"github.com/woshikedayaa/traffics/networks/sockopt"
 	"net"
 	"net/netip"
 	"runtime"
+	"slices"
 	"strconv"
 	"time"
 )
 
-var tfoInitData = []byte{0}
-
 type Dialer interface {
 	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+	// ListenPacket creates an unconnected udp socket to talk with address,
+	// it binds to source if valid, otherwise to the bind address of the family of address.
 	ListenPacket(ctx context.Context, source netip.Addr, address string) (*net.UDPConn, error)
+	// Resolve returns the address a udp or tcp connection to address would be made to first.
+	Resolve(ctx context.Context, network, address string) (netip.AddrPort, error)
+}
+
+// EarlyDataDialer dials tcp connections carrying early data.
+// With TCP Fast Open enabled the data is sent in the SYN,
+// otherwise it is written right after the connection is established.
+type EarlyDataDialer interface {
+	Dialer
+	TFO() bool
+	DialContextEarly(ctx context.Context, network, address string, data []byte) (net.Conn, error)
 }
 
 type DialConfig struct {
@@ -32,14 +46,38 @@ type DialConfig struct {
 	Interface       string
 	BindAddress4    netip.Addr
 	BindAddress6    netip.Addr
+	// SourcePrefixes4 and SourcePrefixes6 are pools of local addresses,
+	// each dial binds to one of them picked by SourceSelection.
+	SourcePrefixes4 []netip.Prefix
+	SourcePrefixes6 []netip.Prefix
+	SourceSelection SourceSelection
 	FwMark          uint32
 	ReuseAddr       bool
+	Socket          sockopt.Options
+	// happy eyeballs, see RFC 8305
+	AttemptDelay    time.Duration
+	ResolutionDelay time.Duration
+	// AddressOrder is the order the addresses of a name are tried in, RFC 6724 if empty
+	AddressOrder AddressOrder
+	// MaxAttempts caps the connection attempts in flight, 0 means no limit
+	MaxAttempts int
+	// Retries is the number of times a failed dial is retried, Timeout bounds all of them.
+	// AttemptTimeout is the timeout of a single connection attempt,
+	// it defaults to Timeout split evenly over the attempts.
+	Retries         int
+	AttemptTimeout  time.Duration
+	RetryBackoff    time.Duration
+	RetryBackoffMax time.Duration
 	// tcp
 	TFO   bool
 	MPTCP bool
 
 	// udp
 	UDPFragment bool
+
+	// NAT64Prefix maps literal ipv4 addresses into it if valid,
+	// so that an ipv6 only host reaches them through NAT64
+	NAT64Prefix netip.Prefix
 }
 
 func NewDefault(config DialConfig) (*DefaultDialer, error) {
@@ -63,15 +101,17 @@ func NewDefault(config DialConfig) (*DefaultDialer, error) {
 		dialer.Control = control.Append(dialer.Control, control.RoutingMark(config.FwMark))
 		listener.Control = control.Append(listener.Control, control.RoutingMark(config.FwMark))
 	}
-	dialer.Timeout = cmp.Or(config.Timeout, constant.DialerDefaultTimeout)
-
-	// TODO: customize keepAlive(dialer)
-	dialer.KeepAliveConfig = net.KeepAliveConfig{
-		Enable:   true,
-		Idle:     constant.KeepAliveInitial,
-		Interval: constant.KeepAliveInterval,
-		Count:    constant.KeepAliveProbeCount,
+	config.Timeout = cmp.Or(config.Timeout, constant.DialerDefaultTimeout)
+	if config.AttemptTimeout == 0 && config.Retries > 0 {
+		// leave time for the retries, an attempt whose SYN was dropped would take all of it
+		config.AttemptTimeout = config.Timeout / time.Duration(config.Retries+1)
 	}
+	dialer.Timeout = cmp.Or(config.AttemptTimeout, config.Timeout)
+
+	dialer.KeepAliveConfig = config.Socket.KeepAliveConfig()
+	socketControl := config.Socket.Control()
+	dialer.Control = control.Append(dialer.Control, socketControl)
+	listener.Control = control.Append(listener.Control, socketControl)
 	if config.ReuseAddr {
 		listener.Control = control.Append(listener.Control, control.ReuseAddr())
 	}
@@ -84,12 +124,18 @@ func NewDefault(config DialConfig) (*DefaultDialer, error) {
 		dialer.SetMultipathTCP(true)
 	}
 
+	var latency *latencyTable
+	if config.AddressOrder == AddressOrderLatency {
+		latency = newLatencyTable()
+	}
+
+	// the per-family dialers inherit every option above and only differ in the bind address
 	var (
-		dialer4 net.Dialer
-		dialer6 net.Dialer
+		dialer4 = dialer
+		dialer6 = dialer
 
-		udpDialer4 net.Dialer
-		udpDialer6 net.Dialer
+		udpDialer4 = dialer
+		udpDialer6 = dialer
 
 		udpAddr4 string
 		udpAddr6 string
@@ -109,27 +155,50 @@ func NewDefault(config DialConfig) (*DefaultDialer, error) {
 		udpAddr6 = bind.String()
 	}
 
-	return &DefaultDialer{
+	d := &DefaultDialer{
 		defaultDialer: dialer,
+		listener:      listener,
 		dialer4: tfo.Dialer{
 			Dialer:     dialer4,
 			DisableTFO: !config.TFO,
+			Fallback:   true,
 		},
 		dialer6: tfo.Dialer{
 			Dialer:     dialer6,
 			DisableTFO: !config.TFO,
+			Fallback:   true,
 		},
 		udpDialer4:      udpDialer4,
 		udpDialer6:      udpDialer6,
 		udpAddr4:        udpAddr4,
 		udpAddr6:        udpAddr6,
+		sources4:        newSourcePool(config.SourcePrefixes4, config.SourceSelection),
+		sources6:        newSourcePool(config.SourcePrefixes6, config.SourceSelection),
 		resolver:        config.Resolver,
 		resolveStrategy: config.ResolveStrategy,
-	}, nil
+		socket:          config.Socket,
+		attemptDelay:    cmp.Or(config.AttemptDelay, constant.HappyEyeballsAttemptDelay),
+		resolutionDelay: cmp.Or(config.ResolutionDelay, constant.HappyEyeballsResolutionDelay),
+		maxAttempts:     config.MaxAttempts,
+		timeout:         config.Timeout,
+		retries:         config.Retries,
+		retryBackoff:    cmp.Or(config.RetryBackoff, constant.DialRetryBackoff),
+		retryBackoffMax: cmp.Or(config.RetryBackoffMax, constant.DialRetryBackoffMax),
+		nat64Prefix:     config.NAT64Prefix,
+		addressOrder:    config.AddressOrder,
+		latency:         latency,
+		sources: cache.New[netip.Addr, netip.Addr](
+			cache.WithSize[netip.Addr, netip.Addr](constant.DialerSourceCacheSize),
+			cache.WithAge[netip.Addr, netip.Addr](int64(constant.DialerSourceCacheTTL/time.Second)),
+		),
+	}
+	d.attempt = d.dialOne
+	return d, nil
 }
 
 type DefaultDialer struct {
 	defaultDialer net.Dialer
+	listener      net.ListenConfig
 
 	dialer4 tfo.Dialer
 	dialer6 tfo.Dialer
@@ -140,11 +209,55 @@ type DefaultDialer struct {
 	udpAddr4 string
 	udpAddr6 string
 
+	sources4 *sourcePool
+	sources6 *sourcePool
+
 	resolver        resolver.Resolver
 	resolveStrategy resolver.Strategy
+	socket          sockopt.Options
+
+	attemptDelay    time.Duration
+	resolutionDelay time.Duration
+	maxAttempts     int
+	addressOrder    AddressOrder
+	// latency is the connect time of addresses, for AddressOrderLatency only
+	latency *latencyTable
+	// sources is the source address of recently sorted destinations
+	sources *cache.LruCache[netip.Addr, netip.Addr]
+	// attempt makes a connection attempt of a race, it is dialOne
+	attempt func(ctx context.Context, nn constant.Network, network string,
+		addr netip.Addr, port uint16, data []byte) (net.Conn, error)
+
+	timeout         time.Duration
+	retries         int
+	retryBackoff    time.Duration
+	retryBackoffMax time.Duration
+
+	nat64Prefix netip.Prefix
 }
 
 func (d *DefaultDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialWithRetry(ctx, network, address, nil)
+}
+
+func (d *DefaultDialer) TFO() bool {
+	return !d.dialer4.DisableTFO
+}
+
+// DialContextEarly is like DialContext, but sends data in the SYN if TCP Fast Open is enabled.
+// If the kernel does not support TFO or the server rejects it, data is sent after the handshake.
+func (d *DefaultDialer) DialContextEarly(ctx context.Context, network, address string, data []byte) (net.Conn, error) {
+	nn, err := constant.ParseNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	if nn.Protocol != constant.ProtocolTCP {
+		return nil, fmt.Errorf("dialer: early data is not supported for network: %s", network)
+	}
+	return d.dialWithRetry(ctx, network, address, data)
+}
+
+func (d *DefaultDialer) dialContext(ctx context.Context, network, address string, data []byte) (net.Conn, error) {
 	switch network {
 	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
 	default:
@@ -165,17 +278,16 @@ func (d *DefaultDialer) DialContext(ctx context.Context, network, address string
 		if err != nil {
 			return nil, fmt.Errorf("dialer: invalid address: %s: %w", host, err)
 		}
-		return d.DialSerial(ctx, network, []netip.Addr{addr}, uint16(portNum))
+		return d.dialSerial(ctx, network, []netip.Addr{d.nat64(addr)}, uint16(portNum), data)
 	}
-	a, aaaa, err := d.resolver.Lookup(ctx, host, d.resolveStrategy)
-	if err != nil {
-		return nil, fmt.Errorf("dialer: resolve address failed: %w", err)
-	}
-
-	return d.DialParallel(ctx, network, d.resolveStrategy, a, aaaa, uint16(portNum))
+	return d.dialHappyEyeballs(ctx, network, host, uint16(portNum), data)
 }
 
 func (d *DefaultDialer) DialSerial(ctx context.Context, network string, addresses []netip.Addr, port uint16) (net.Conn, error) {
+	return d.dialSerial(ctx, network, addresses, port, nil)
+}
+
+func (d *DefaultDialer) dialSerial(ctx context.Context, network string, addresses []netip.Addr, port uint16, data []byte) (net.Conn, error) {
 	if len(addresses) == 0 {
 		return nil, errors.New("dialer: no address to dial")
 	}
@@ -194,150 +306,202 @@ func (d *DefaultDialer) DialSerial(ctx context.Context, network string, addresse
 		if common.Done(ctx) {
 			return nil, ctx.Err()
 		}
-		var (
-			target    = netip.AddrPortFrom(addr, port)
-			conn      net.Conn
-			err       error
-			tcpDialer *tfo.Dialer
-			udpDialer *net.Dialer
-		)
-		switch {
-		case addr.Is4():
-			udpDialer = &d.udpDialer4
-			tcpDialer = &d.dialer4
-		case addr.Is6():
-			udpDialer = &d.udpDialer4
-			tcpDialer = &d.dialer4
-		default:
-			tcpDialer = &tfo.Dialer{Dialer: d.defaultDialer, DisableTFO: true, Fallback: false}
-			udpDialer = &d.defaultDialer
-		}
-		switch nn.Protocol {
-		case constant.ProtocolUDP:
-			conn, err = udpDialer.DialContext(ctx, network, target.String())
-		case constant.ProtocolTCP:
-			//if tcpDialer.DisableTFO {
-			//	conn, err = tcpDialer.DialContext(ctx, network, target.String(), nil)
-			//} else {
-			//	conn, err = tcpDialer.DialContext(ctx, network, target.String(), tfoInitData)
-			//}
-			// FIXME: enable tfo for client
-			conn, err = tcpDialer.DialContext(ctx, network, target.String(), nil)
-		default:
-			conn, err = d.defaultDialer.DialContext(ctx, network, addr.String())
-		}
-
+		conn, err := d.dialOne(ctx, nn, network, addr, port, data)
 		if err == nil {
 			return conn, nil
 		}
-
 		lastErr = err
 	}
 
 	return nil, fmt.Errorf("dialer: all addresses failed, last error: %w", lastErr)
 }
 
+// dialOne dials addr with the dialer of its family.
+func (d *DefaultDialer) dialOne(ctx context.Context, nn constant.Network, network string,
+	addr netip.Addr, port uint16, data []byte) (net.Conn, error) {
+	addr = addr.Unmap()
+	var (
+		target    = netip.AddrPortFrom(addr, port)
+		conn      net.Conn
+		err       error
+		tcpDialer *tfo.Dialer
+		udpDialer *net.Dialer
+	)
+	switch {
+	case addr.Is4():
+		udpDialer = &d.udpDialer4
+		tcpDialer = &d.dialer4
+	case addr.Is6():
+		udpDialer = &d.udpDialer6
+		tcpDialer = &d.dialer6
+	default:
+		tcpDialer = &tfo.Dialer{Dialer: d.defaultDialer, DisableTFO: true, Fallback: false}
+		udpDialer = &d.defaultDialer
+	}
+	if source := d.pickSource(ctx, addr); source.IsValid() {
+		tcpCopy, udpCopy := *tcpDialer, *udpDialer
+		tcpCopy.LocalAddr = &net.TCPAddr{IP: source.AsSlice()}
+		udpCopy.LocalAddr = &net.UDPAddr{IP: source.AsSlice()}
+		tcpDialer, udpDialer = &tcpCopy, &udpCopy
+	}
+	switch nn.Protocol {
+	case constant.ProtocolUDP:
+		conn, err = udpDialer.DialContext(ctx, network, target.String())
+	case constant.ProtocolTCP:
+		// with tfo disabled, tfo.Dialer writes data after connecting
+		start := time.Now()
+		conn, err = tcpDialer.DialContext(ctx, network, target.String(), data)
+		d.observe(ctx, addr, time.Since(start), err)
+	default:
+		conn, err = d.defaultDialer.DialContext(ctx, network, addr.String())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = d.socket.Apply(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dialer: set socket options: %w", err)
+	}
+	return conn, nil
+}
+
 func (d *DefaultDialer) DialParallel(ctx context.Context, network string, strategy resolver.Strategy,
 	ipv4 []netip.Addr, ipv6 []netip.Addr, port uint16) (net.Conn, error) {
-	if len(ipv4) == 0 && len(ipv6) == 0 {
+	return d.dialParallel(ctx, network, strategy, ipv4, ipv6, port, nil)
+}
+
+// dialParallel races the addresses of both families with Happy Eyeballs.
+// Note that early data may reach the server on more than one connection, the losers are closed.
+func (d *DefaultDialer) dialParallel(ctx context.Context, network string, strategy resolver.Strategy,
+	ipv4 []netip.Addr, ipv6 []netip.Addr, port uint16, data []byte) (net.Conn, error) {
+	nn, err := constant.ParseNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	ipv4, ipv6 = resolver.FilterAddress(ipv4, ipv6, strategy)
+	addresses := filterAddressByNetwork(nn, slices.Concat(ipv4, ipv6))
+	if len(addresses) == 0 {
 		return nil, fmt.Errorf("dialer: no available address to dial")
 	}
+	return d.race(ctx, nn, network, strategy, addresses, port, data, nil, 0)
+}
 
-	if len(ipv4) == 0 || strategy == resolver.StrategyIPv6Only {
-		return d.DialSerial(ctx, network, ipv6, port)
-	}
-	if len(ipv6) == 0 || strategy == resolver.StrategyIPv4Only {
-		return d.DialSerial(ctx, network, ipv4, port)
+func (d *DefaultDialer) ListenPacket(ctx context.Context, source netip.Addr, address string) (*net.UDPConn, error) {
+	var (
+		network = string(constant.ProtocolUDP)
+		bind    string
+	)
+	switch {
+	case source.IsValid():
+		bind = source.String()
+		if source.Unmap().Is4() {
+			network = "udp4"
+		} else {
+			network = "udp6"
+		}
+	case address != "":
+		target, err := d.Resolve(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if target.Addr().Is4() {
+			network, bind = "udp4", d.udpAddr4
+		} else {
+			network, bind = "udp6", d.udpAddr6
+		}
+		if source := d.pickSource(ctx, target.Addr()); source.IsValid() {
+			bind = source.String()
+		}
 	}
 
-	// happy eyeball implement
-	type dialResult struct {
-		conn net.Conn
-		err  error
-		ipv6 bool
+	conn, err := d.listener.ListenPacket(ctx, network, net.JoinHostPort(bind, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("dialer: listen packet: %w", err)
+	}
+	udpConn := conn.(*net.UDPConn)
+	if err = d.socket.Apply(udpConn); err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("dialer: set socket options: %w", err)
 	}
+	return udpConn, nil
+}
 
-	resultChan := make(chan dialResult, 2)
-	dialCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+func (d *DefaultDialer) Resolve(ctx context.Context, network, address string) (netip.AddrPort, error) {
+	nn, err := constant.ParseNetwork(network)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("dialer: split host port failed: %s: %w", address, err)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("dialer: invalid port number: %s: %w", port, err)
+	}
 
-	firstIsIPv4 := strategy == resolver.StrategyPreferIPv4
-	var first, second []netip.Addr
-	if firstIsIPv4 {
-		first, second = ipv4, ipv6
+	var addresses []netip.Addr
+	if !metadata.IsDomainName(host) {
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("dialer: invalid address: %s: %w", host, err)
+		}
+		addresses = []netip.Addr{d.nat64(addr.Unmap())}
 	} else {
-		first, second = ipv6, ipv4
-	}
-
-	go func() {
-		conn, err := d.DialSerial(dialCtx, network, first, port)
-		select {
-		case resultChan <- dialResult{conn: conn, err: err,
-			ipv6: !firstIsIPv4}:
-		case <-dialCtx.Done():
-			if conn != nil {
-				conn.Close()
-			}
+		a, aaaa, err := d.resolver.Lookup(ctx, host, d.resolveStrategy)
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("dialer: resolve address failed: %w", err)
 		}
-	}()
-
-	// happy eyeball
-	firstTimer := time.NewTimer(300 * time.Millisecond)
-	defer firstTimer.Stop()
-
-	var secondStarted bool
-	var resultsReceived int
-
-	for resultsReceived < 2 {
-		select {
-		case <-dialCtx.Done():
-			return nil, dialCtx.Err()
-
-		case <-firstTimer.C:
-			if !secondStarted {
-				secondStarted = true
-				go func() {
-					conn, err := d.DialSerial(dialCtx, network, second, port)
-					select {
-					case resultChan <- dialResult{conn: conn, err: err, ipv6: firstIsIPv4}:
-					case <-dialCtx.Done():
-						if conn != nil {
-							conn.Close()
-						}
-					}
-				}()
-			}
-
-		case result := <-resultChan:
-			resultsReceived++
-
-			if result.err == nil {
-				cancel()
-				return result.conn, nil
-			}
-
-			if !secondStarted && resultsReceived == 1 {
-				secondStarted = true
-				firstTimer.Stop()
-				go func() {
-					conn, err := d.DialSerial(dialCtx, network, second, port)
-					select {
-					case resultChan <- dialResult{conn: conn, err: err, ipv6: firstIsIPv4}:
-					case <-dialCtx.Done():
-						if conn != nil {
-							conn.Close()
-						}
-					}
-				}()
-			}
+		// the same order as the connection attempts
+		addresses = d.order(ctx, d.resolveStrategy, slices.Concat(a, aaaa))
+	}
+	addresses = filterAddressByNetwork(nn, addresses)
+	if len(addresses) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("dialer: no available address found for network: %s", network)
+	}
+	return netip.AddrPortFrom(addresses[0], uint16(portNum)), nil
+}
+
+// observe records the connect time of addr for AddressOrderLatency. Failed connects count
+// as slow as the attempt timeout, connects canceled by the caller or by a faster attempt
+// took at least as long as they ran.
+func (d *DefaultDialer) observe(ctx context.Context, addr netip.Addr, rtt time.Duration, err error) {
+	if d.latency == nil {
+		return
+	}
+	if err != nil {
+		if ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			d.latency.observeAtLeast(addr, rtt)
+			return
 		}
+		rtt = max(rtt, d.defaultDialer.Timeout)
 	}
+	d.latency.observe(addr, rtt)
+}
 
-	return nil, fmt.Errorf("dialer: all parallel dials failed for both IPv4 and IPv6")
+// nat64 returns the address of addr in the NAT64 prefix, or addr if it is not mapped.
+func (d *DefaultDialer) nat64(addr netip.Addr) netip.Addr {
+	if !d.nat64Prefix.IsValid() {
+		return addr
+	}
+	if mapped, ok := resolver.NAT64Address(d.nat64Prefix, addr); ok {
+		return mapped
+	}
+	return addr
 }
 
-func (d *DefaultDialer) ListenPacket(ctx context.Context, source netip.Addr, address string) (*net.UDPConn, error) {
-	return nil, nil
+// pickSource returns the source address to reach addr from the source pool of its family,
+// it is invalid if there is no pool.
+func (d *DefaultDialer) pickSource(ctx context.Context, addr netip.Addr) netip.Addr {
+	pool := d.sources6
+	if addr.Is4() {
+		pool = d.sources4
+	}
+	if pool == nil {
+		return netip.Addr{}
+	}
+	return pool.pick(ctx)
 }
 
 func filterAddressByNetwork(network constant.Network, addr []netip.Addr) []netip.Addr {
@@ -348,11 +512,11 @@ func filterAddressByNetwork(network constant.Network, addr []netip.Addr) []netip
 		})
 	case network.Version == constant.NetworkVersion4:
 		return common.Filter(addr, func(it netip.Addr) bool {
-			return it.IsValid() && it.Is4()
+			return it.IsValid() && it.Unmap().Is4()
 		})
 	case network.Version == constant.NetworkVersion6:
 		return common.Filter(addr, func(it netip.Addr) bool {
-			return it.IsValid() && it.Is6()
+			return it.IsValid() && it.Is6() && !it.Is4In6()
 		})
 	default:
 		return addr
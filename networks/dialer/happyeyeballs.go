@@ -0,0 +1,220 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"github.com/woshikedayaa/traffics/networks/resolver"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Happy Eyeballs Version 2, RFC 8305.
+
+type lookupResult struct {
+	addresses []netip.Addr
+	ipv4      bool
+	err       error
+}
+
+// dialHappyEyeballs queries both families of host at the same time and races the addresses.
+// Connection attempts start once the preferred family is answered, or the resolution delay
+// passed after the other family is answered (RFC 8305 section 3).
+func (d *DefaultDialer) dialHappyEyeballs(ctx context.Context, network string, host string,
+	port uint16, data []byte) (net.Conn, error) {
+	nn, err := constant.ParseNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	// stops the lookups still running when a connection is made
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		want4   = nn.Version != constant.NetworkVersion6 && d.resolveStrategy != resolver.StrategyIPv6Only
+		want6   = nn.Version != constant.NetworkVersion4 && d.resolveStrategy != resolver.StrategyIPv4Only
+		prefer4 = d.resolveStrategy == resolver.StrategyPreferIPv4 || !want6
+		lookups = make(chan lookupResult, 2)
+		pending int
+	)
+	lookup := func(ipv4 bool) {
+		strategy := resolver.StrategyIPv6Only
+		if ipv4 {
+			strategy = resolver.StrategyIPv4Only
+		}
+		pending++
+		go func() {
+			a, aaaa, err := d.resolver.Lookup(ctx, host, strategy)
+			lookups <- lookupResult{addresses: slices.Concat(a, aaaa), ipv4: ipv4, err: err}
+		}()
+	}
+	if want4 {
+		lookup(true)
+	}
+	if want6 {
+		lookup(false)
+	}
+
+	var (
+		addresses []netip.Addr
+		errs      []error
+		delay     <-chan time.Time
+	)
+wait:
+	for pending > 0 {
+		select {
+		case result := <-lookups:
+			pending--
+			if result.err != nil {
+				errs = append(errs, result.err)
+				if result.ipv4 == prefer4 && len(addresses) > 0 {
+					break wait
+				}
+				continue
+			}
+			addresses = append(addresses, result.addresses...)
+			if result.ipv4 == prefer4 {
+				break wait
+			}
+			if len(result.addresses) > 0 && delay == nil {
+				timer := time.NewTimer(d.resolutionDelay)
+				defer timer.Stop()
+				delay = timer.C
+			}
+		case <-delay:
+			break wait
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	addresses = filterAddressByNetwork(nn, addresses)
+	if len(addresses) == 0 && pending == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("dialer: resolve address failed: %w", errors.Join(errs...))
+		}
+		return nil, fmt.Errorf("dialer: no available address found for %s", host)
+	}
+	return d.race(ctx, nn, network, d.resolveStrategy, addresses, port, data, lookups, pending)
+}
+
+// race makes staggered connection attempts to addresses (RFC 8305 section 5).
+// The next attempt starts after the connection attempt delay, or at once if an attempt fails,
+// with at most maxAttempts attempts in flight. The first connection made wins.
+// Addresses of the pending lookups are added to the remaining ones when they arrive.
+func (d *DefaultDialer) race(ctx context.Context, nn constant.Network, network string, strategy resolver.Strategy,
+	addresses []netip.Addr, port uint16, data []byte, lookups <-chan lookupResult, pending int) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		conn net.Conn
+		err  error
+	}
+	var (
+		results  = make(chan attempt)
+		queue    = d.order(ctx, strategy, addresses)
+		inflight int
+		ready    = true
+		lastErr  error
+		timer    = time.NewTimer(d.attemptDelay)
+	)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		if ready && len(queue) > 0 && (d.maxAttempts <= 0 || inflight < d.maxAttempts) {
+			addr := queue[0]
+			queue = queue[1:]
+			inflight++
+			ready = false
+			timer.Reset(d.attemptDelay)
+			go func() {
+				conn, err := d.attempt(ctx, nn, network, addr, port, data)
+				select {
+				case results <- attempt{conn: conn, err: err}:
+				case <-ctx.Done():
+					if conn != nil {
+						conn.Close()
+					}
+				}
+			}()
+		}
+		if inflight == 0 && len(queue) == 0 && pending == 0 {
+			if lastErr == nil {
+				lastErr = errors.New("no address to dial")
+			}
+			return nil, fmt.Errorf("dialer: all addresses failed, last error: %w", lastErr)
+		}
+
+		select {
+		case <-timer.C:
+			ready = true
+		case result := <-results:
+			inflight--
+			if result.err == nil {
+				return result.conn, nil
+			}
+			lastErr = result.err
+			ready = true
+		case result := <-lookups:
+			pending--
+			if result.err != nil {
+				if lastErr == nil {
+					lastErr = result.err
+				}
+				continue
+			}
+			queue = d.order(ctx, strategy, slices.Concat(queue, filterAddressByNetwork(nn, result.addresses)))
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// order sorts addresses by the address order of the dialer and interleaves the families,
+// the strategy decides the first family.
+func (d *DefaultDialer) order(ctx context.Context, strategy resolver.Strategy, addresses []netip.Addr) []netip.Addr {
+	if len(addresses) == 0 {
+		return addresses
+	}
+	var sorted []netip.Addr
+	switch d.addressOrder {
+	case AddressOrderAsReturned:
+		sorted = addresses
+	case AddressOrderRandom:
+		sorted = shuffleAddresses(addresses)
+	case AddressOrderLatency:
+		// not interleaved, that would put a slow address of the other family before a fast one
+		sorted = d.latency.sort(addresses)
+		switch strategy {
+		case resolver.StrategyPreferIPv4, resolver.StrategyPreferIPv6:
+			prefer4 := strategy == resolver.StrategyPreferIPv4
+			slices.SortStableFunc(sorted, func(a, b netip.Addr) int {
+				if a.Is4() == b.Is4() {
+					return 0
+				}
+				if a.Is4() == prefer4 {
+					return -1
+				}
+				return 1
+			})
+		}
+		return sorted
+	default:
+		// spread the connections over equal addresses
+		sorted = d.sortAddresses(ctx, shuffleAddresses(addresses))
+	}
+	var first4 bool
+	switch strategy {
+	case resolver.StrategyPreferIPv4, resolver.StrategyIPv4Only:
+		first4 = true
+	case resolver.StrategyPreferIPv6, resolver.StrategyIPv6Only:
+		first4 = false
+	default:
+		first4 = sorted[0].Is4()
+	}
+	return interleave(sorted, first4)
+}
@@ -0,0 +1,228 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"github.com/woshikedayaa/traffics/networks/resolver"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAttempts replaces the connection attempts of a dialer, each address behaves by its outcome.
+type fakeAttempts struct {
+	start    time.Time
+	outcomes map[netip.Addr]outcome
+
+	access      sync.Mutex
+	started     []netip.Addr
+	startedAt   []time.Duration
+	canceled    []netip.Addr
+	inflight    int
+	maxInflight int
+}
+
+// outcome is how an attempt ends: after delay with err, or a connection if err is nil.
+// An attempt that hangs only ends when it is canceled.
+type outcome struct {
+	delay time.Duration
+	err   error
+	hang  bool
+}
+
+func newFakeAttempts(d *DefaultDialer, outcomes map[netip.Addr]outcome) *fakeAttempts {
+	f := &fakeAttempts{start: time.Now(), outcomes: outcomes}
+	d.attempt = f.dial
+	return f
+}
+
+func (f *fakeAttempts) dial(ctx context.Context, nn constant.Network, network string,
+	addr netip.Addr, port uint16, data []byte) (net.Conn, error) {
+	f.access.Lock()
+	f.started = append(f.started, addr)
+	f.startedAt = append(f.startedAt, time.Since(f.start))
+	f.inflight++
+	f.maxInflight = max(f.maxInflight, f.inflight)
+	f.access.Unlock()
+	defer func() {
+		f.access.Lock()
+		f.inflight--
+		f.access.Unlock()
+	}()
+
+	o := f.outcomes[addr]
+	var wait <-chan time.Time
+	if !o.hang {
+		wait = time.After(o.delay)
+	}
+	select {
+	case <-wait:
+	case <-ctx.Done():
+		f.access.Lock()
+		f.canceled = append(f.canceled, addr)
+		f.access.Unlock()
+		return nil, ctx.Err()
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, nil
+}
+
+// attempts returns the addresses attempted, when they started and the ones canceled.
+func (f *fakeAttempts) attempts() ([]netip.Addr, []time.Duration, []netip.Addr) {
+	f.access.Lock()
+	defer f.access.Unlock()
+	return append([]netip.Addr(nil), f.started...), append([]time.Duration(nil), f.startedAt...),
+		append([]netip.Addr(nil), f.canceled...)
+}
+
+func newRaceDialer(t *testing.T, config DialConfig) *DefaultDialer {
+	t.Helper()
+	config.AddressOrder = AddressOrderAsReturned
+	d, err := NewDefault(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+var (
+	raceAddr4 = netip.MustParseAddr("192.0.2.1")
+	raceAddr6 = netip.MustParseAddr("2001:db8::1")
+)
+
+// TestRaceAttemptDelay checks that the next attempt starts after the attempt delay while
+// the first one hangs, and that the first one is canceled once the second one wins.
+func TestRaceAttemptDelay(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	d := newRaceDialer(t, DialConfig{AttemptDelay: delay})
+	f := newFakeAttempts(d, map[netip.Addr]outcome{
+		raceAddr4: {hang: true},
+		raceAddr6: {},
+	})
+	conn, err := d.DialParallel(context.Background(), "tcp", resolver.StrategyPreferIPv4,
+		[]netip.Addr{raceAddr4}, []netip.Addr{raceAddr6}, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	var canceled []netip.Addr
+	for deadline := time.Now().Add(5 * time.Second); len(canceled) == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		_, _, canceled = f.attempts()
+	}
+	started, at, _ := f.attempts()
+	if len(started) != 2 || started[0] != raceAddr4 || started[1] != raceAddr6 {
+		t.Fatalf("attempts %v, want %v then %v", started, raceAddr4, raceAddr6)
+	}
+	if gap := at[1] - at[0]; gap < delay || gap > 5*delay {
+		t.Errorf("second attempt started %s after the first, attempt delay is %s", gap, delay)
+	}
+	if len(canceled) != 1 || canceled[0] != raceAddr4 {
+		t.Errorf("canceled %v, want the losing attempt to %v", canceled, raceAddr4)
+	}
+}
+
+// TestRaceFailureStartsNext checks that a failed attempt starts the next one at once.
+func TestRaceFailureStartsNext(t *testing.T) {
+	const delay = time.Second
+	d := newRaceDialer(t, DialConfig{AttemptDelay: delay})
+	f := newFakeAttempts(d, map[netip.Addr]outcome{
+		raceAddr4: {err: errors.New("refused")},
+		raceAddr6: {},
+	})
+	conn, err := d.DialParallel(context.Background(), "tcp", resolver.StrategyPreferIPv4,
+		[]netip.Addr{raceAddr4}, []netip.Addr{raceAddr6}, 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	started, at, _ := f.attempts()
+	if len(started) != 2 || at[1]-at[0] >= delay/2 {
+		t.Errorf("attempts %v at %v, want the second one right after the failure", started, at)
+	}
+}
+
+// TestRaceMaxAttempts checks that no more than MaxAttempts attempts are in flight.
+func TestRaceMaxAttempts(t *testing.T) {
+	var (
+		outcomes  = make(map[netip.Addr]outcome)
+		addresses []netip.Addr
+	)
+	for i := range 6 {
+		addr := netip.AddrFrom4([4]byte{192, 0, 2, byte(i + 1)})
+		addresses = append(addresses, addr)
+		outcomes[addr] = outcome{delay: 50 * time.Millisecond, err: errors.New("timeout")}
+	}
+	d := newRaceDialer(t, DialConfig{AttemptDelay: time.Millisecond, MaxAttempts: 2})
+	f := newFakeAttempts(d, outcomes)
+	if _, err := d.DialParallel(context.Background(), "tcp", resolver.StrategyDefault, addresses, nil, 80); err == nil {
+		t.Fatal("dial succeeded, every attempt fails")
+	}
+	started, _, _ := f.attempts()
+	if len(started) != len(addresses) {
+		t.Errorf("%d attempts, want %d", len(started), len(addresses))
+	}
+	if f.maxInflight != 2 {
+		t.Errorf("%d attempts in flight, want at most 2", f.maxInflight)
+	}
+}
+
+// delayedResolver answers each family after its delay.
+type delayedResolver struct {
+	delay4, delay6 time.Duration
+}
+
+func (r delayedResolver) Lookup(ctx context.Context, fqdn string, strategy resolver.Strategy) ([]netip.Addr, []netip.Addr, error) {
+	delay, A, AAAA := r.delay6, []netip.Addr(nil), []netip.Addr{raceAddr6}
+	if strategy == resolver.StrategyIPv4Only {
+		delay, A, AAAA = r.delay4, []netip.Addr{raceAddr4}, nil
+	}
+	select {
+	case <-time.After(delay):
+		return A, AAAA, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// TestHappyEyeballsResolutionDelay checks that the attempts wait for the preferred family
+// for the resolution delay only.
+func TestHappyEyeballsResolutionDelay(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	tests := []struct {
+		name     string
+		resolver delayedResolver
+		// first is the address of the first attempt, any if invalid
+		first netip.Addr
+		// the first attempt starts in [after, before)
+		after, before time.Duration
+	}{
+		// both families are answered, the address order picks the first
+		{"preferred answers in the delay", delayedResolver{delay4: 0, delay6: delay / 4}, netip.Addr{}, delay / 4, delay},
+		{"preferred answers late", delayedResolver{delay4: 0, delay6: time.Second}, raceAddr4, delay, time.Second},
+		{"preferred answers first", delayedResolver{delay4: time.Second, delay6: 0}, raceAddr6, 0, delay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newRaceDialer(t, DialConfig{Resolver: tt.resolver, ResolutionDelay: delay})
+			f := newFakeAttempts(d, map[netip.Addr]outcome{raceAddr4: {}, raceAddr6: {}})
+			conn, err := d.DialContext(context.Background(), "tcp", "example.com:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			started, at, _ := f.attempts()
+			if tt.first.IsValid() && started[0] != tt.first || at[0] < tt.after || at[0] >= tt.before {
+				t.Errorf("first attempt to %s after %s, want %s in [%s, %s)", started[0], at[0], tt.first, tt.after, tt.before)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package dialer
+
+import (
+	"cmp"
+	"github.com/sagernet/sing/common/cache"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// AddressOrder decides the order the addresses of a name are tried in.
+// The address families are interleaved afterward (RFC 8305 section 4), except for AddressOrderLatency.
+type AddressOrder string
+
+const (
+	// AddressOrderRFC6724 sorts by destination address selection, equal addresses in random order.
+	AddressOrderRFC6724 AddressOrder = "rfc6724"
+	// AddressOrderAsReturned keeps the order of the answer.
+	AddressOrderAsReturned AddressOrder = "as_returned"
+	AddressOrderRandom     AddressOrder = "random"
+	// AddressOrderLatency tries the addresses with the lowest observed connect time first,
+	// addresses not connected to yet go first so that they get measured. The families are
+	// not interleaved, a preferred family goes first.
+	AddressOrderLatency AddressOrder = "latency"
+)
+
+func (o AddressOrder) IsValid() bool {
+	switch o {
+	case "", AddressOrderRFC6724, AddressOrderAsReturned, AddressOrderRandom, AddressOrderLatency:
+		return true
+	default:
+		return false
+	}
+}
+
+func shuffleAddresses(addresses []netip.Addr) []netip.Addr {
+	shuffled := slices.Clone(addresses)
+	rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return shuffled
+}
+
+// latencyTable is the smoothed tcp connect time of the addresses dialed recently.
+type latencyTable struct {
+	cache *cache.LruCache[netip.Addr, time.Duration]
+}
+
+func newLatencyTable() *latencyTable {
+	return &latencyTable{
+		cache: cache.New[netip.Addr, time.Duration](
+			cache.WithSize[netip.Addr, time.Duration](constant.DialerLatencyTableSize),
+			cache.WithAge[netip.Addr, time.Duration](int64(constant.DialerLatencyMaxAge/time.Second)),
+		),
+	}
+}
+
+// observe records a connect time, a failed connect is recorded as a slow one.
+func (t *latencyTable) observe(addr netip.Addr, rtt time.Duration) {
+	if old, ok := t.cache.Load(addr); ok {
+		rtt = old + (rtt-old)/4
+	}
+	t.cache.Store(addr, rtt)
+}
+
+// observeAtLeast records that a connect took longer than rtt, for a connect that lost the race.
+// Otherwise the addresses that always lose would stay unmeasured and be tried first forever.
+func (t *latencyTable) observeAtLeast(addr netip.Addr, rtt time.Duration) {
+	if old, ok := t.cache.Load(addr); ok && old >= rtt {
+		return
+	}
+	t.cache.Store(addr, rtt)
+}
+
+// sort returns addresses by connect time, the ones without connect time first in their order.
+func (t *latencyTable) sort(addresses []netip.Addr) []netip.Addr {
+	type candidate struct {
+		addr    netip.Addr
+		latency time.Duration
+		known   bool
+	}
+	candidates := make([]candidate, len(addresses))
+	for i, addr := range addresses {
+		latency, known := t.cache.Load(addr)
+		candidates[i] = candidate{addr: addr, latency: latency, known: known}
+	}
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		if a.known != b.known {
+			if !a.known {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.latency, b.latency)
+	})
+	sorted := make([]netip.Addr, len(candidates))
+	for i, c := range candidates {
+		sorted[i] = c.addr
+	}
+	return sorted
+}
@@ -0,0 +1,201 @@
+package dialer
+
+import (
+	"context"
+	"github.com/woshikedayaa/traffics/networks/resolver"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+)
+
+func addrs(s ...string) []netip.Addr {
+	addresses := make([]netip.Addr, len(s))
+	for i, addr := range s {
+		addresses[i] = netip.MustParseAddr(addr)
+	}
+	return addresses
+}
+
+func newOrderDialer(t *testing.T, order AddressOrder) *DefaultDialer {
+	t.Helper()
+	d, err := NewDefault(DialConfig{AddressOrder: order})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestOrderAsReturned(t *testing.T) {
+	tests := []struct {
+		name      string
+		strategy  resolver.Strategy
+		addresses []netip.Addr
+		want      []netip.Addr
+	}{
+		{"single", resolver.StrategyDefault, addrs("192.0.2.1"), addrs("192.0.2.1")},
+		{"one family", resolver.StrategyDefault, addrs("192.0.2.3", "192.0.2.1", "192.0.2.2"), addrs("192.0.2.3", "192.0.2.1", "192.0.2.2")},
+		{"first family first", resolver.StrategyDefault,
+			addrs("2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"), addrs("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2")},
+		{"prefer ipv4", resolver.StrategyPreferIPv4,
+			addrs("2001:db8::1", "2001:db8::2", "192.0.2.1"), addrs("192.0.2.1", "2001:db8::1", "2001:db8::2")},
+		{"prefer ipv6", resolver.StrategyPreferIPv6,
+			addrs("192.0.2.1", "192.0.2.2", "2001:db8::1"), addrs("2001:db8::1", "192.0.2.1", "192.0.2.2")},
+	}
+	d := newOrderDialer(t, AddressOrderAsReturned)
+	for _, tt := range tests {
+		if got := d.order(context.Background(), tt.strategy, tt.addresses); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOrderRandom(t *testing.T) {
+	tests := []struct {
+		name        string
+		addresses   []netip.Addr
+		interleaved bool
+	}{
+		{"one family", addrs("192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"), false},
+		{"both families", addrs("192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"), true},
+	}
+	d := newOrderDialer(t, AddressOrderRandom)
+	for _, tt := range tests {
+		first := make(map[netip.Addr]int)
+		for range 1000 {
+			got := d.order(context.Background(), resolver.StrategyDefault, tt.addresses)
+			if !slices.Equal(slices.SortedFunc(slices.Values(got), netip.Addr.Compare),
+				slices.SortedFunc(slices.Values(tt.addresses), netip.Addr.Compare)) {
+				t.Fatalf("%s: %v is not a permutation of %v", tt.name, got, tt.addresses)
+			}
+			for i := 1; i < len(got) && tt.interleaved; i++ {
+				if got[i].Is4() == got[i-1].Is4() {
+					t.Fatalf("%s: %v does not interleave the families", tt.name, got)
+				}
+			}
+			first[got[0]]++
+		}
+		for _, addr := range tt.addresses {
+			if first[addr] == 0 {
+				t.Errorf("%s: %s never came first", tt.name, addr)
+			}
+		}
+	}
+}
+
+// TestOrderRFC6724 follows the examples of RFC 6724 section 10.2 and the rules they exercise,
+// the source of every destination is given.
+func TestOrderRFC6724(t *testing.T) {
+	tests := []struct {
+		name    string
+		sources map[string]string // destination to source, none if unusable
+		want    []netip.Addr
+	}{
+		{"rule 1: avoid unusable destinations",
+			map[string]string{"2001:db8:1::1": "", "198.51.100.121": "198.51.100.117"},
+			addrs("198.51.100.121", "2001:db8:1::1")},
+		{"rule 2: prefer matching scope",
+			map[string]string{"2001:db8:1::1": "2001:db8:1::2", "198.51.100.121": "169.254.13.78"},
+			addrs("2001:db8:1::1", "198.51.100.121")},
+		{"rule 5: prefer matching label",
+			map[string]string{"2001:db8:1::1": "fe80::1", "198.51.100.121": "198.51.100.117"},
+			addrs("198.51.100.121", "2001:db8:1::1")},
+		{"rule 6: prefer higher precedence",
+			map[string]string{"2001:db8:1::1": "2001:db8:1::2", "10.1.2.3": "10.1.2.4"},
+			addrs("2001:db8:1::1", "10.1.2.3")},
+		{"rule 8: prefer smaller scope",
+			map[string]string{"2001:db8:1::1": "2001:db8:1::2", "fe80::1": "fe80::2"},
+			addrs("fe80::1", "2001:db8:1::1")},
+		{"rule 9: use longest matching prefix",
+			map[string]string{"2001:db8:1::1": "2001:db8:3::1", "2001:db8:3ffe::1": "2001:db8:3::1"},
+			addrs("2001:db8:1::1", "2001:db8:3ffe::1")},
+	}
+	for _, tt := range tests {
+		d := newOrderDialer(t, AddressOrderRFC6724)
+		var addresses []netip.Addr
+		for destination, source := range tt.sources {
+			var sourceAddr netip.Addr
+			if source != "" {
+				sourceAddr = netip.MustParseAddr(source)
+			}
+			d.sources.Store(netip.MustParseAddr(destination), sourceAddr)
+			addresses = append(addresses, netip.MustParseAddr(destination))
+		}
+		// the answer is shuffled first, the rules decide regardless
+		for range 10 {
+			if got := d.order(context.Background(), resolver.StrategyDefault, addresses); !slices.Equal(got, tt.want) {
+				t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestOrderLatency(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	type observation struct {
+		addr string
+		rtt  time.Duration
+		ctx  context.Context
+	}
+	tests := []struct {
+		name         string
+		observations []observation
+		addresses    []netip.Addr
+		want         []netip.Addr
+	}{
+		{"unmeasured keep their order", nil,
+			addrs("192.0.2.1", "192.0.2.2", "192.0.2.3"), addrs("192.0.2.1", "192.0.2.2", "192.0.2.3")},
+		{"fastest first", []observation{
+			{"192.0.2.1", 30 * time.Millisecond, nil}, {"192.0.2.2", 10 * time.Millisecond, nil}, {"192.0.2.3", 20 * time.Millisecond, nil},
+		}, addrs("192.0.2.1", "192.0.2.2", "192.0.2.3"), addrs("192.0.2.2", "192.0.2.3", "192.0.2.1")},
+		{"unmeasured first", []observation{
+			{"192.0.2.1", 10 * time.Millisecond, nil},
+		}, addrs("192.0.2.1", "192.0.2.2"), addrs("192.0.2.2", "192.0.2.1")},
+		{"smoothed", []observation{
+			{"192.0.2.1", 10 * time.Millisecond, nil}, {"192.0.2.2", 20 * time.Millisecond, nil}, {"192.0.2.1", 90 * time.Millisecond, nil},
+		}, addrs("192.0.2.1", "192.0.2.2"), addrs("192.0.2.2", "192.0.2.1")},
+		// the attempt to .1 lost the race to .2 and was canceled, it is no longer unmeasured
+		{"losers are measured", []observation{
+			{"192.0.2.2", 10 * time.Millisecond, nil}, {"192.0.2.1", 300 * time.Millisecond, canceled},
+		}, addrs("192.0.2.1", "192.0.2.2"), addrs("192.0.2.2", "192.0.2.1")},
+		{"a lost race is a lower bound", []observation{
+			{"192.0.2.1", 100 * time.Millisecond, nil}, {"192.0.2.2", 50 * time.Millisecond, nil}, {"192.0.2.1", 10 * time.Millisecond, canceled},
+		}, addrs("192.0.2.1", "192.0.2.2"), addrs("192.0.2.2", "192.0.2.1")},
+		{"families not interleaved", []observation{
+			{"192.0.2.1", 10 * time.Millisecond, nil}, {"192.0.2.2", 20 * time.Millisecond, nil},
+			{"2001:db8::1", 30 * time.Millisecond, nil}, {"2001:db8::2", 40 * time.Millisecond, nil},
+		}, addrs("2001:db8::2", "2001:db8::1", "192.0.2.2", "192.0.2.1"), addrs("192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2")},
+		{"families mixed", []observation{
+			{"2001:db8::1", 10 * time.Millisecond, nil}, {"192.0.2.1", 20 * time.Millisecond, nil},
+			{"2001:db8::2", 30 * time.Millisecond, nil}, {"192.0.2.2", 40 * time.Millisecond, nil},
+		}, addrs("192.0.2.2", "192.0.2.1", "2001:db8::2", "2001:db8::1"), addrs("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2")},
+	}
+	for _, tt := range tests {
+		d := newOrderDialer(t, AddressOrderLatency)
+		for _, o := range tt.observations {
+			ctx, err := o.ctx, error(nil)
+			if ctx == nil {
+				ctx = context.Background()
+			} else {
+				err = ctx.Err()
+			}
+			d.observe(ctx, netip.MustParseAddr(o.addr), o.rtt, err)
+		}
+		if got := d.order(context.Background(), resolver.StrategyDefault, tt.addresses); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// a preferred family goes first, in the order of latency
+	d := newOrderDialer(t, AddressOrderLatency)
+	for i, addr := range []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "2001:db8::2"} {
+		d.observe(context.Background(), netip.MustParseAddr(addr), time.Duration(i+1)*10*time.Millisecond, nil)
+	}
+	addresses := addrs("2001:db8::2", "192.0.2.2", "2001:db8::1", "192.0.2.1")
+	want := addrs("2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2")
+	if got := d.order(context.Background(), resolver.StrategyPreferIPv6, addresses); !slices.Equal(got, want) {
+		t.Errorf("prefer ipv6: %v, want %v", got, want)
+	}
+}
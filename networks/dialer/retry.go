@@ -0,0 +1,52 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// dialWithRetry dials address and retries failed dials with exponential backoff,
+// all attempts share the dial timeout.
+func (d *DefaultDialer) dialWithRetry(ctx context.Context, network, address string, data []byte) (net.Conn, error) {
+	if d.retries <= 0 {
+		return d.dialContext(ctx, network, address, data)
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		conn, err := d.dialContext(ctx, network, address, data)
+		if err == nil {
+			return conn, nil
+		}
+		if attempt >= d.retries || ctx.Err() != nil {
+			return nil, fmt.Errorf("dialer: %d attempts failed: %w", attempt+1, err)
+		}
+
+		timer := time.NewTimer(d.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, fmt.Errorf("dialer: %d attempts failed: %w", attempt+1, err)
+		}
+	}
+}
+
+// backoff returns the delay before retry n, counted from 0.
+// Half of it is random, so that clients of a restarting backend do not retry at the same time.
+func (d *DefaultDialer) backoff(n int) time.Duration {
+	delay := d.retryBackoff
+	for i := 0; i < n && delay < d.retryBackoffMax; i++ {
+		delay *= 2
+	}
+	delay = min(delay, d.retryBackoffMax)
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + rand.N(delay-half+1)
+}
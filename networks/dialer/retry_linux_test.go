@@ -0,0 +1,131 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	d := &DefaultDialer{retryBackoff: 100 * time.Millisecond, retryBackoffMax: time.Second}
+	tests := []struct {
+		n        int
+		min, max time.Duration
+	}{
+		{0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{1, 100 * time.Millisecond, 200 * time.Millisecond},
+		{2, 200 * time.Millisecond, 400 * time.Millisecond},
+		{3, 400 * time.Millisecond, 800 * time.Millisecond},
+		{4, 500 * time.Millisecond, time.Second},
+		{30, 500 * time.Millisecond, time.Second},
+	}
+	for _, tt := range tests {
+		for range 100 {
+			if delay := d.backoff(tt.n); delay < tt.min || delay > tt.max {
+				t.Fatalf("backoff(%d) = %s, want in [%s, %s]", tt.n, delay, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+// closedPort returns a loopback address nothing listens on, dials to it are refused at once.
+func closedPort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func TestDialRetries(t *testing.T) {
+	const backoff = 20 * time.Millisecond
+	for _, retries := range []int{0, 1, 3} {
+		d, err := NewDefault(DialConfig{Retries: retries, RetryBackoff: backoff, RetryBackoffMax: backoff})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		_, err = d.DialContext(context.Background(), "tcp4", closedPort(t))
+		if err == nil {
+			t.Fatal("dial to a closed port succeeded")
+		}
+		if retries > 0 && !strings.Contains(err.Error(), fmt.Sprintf("%d attempts failed", retries+1)) {
+			t.Errorf("retries %d: %v, want %d attempts", retries, err, retries+1)
+		}
+		// every retry waits at least half of the backoff
+		if elapsed := time.Since(start); elapsed < time.Duration(retries)*backoff/2 {
+			t.Errorf("retries %d: failed after %s, without backing off", retries, elapsed)
+		}
+	}
+}
+
+// unacceptedListener returns the address of a listener whose accept queue is full,
+// the kernel drops the SYNs sent to it as on a lossy path.
+func unacceptedListener(t *testing.T) string {
+	t.Helper()
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	if err = unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := netip.AddrPortFrom(netip.AddrFrom4(sa.(*unix.SockaddrInet4).Addr), uint16(sa.(*unix.SockaddrInet4).Port)).String()
+	for range 8 {
+		conn, err := net.DialTimeout("tcp4", address, 200*time.Millisecond)
+		if err != nil {
+			return address
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+	t.Skip("the accept queue of the listener does not fill up")
+	return ""
+}
+
+// TestDialAttemptTimeout checks that an attempt whose SYN is dropped leaves time for the retries.
+func TestDialAttemptTimeout(t *testing.T) {
+	const timeout = 900 * time.Millisecond
+	address := unacceptedListener(t)
+	tests := []struct {
+		name     string
+		config   DialConfig
+		attempts int
+	}{
+		{"default", DialConfig{Timeout: timeout, Retries: 2, RetryBackoff: time.Millisecond}, 3},
+		{"attempt timeout", DialConfig{Timeout: timeout, Retries: 5, AttemptTimeout: 400 * time.Millisecond,
+			RetryBackoff: time.Millisecond}, 3},
+	}
+	for _, tt := range tests {
+		d, err := NewDefault(tt.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		_, err = d.DialContext(context.Background(), "tcp4", address)
+		if err == nil {
+			t.Fatalf("%s: dial to a full accept queue succeeded", tt.name)
+		}
+		if !strings.Contains(err.Error(), fmt.Sprintf("%d attempts failed", tt.attempts)) {
+			t.Errorf("%s: %v, want %d attempts", tt.name, err, tt.attempts)
+		}
+		if elapsed := time.Since(start); elapsed > timeout+200*time.Millisecond {
+			t.Errorf("%s: failed after %s, the timeout of all attempts is %s", tt.name, elapsed, timeout)
+		}
+	}
+}
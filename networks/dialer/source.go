@@ -0,0 +1,151 @@
+package dialer
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/netip"
+	"sync/atomic"
+)
+
+// SourceSelection decides which address of a source pool a dial binds to.
+type SourceSelection string
+
+const (
+	SourceRoundRobin SourceSelection = "round_robin"
+	SourceRandom     SourceSelection = "random"
+	// SourceHash picks the address by the hash of the client address,
+	// so that a client always leaves from the same source address.
+	SourceHash SourceSelection = "hash"
+)
+
+func (s SourceSelection) IsValid() bool {
+	switch s {
+	case "", SourceRoundRobin, SourceRandom, SourceHash:
+		return true
+	default:
+		return false
+	}
+}
+
+type clientKey struct{}
+
+// WithClient returns a context carrying the client a dial is made for.
+func WithClient(ctx context.Context, client netip.Addr) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+func clientFromContext(ctx context.Context) (netip.Addr, bool) {
+	client, ok := ctx.Value(clientKey{}).(netip.Addr)
+	return client, ok && client.IsValid()
+}
+
+// sourcePrefixMaxWeight caps the share of the picks of a prefix. Beyond a few hundred
+// addresses more of them do not help, and a large prefix would take nearly every pick.
+const sourcePrefixMaxWeight = 256
+
+// sourcePool is a set of local addresses of one family given as prefixes.
+type sourcePool struct {
+	ranges    []sourceRange
+	total     uint64
+	selection SourceSelection
+	next      atomic.Uint64
+}
+
+// sourceRange is the addresses of a prefix that work as source address.
+type sourceRange struct {
+	first netip.Addr
+	// size is the number of addresses, saturated at math.MaxUint64
+	size   uint64
+	weight uint64
+}
+
+func newSourceRange(prefix netip.Prefix) sourceRange {
+	prefix = prefix.Masked()
+	r := sourceRange{first: prefix.Addr(), size: 1}
+	bits := prefix.Addr().BitLen() - prefix.Bits()
+	if bits > 0 {
+		r.size = math.MaxUint64
+		if bits < 64 {
+			r.size = 1 << bits
+		}
+		switch {
+		case prefix.Addr().Is4() && bits == 1:
+			// both addresses of a /31 are hosts (RFC 3021)
+		case prefix.Addr().Is4():
+			// neither the network nor the broadcast address
+			r.first = addrAdd(r.first, 1)
+			r.size -= 2
+		default:
+			// not the subnet-router anycast address (RFC 4291 section 2.6.1)
+			r.first = addrAdd(r.first, 1)
+			if bits < 64 {
+				// 1<<64 - 1 is the saturated size already
+				r.size--
+			}
+		}
+	}
+	r.weight = min(r.size, sourcePrefixMaxWeight)
+	return r
+}
+
+func newSourcePool(prefixes []netip.Prefix, selection SourceSelection) *sourcePool {
+	if len(prefixes) == 0 {
+		return nil
+	}
+	p := &sourcePool{selection: selection}
+	for _, prefix := range prefixes {
+		r := newSourceRange(prefix)
+		p.ranges = append(p.ranges, r)
+		p.total += r.weight
+	}
+	return p
+}
+
+func (p *sourcePool) pick(ctx context.Context) netip.Addr {
+	var n uint64
+	switch p.selection {
+	case SourceRandom:
+		n = rand.Uint64()
+	case SourceHash:
+		if client, ok := clientFromContext(ctx); ok {
+			h := fnv.New64a()
+			h.Write(client.Unmap().AsSlice())
+			n = h.Sum64()
+			break
+		}
+		fallthrough
+	default:
+		n = p.next.Add(1) - 1
+	}
+	// the prefix is picked by weight, an address of a prefix larger than its weight
+	// moves on by the weight every round, so that all of them are used
+	round, index := n/p.total, n%p.total
+	for _, r := range p.ranges {
+		if index < r.weight {
+			return addrAdd(r.first, (round*r.weight+index)%r.size)
+		}
+		index -= r.weight
+	}
+	return p.ranges[0].first
+}
+
+// addrAdd returns the address n after addr.
+func addrAdd(addr netip.Addr, n uint64) netip.Addr {
+	if addr.Is4() {
+		bs := addr.As4()
+		v := binary.BigEndian.Uint32(bs[:]) + uint32(n)
+		binary.BigEndian.PutUint32(bs[:], v)
+		return netip.AddrFrom4(bs)
+	}
+	bs := addr.As16()
+	low := binary.BigEndian.Uint64(bs[8:])
+	sum := low + n
+	binary.BigEndian.PutUint64(bs[8:], sum)
+	if sum < low {
+		binary.BigEndian.PutUint64(bs[:8], binary.BigEndian.Uint64(bs[:8])+1)
+	}
+	return netip.AddrFrom16(bs).WithZone(addr.Zone())
+}
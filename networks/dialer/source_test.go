@@ -0,0 +1,79 @@
+package dialer
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestSourcePoolUsableAddresses(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"192.0.2.0/30", []string{"192.0.2.1", "192.0.2.2"}},
+		{"192.0.2.4/31", []string{"192.0.2.4", "192.0.2.5"}},
+		{"192.0.2.9/32", []string{"192.0.2.9"}},
+		{"2001:db8::/126", []string{"2001:db8::1", "2001:db8::2", "2001:db8::3"}},
+		{"2001:db8::5/128", []string{"2001:db8::5"}},
+	}
+	for _, tt := range tests {
+		pool := newSourcePool([]netip.Prefix{netip.MustParsePrefix(tt.prefix)}, SourceRoundRobin)
+		for round := range 2 {
+			for i, want := range tt.want {
+				if got := pool.pick(context.Background()); got.String() != want {
+					t.Errorf("%s: pick %d of round %d = %s, want %s", tt.prefix, i, round, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestSourcePoolLargePrefix(t *testing.T) {
+	pool := newSourcePool([]netip.Prefix{
+		netip.MustParsePrefix("2001:db8::/64"),
+		netip.MustParsePrefix("2001:db8:1::/127"),
+	}, SourceRandom)
+	var small int
+	seen := make(map[netip.Addr]bool)
+	const picks = 10000
+	for range picks {
+		addr := pool.pick(context.Background())
+		if addr.IsUnspecified() || addr == netip.MustParseAddr("2001:db8::") || addr == netip.MustParseAddr("2001:db8:1::") {
+			t.Fatalf("picked the subnet-router anycast address %s", addr)
+		}
+		if netip.MustParsePrefix("2001:db8:1::/127").Contains(addr) {
+			small++
+		}
+		seen[addr] = true
+	}
+	// the /64 weighs sourcePrefixMaxWeight, the /127 has a single usable address
+	if want := picks / (sourcePrefixMaxWeight + 1); small < want/2 || small > want*2 {
+		t.Errorf("the small prefix got %d of %d picks, want about %d", small, picks, want)
+	}
+	if len(seen) < picks/2 {
+		t.Errorf("%d different addresses in %d picks of a /64", len(seen), picks)
+	}
+}
+
+func TestSourcePoolRoundRobinCoversLargePrefix(t *testing.T) {
+	pool := newSourcePool([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/22")}, SourceRoundRobin)
+	seen := make(map[netip.Addr]bool)
+	for range 1022 {
+		seen[pool.pick(context.Background())] = true
+	}
+	if len(seen) != 1022 {
+		t.Errorf("round robin used %d of the 1022 hosts of a /22", len(seen))
+	}
+}
+
+func TestSourcePoolHash(t *testing.T) {
+	pool := newSourcePool([]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}, SourceHash)
+	ctx := WithClient(context.Background(), netip.MustParseAddr("198.51.100.7"))
+	first := pool.pick(ctx)
+	for range 10 {
+		if addr := pool.pick(ctx); addr != first {
+			t.Fatalf("a client left from %s and %s", first, addr)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package dialer
+
+import (
+	"context"
+	"github.com/metacubex/tfo-go"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpiOptSynData is TCPI_OPT_SYN_DATA of linux/tcp.h, set once the data in the SYN is acknowledged.
+const tcpiOptSynData = 0x20
+
+func TestDialTFO(t *testing.T) {
+	value, err := os.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	if err != nil {
+		t.Skipf("read tcp_fastopen: %v", err)
+	}
+	// both the client (1) and the server (2) side are needed on loopback
+	if mode, _ := strconv.Atoi(strings.TrimSpace(string(value))); mode&3 != 3 {
+		t.Skipf("net.ipv4.tcp_fastopen is %d, TFO on loopback needs 3", mode)
+	}
+
+	listener, err := (&tfo.ListenConfig{}).Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	d, err := NewDefault(DialConfig{TFO: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first connection fetches the TFO cookie, the second one carries data in its SYN
+	for i := range 2 {
+		conn, err := d.DialContextEarly(context.Background(), "tcp4", listener.Addr().String(), []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 5)
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Fatalf("dial %d: read %q, %v", i, buf, err)
+		}
+		var info *unix.TCPInfo
+		raw, err := conn.(syscall.Conn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = raw.Control(func(fd uintptr) {
+			info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+		})
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && info.Options&tcpiOptSynData == 0 {
+			t.Error("the data was not sent in the SYN")
+		}
+	}
+}
+
+// TestDialTFOFallback checks that the data reaches a server without TFO.
+func TestDialTFOFallback(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		_, _ = io.ReadFull(conn, buf)
+		received <- string(buf)
+	}()
+
+	d, err := NewDefault(DialConfig{TFO: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.DialContextEarly(context.Background(), "tcp4", listener.Addr().String(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case data := <-received:
+		if data != "hello" {
+			t.Fatalf("server read %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server received nothing")
+	}
+}
@@ -0,0 +1,355 @@
+package listener
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/sagernet/sing/common/control"
+	"golang.org/x/sys/unix"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// maxGSOSegments is the kernel limit (UDP_MAX_SEGMENTS) of segments per gso send
+	maxGSOSegments = 64
+	// maxGSOSize is the max total payload of one gso send
+	maxGSOSize = 65507
+	// groBufferSize is the read buffer size required to hold a gro coalesced datagram
+	groBufferSize = 65535
+	batchOOBSize  = 128
+)
+
+type mmsghdr struct {
+	Hdr unix.Msghdr
+	Len uint32
+	_   [unsafe.Sizeof(uintptr(0)) - 4]byte
+}
+
+// BatchConn reads and writes udp datagrams in batches with recvmmsg/sendmmsg,
+// using UDP_GRO/UDP_SEGMENT offload where the kernel supports it.
+type BatchConn struct {
+	conn    *net.UDPConn
+	rawConn syscall.RawConn
+	is6     bool
+	gro     bool
+	gso     bool
+
+	// read side, only accessed by the reading goroutine
+	buffers [][]byte
+	oobs    [][]byte
+	names   []unix.RawSockaddrInet6
+	iovecs  []unix.Iovec
+	headers []mmsghdr
+
+	writeAccess  sync.Mutex
+	writeName    unix.RawSockaddrInet6
+	writeIovecs  []unix.Iovec
+	writeHeaders []mmsghdr
+	writeOOBs    [][]byte
+}
+
+// NewBatchConn wraps conn for batched I/O. size is the max number of datagrams
+// per batch and bufferSize the size of each read buffer.
+// If offload is set, UDP_GRO and UDP_SEGMENT are enabled when available.
+func NewBatchConn(conn *net.UDPConn, size int, bufferSize int, offload bool) (*BatchConn, error) {
+	if size <= 1 {
+		return nil, errors.New("batch: size must be greater than 1")
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	c := &BatchConn{
+		conn:    conn,
+		rawConn: rawConn,
+	}
+	err = control.Raw(rawConn, func(fd uintptr) error {
+		domain, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if err != nil {
+			return os.NewSyscallError("getsockopt", err)
+		}
+		c.is6 = domain == unix.AF_INET6
+		if !offload {
+			return nil
+		}
+		if _, err := unix.GetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_SEGMENT); err == nil {
+			c.gso = true
+		}
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, unix.UDP_GRO, 1); err == nil {
+			c.gro = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.gro {
+		bufferSize = max(bufferSize, groBufferSize)
+	}
+
+	c.buffers = make([][]byte, size)
+	c.oobs = make([][]byte, size)
+	c.names = make([]unix.RawSockaddrInet6, size)
+	c.iovecs = make([]unix.Iovec, size)
+	c.headers = make([]mmsghdr, size)
+	for i := range size {
+		c.buffers[i] = make([]byte, bufferSize)
+		c.oobs[i] = make([]byte, batchOOBSize)
+		c.iovecs[i].Base = &c.buffers[i][0]
+		c.iovecs[i].SetLen(bufferSize)
+		c.headers[i].Hdr.Name = (*byte)(unsafe.Pointer(&c.names[i]))
+		c.headers[i].Hdr.Iov = &c.iovecs[i]
+		c.headers[i].Hdr.SetIovlen(1)
+		c.headers[i].Hdr.Control = &c.oobs[i][0]
+	}
+	return c, nil
+}
+
+// Offload reports whether gro and gso are enabled.
+func (c *BatchConn) Offload() (gro bool, gso bool) {
+	return c.gro, c.gso
+}
+
+// ReadBatch reads a batch of datagrams and calls handle for each of them.
+// Gro coalesced datagrams are split into their original segments.
+// p and oob are only valid until handle returns.
+func (c *BatchConn) ReadBatch(handle func(p []byte, oob []byte, remote netip.AddrPort)) error {
+	for i := range c.headers {
+		c.headers[i].Hdr.Namelen = unix.SizeofSockaddrInet6
+		c.headers[i].Hdr.SetControllen(batchOOBSize)
+		c.headers[i].Hdr.Flags = 0
+		c.headers[i].Len = 0
+	}
+	var (
+		n       int
+		errno   syscall.Errno
+		headers = c.headers
+	)
+	err := c.rawConn.Read(func(fd uintptr) bool {
+		for {
+			r, _, e := unix.Syscall6(unix.SYS_RECVMMSG, fd,
+				uintptr(unsafe.Pointer(&headers[0])), uintptr(len(headers)),
+				unix.MSG_DONTWAIT, 0, 0)
+			switch e {
+			case unix.EINTR:
+				continue
+			case unix.EAGAIN:
+				return false
+			}
+			n, errno = int(r), e
+			return true
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return os.NewSyscallError("recvmmsg", errno)
+	}
+
+	for i := range n {
+		header := &c.headers[i]
+		remote := sockaddrToAddrPort(&c.names[i])
+		p := c.buffers[i][:header.Len]
+		oob := c.oobs[i][:header.Hdr.Controllen]
+		segment := len(p)
+		if c.gro {
+			if size := groSegmentSize(oob); size > 0 {
+				segment = size
+			}
+		}
+		if segment == 0 {
+			handle(p, oob, remote)
+			continue
+		}
+		for len(p) > 0 {
+			m := min(segment, len(p))
+			handle(p[:m], oob, remote)
+			p = p[m:]
+		}
+	}
+	return nil
+}
+
+// WriteBatch writes packets to remote, or to the connected peer if remote is invalid.
+// oob is attached to every datagram if not empty.
+// Consecutive packets of the same size are merged into one gso send when available.
+func (c *BatchConn) WriteBatch(packets [][]byte, oob []byte, remote netip.AddrPort) error {
+	if len(packets) == 0 {
+		return nil
+	}
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+
+	var (
+		name    *byte
+		namelen uint32
+	)
+	if remote.IsValid() {
+		namelen = c.putSockaddr(&c.writeName, remote)
+		name = (*byte)(unsafe.Pointer(&c.writeName))
+	}
+	oobSize := len(oob) + unix.CmsgSpace(2)
+	if cap(c.writeIovecs) < len(packets) {
+		c.writeIovecs = make([]unix.Iovec, len(packets))
+		c.writeHeaders = make([]mmsghdr, len(packets))
+		c.writeOOBs = make([][]byte, len(packets))
+	}
+	for i := range c.writeOOBs {
+		if cap(c.writeOOBs[i]) < oobSize {
+			c.writeOOBs[i] = make([]byte, oobSize)
+		}
+	}
+
+	for {
+		iovecs := c.writeIovecs[:len(packets)]
+		headers := c.writeHeaders[:0]
+		for i, p := range packets {
+			iovecs[i] = unix.Iovec{}
+			if len(p) > 0 {
+				iovecs[i].Base = &p[0]
+			}
+			iovecs[i].SetLen(len(p))
+		}
+		segmented := false
+		for i := 0; i < len(packets); {
+			j := i + 1
+			size := len(packets[i])
+			if c.gso && size > 0 {
+				total := size
+				for j < len(packets) && j-i < maxGSOSegments &&
+					len(packets[j]) > 0 && len(packets[j]) <= size && total+len(packets[j]) <= maxGSOSize {
+					total += len(packets[j])
+					j++
+					if len(packets[j-1]) < size {
+						// only the last segment can be shorter
+						break
+					}
+				}
+			}
+			header := mmsghdr{}
+			header.Hdr.Name = name
+			header.Hdr.Namelen = namelen
+			header.Hdr.Iov = &iovecs[i]
+			header.Hdr.SetIovlen(j - i)
+			control := c.writeOOBs[len(headers)][:len(oob)]
+			copy(control, oob)
+			if j-i > 1 {
+				control = control[:len(oob)+unix.CmsgSpace(2)]
+				putGSOSegmentSize(control[len(oob):], size)
+				segmented = true
+			}
+			if len(control) > 0 {
+				header.Hdr.Control = &control[0]
+				header.Hdr.SetControllen(len(control))
+			}
+			headers = append(headers, header)
+			i = j
+		}
+
+		err := c.sendmmsg(headers)
+		if errors.Is(err, unix.EIO) && segmented {
+			// the device does not support checksum offload, disable gso and send again
+			c.gso = false
+			continue
+		}
+		return err
+	}
+}
+
+func (c *BatchConn) sendmmsg(headers []mmsghdr) error {
+	var errno syscall.Errno
+	for len(headers) > 0 {
+		var n int
+		err := c.rawConn.Write(func(fd uintptr) bool {
+			for {
+				r, _, e := unix.Syscall6(unix.SYS_SENDMMSG, fd,
+					uintptr(unsafe.Pointer(&headers[0])), uintptr(len(headers)),
+					unix.MSG_DONTWAIT, 0, 0)
+				switch e {
+				case unix.EINTR:
+					continue
+				case unix.EAGAIN:
+					return false
+				}
+				n, errno = int(r), e
+				return true
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if errno != 0 {
+			return os.NewSyscallError("sendmmsg", errno)
+		}
+		headers = headers[n:]
+	}
+	return nil
+}
+
+func (c *BatchConn) putSockaddr(sa *unix.RawSockaddrInet6, remote netip.AddrPort) uint32 {
+	*sa = unix.RawSockaddrInet6{}
+	addr := remote.Addr()
+	port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	binary.BigEndian.PutUint16(port[:], remote.Port())
+	if !c.is6 {
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		sa4.Family = unix.AF_INET
+		sa4.Addr = addr.Unmap().As4()
+		return unix.SizeofSockaddrInet4
+	}
+	sa.Family = unix.AF_INET6
+	sa.Addr = addr.As16()
+	if zone := addr.Zone(); zone != "" {
+		if index, err := strconv.Atoi(zone); err == nil {
+			sa.Scope_id = uint32(index)
+		} else if iif, err := net.InterfaceByName(zone); err == nil {
+			sa.Scope_id = uint32(iif.Index)
+		}
+	}
+	return unix.SizeofSockaddrInet6
+}
+
+func sockaddrToAddrPort(sa *unix.RawSockaddrInet6) netip.AddrPort {
+	port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&sa.Port))[:])
+	switch sa.Family {
+	case unix.AF_INET:
+		sa4 := (*unix.RawSockaddrInet4)(unsafe.Pointer(sa))
+		return netip.AddrPortFrom(netip.AddrFrom4(sa4.Addr), port)
+	case unix.AF_INET6:
+		addr := netip.AddrFrom16(sa.Addr)
+		if sa.Scope_id != 0 {
+			addr = addr.WithZone(strconv.FormatUint(uint64(sa.Scope_id), 10))
+		}
+		return netip.AddrPortFrom(addr, port)
+	default:
+		return netip.AddrPort{}
+	}
+}
+
+func groSegmentSize(oob []byte) int {
+	for len(oob) > 0 {
+		header, data, remainder, err := unix.ParseOneSocketControlMessage(oob)
+		if err != nil {
+			return 0
+		}
+		if header.Level == unix.IPPROTO_UDP && header.Type == unix.UDP_GRO && len(data) >= 4 {
+			return int(binary.NativeEndian.Uint32(data))
+		}
+		oob = remainder
+	}
+	return 0
+}
+
+func putGSOSegmentSize(oob []byte, size int) {
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = unix.IPPROTO_UDP
+	header.Type = unix.UDP_SEGMENT
+	header.SetLen(unix.CmsgLen(2))
+	binary.NativeEndian.PutUint16(oob[unix.CmsgLen(0):], uint16(size))
+}
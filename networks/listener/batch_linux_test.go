@@ -0,0 +1,169 @@
+package listener
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+const (
+	benchBatchSize  = 32
+	benchPacketSize = 1200
+)
+
+func listenLoopback(t testing.TB) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newBatchConn(t testing.TB, conn *net.UDPConn, offload bool) *BatchConn {
+	t.Helper()
+	c, err := NewBatchConn(conn, benchBatchSize, 2048, offload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func benchPackets() [][]byte {
+	packets := make([][]byte, benchBatchSize)
+	for i := range packets {
+		packets[i] = bytes.Repeat([]byte{byte(i)}, benchPacketSize)
+	}
+	return packets
+}
+
+func TestBatchConnRoundTrip(t *testing.T) {
+	for _, offload := range []bool{false, true} {
+		sender, receiver := listenLoopback(t), listenLoopback(t)
+		batchSender, batchReceiver := newBatchConn(t, sender, offload), newBatchConn(t, receiver, offload)
+		// the same sizes are sent as one gso send, the shorter last one ends it
+		packets := [][]byte{
+			bytes.Repeat([]byte{1}, 1000), bytes.Repeat([]byte{2}, 1000), bytes.Repeat([]byte{3}, 1000),
+			bytes.Repeat([]byte{4}, 10), bytes.Repeat([]byte{5}, 1400),
+		}
+		to := receiver.LocalAddr().(*net.UDPAddr).AddrPort()
+		if err := batchSender.WriteBatch(packets, nil, to); err != nil {
+			t.Fatal(err)
+		}
+
+		from := sender.LocalAddr().(*net.UDPAddr).AddrPort()
+		var received [][]byte
+		_ = receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for len(received) < len(packets) {
+			err := batchReceiver.ReadBatch(func(p []byte, oob []byte, remote netip.AddrPort) {
+				if remote != from {
+					t.Errorf("offload %v: remote = %s, want %s", offload, remote, from)
+				}
+				received = append(received, bytes.Clone(p))
+			})
+			if err != nil {
+				t.Fatalf("offload %v: read: %v", offload, err)
+			}
+		}
+		for i := range packets {
+			if !bytes.Equal(received[i], packets[i]) {
+				t.Errorf("offload %v: packet %d has %d bytes of %d, want %d bytes of %d", offload, i,
+					len(received[i]), received[i][0], len(packets[i]), packets[i][0])
+			}
+		}
+	}
+}
+
+// drain reads conn until it is closed, so that the writes of a benchmark are not refused.
+func drain(conn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// BenchmarkUDPWrite compares a WriteToUDPAddrPort per datagram with sendmmsg and gso,
+// an op writes a batch of benchBatchSize datagrams.
+func BenchmarkUDPWrite(b *testing.B) {
+	packets := benchPackets()
+	b.Run("single", func(b *testing.B) {
+		sender, receiver := listenLoopback(b), listenLoopback(b)
+		go drain(receiver)
+		to := receiver.LocalAddr().(*net.UDPAddr).AddrPort()
+		b.SetBytes(benchBatchSize * benchPacketSize)
+		for b.Loop() {
+			for _, p := range packets {
+				if _, err := sender.WriteToUDPAddrPort(p, to); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	for _, mode := range []struct {
+		name    string
+		offload bool
+	}{{"batch", false}, {"batch-gso", true}} {
+		b.Run(mode.name, func(b *testing.B) {
+			sender, receiver := listenLoopback(b), listenLoopback(b)
+			go drain(receiver)
+			batch := newBatchConn(b, sender, mode.offload)
+			to := receiver.LocalAddr().(*net.UDPAddr).AddrPort()
+			b.SetBytes(benchBatchSize * benchPacketSize)
+			for b.Loop() {
+				if err := batch.WriteBatch(packets, nil, to); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkUDPRead compares a ReadFromUDPAddrPort per datagram with recvmmsg and gro,
+// an op reads one datagram. The sender writes in batches until the benchmark ends.
+func BenchmarkUDPRead(b *testing.B) {
+	flood := func(b *testing.B, to netip.AddrPort) {
+		sender := listenLoopback(b)
+		batch := newBatchConn(b, sender, true)
+		packets := benchPackets()
+		go func() {
+			for batch.WriteBatch(packets, nil, to) == nil {
+			}
+		}()
+	}
+	b.Run("single", func(b *testing.B) {
+		receiver := listenLoopback(b)
+		flood(b, receiver.LocalAddr().(*net.UDPAddr).AddrPort())
+		_ = receiver.SetReadBuffer(4 << 20)
+		buf := make([]byte, 2048)
+		b.SetBytes(benchPacketSize)
+		for b.Loop() {
+			if _, _, err := receiver.ReadFromUDPAddrPort(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, mode := range []struct {
+		name    string
+		offload bool
+	}{{"batch", false}, {"batch-gro", true}} {
+		b.Run(mode.name, func(b *testing.B) {
+			receiver := listenLoopback(b)
+			flood(b, receiver.LocalAddr().(*net.UDPAddr).AddrPort())
+			_ = receiver.SetReadBuffer(4 << 20)
+			batch := newBatchConn(b, receiver, mode.offload)
+			b.SetBytes(benchPacketSize)
+			count := 0
+			handle := func(p []byte, oob []byte, remote netip.AddrPort) { count++ }
+			for count < b.N {
+				if err := batch.ReadBatch(handle); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package listener
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// BatchConn is only supported on Linux.
+type BatchConn struct{}
+
+func NewBatchConn(conn *net.UDPConn, size int, bufferSize int, offload bool) (*BatchConn, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (c *BatchConn) Offload() (gro bool, gso bool) {
+	return false, false
+}
+
+func (c *BatchConn) ReadBatch(handle func(p []byte, oob []byte, remote netip.AddrPort)) error {
+	return errors.ErrUnsupported
+}
+
+func (c *BatchConn) WriteBatch(packets [][]byte, oob []byte, remote netip.AddrPort) error {
+	return errors.ErrUnsupported
+}
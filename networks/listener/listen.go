@@ -2,20 +2,46 @@ package listener
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/metacubex/tfo-go"
 	"github.com/sagernet/sing/common"
 	"github.com/sagernet/sing/common/control"
 	"github.com/woshikedayaa/traffics/networks/constant"
+	"github.com/woshikedayaa/traffics/networks/sockopt"
 	"log/slog"
 	"net"
 	"net/netip"
+	"runtime"
+	"syscall"
 )
 
 type PacketWriter interface {
 	WritePacket(bs []byte, remote netip.AddrPort)
 }
 
+// PacketBatchWriter writes several packets to the same remote at once.
+type PacketBatchWriter interface {
+	PacketWriter
+	WritePackets(bs [][]byte, remote netip.AddrPort)
+}
+
+// PacketInfo is the local address and interface a packet was received on.
+type PacketInfo struct {
+	Local     netip.Addr
+	Interface int
+}
+
+func (i PacketInfo) IsValid() bool {
+	return i.Local.IsValid()
+}
+
+// PacketInfoWriter writes packets to remote from the local address in info,
+// so that replies of a wildcard bind leave from the address the client targeted.
+type PacketInfoWriter interface {
+	WritePacketsFrom(bs [][]byte, remote netip.AddrPort, info PacketInfo)
+}
+
 type PacketHandler interface {
 	HandlePacket(p []byte, remote netip.AddrPort, pw PacketWriter)
 }
@@ -29,13 +55,17 @@ type ConnHandler interface {
 }
 
 type (
-	FuncPacketHandler func(p []byte, remote netip.AddrPort, pw PacketWriter)
-	FuncConnHandler   func(ctx context.Context, conn net.Conn)
+	FuncPacketHandler    func(p []byte, remote netip.AddrPort, pw PacketWriter)
+	FuncPacketHandlerOOb func(oob []byte, p []byte, remote netip.AddrPort, pw PacketWriter)
+	FuncConnHandler      func(ctx context.Context, conn net.Conn)
 )
 
 func (f FuncPacketHandler) HandlePacket(p []byte, remote netip.AddrPort, pw PacketWriter) {
 	f(p, remote, pw)
 }
+func (f FuncPacketHandlerOOb) HandlePacketOOb(oob []byte, p []byte, remote netip.AddrPort, pw PacketWriter) {
+	f(oob, p, remote, pw)
+}
 func (f FuncConnHandler) HandleConn(ctx context.Context, conn net.Conn) {
 	f(ctx, conn)
 }
@@ -50,6 +80,7 @@ type ListenOptions struct {
 	Family    string
 	Interface string
 	ReuseAddr bool
+	Socket    sockopt.Options
 
 	// tcp
 	TFO   bool
@@ -58,6 +89,12 @@ type ListenOptions struct {
 	// udp
 	UDPFragment   bool
 	UDPBufferSize int
+	UDPBatchSize  int
+
+	// Workers is the number of SO_REUSEPORT sockets opened per protocol,
+	// each served by its own goroutine.
+	Workers     int
+	CPUAffinity bool
 
 	// Handler
 	PacketHandler    PacketHandler
@@ -75,9 +112,18 @@ type Listener struct {
 	packetHandlerOOb PacketHandlerOOb
 
 	// internal
-	udpConn     *net.UDPConn
-	tcpListener net.Listener
-	cancel      context.CancelFunc
+	udpWorkers   []*udpWorker
+	tcpListeners []net.Listener
+	cancel       context.CancelFunc
+}
+
+// udpWorker serves one udp socket of a listener.
+// Replies are written back from the socket the request was read from.
+type udpWorker struct {
+	l         *Listener
+	index     int
+	conn      *net.UDPConn
+	batchConn *BatchConn
 }
 
 func NewListener(ctx context.Context, logger *slog.Logger,
@@ -95,34 +141,96 @@ func NewListener(ctx context.Context, logger *slog.Logger,
 	}
 }
 
+// Start opens the sockets of the listener and serves them. If a socket fails to open,
+// the ones already opened are closed.
 func (l *Listener) Start() error {
+	workers := max(l.options.Workers, 1)
+	if workers > 1 && runtime.GOOS != "linux" {
+		return errors.New("listen: `workers` is only supported on Linux")
+	}
 	if l.options.Network.Contain(string(constant.ProtocolTCP)) {
-		_, err := l.ListenTCP()
-		if err != nil {
-			return err
+		for i := range workers {
+			listener, err := l.ListenTCP()
+			if err != nil {
+				l.Close()
+				return err
+			}
+			l.tcpListeners = append(l.tcpListeners, listener)
+			if conn, ok := listener.(syscall.Conn); ok && l.options.CPUAffinity {
+				// with SO_REUSEPORT, connections are accepted by the listener of the cpu they arrive on
+				if err = setIncomingCPU(conn, l.cpu(i)); err != nil {
+					l.logger.WarnContext(l.ctx, "set incoming cpu failed", slog.String("error", err.Error()))
+				}
+			}
+			l.logger.InfoContext(l.ctx, "new tcp server started at",
+				slog.String("address", listener.Addr().String()), slog.Int("worker", i))
+			go l.loopTcp(i, listener)
 		}
-		l.logger.InfoContext(l.ctx, "new tcp server started at",
-			slog.String("address", l.tcpListener.Addr().String()))
-		go l.loopTcp()
 	}
 	if l.options.Network.Contain(string(constant.ProtocolUDP)) {
-		_, err := l.ListenUDP()
-		if err != nil {
-			return err
-		}
+		for i := range workers {
+			conn, err := l.ListenUDP()
+			if err != nil {
+				l.Close()
+				return err
+			}
+			w := &udpWorker{l: l, index: i, conn: conn}
+			l.udpWorkers = append(l.udpWorkers, w)
+			if l.packetHandlerOOb != nil && l.options.Address.IsUnspecified() {
+				if err = enablePacketInfo(conn); err != nil {
+					l.logger.WarnContext(l.ctx, "enable packet info failed", slog.String("error", err.Error()))
+				}
+			}
+			if l.options.CPUAffinity {
+				if err = setIncomingCPU(conn, l.cpu(i)); err != nil {
+					l.logger.WarnContext(l.ctx, "set incoming cpu failed", slog.String("error", err.Error()))
+				}
+			}
 
-		if l.packetHandlerOOb != nil {
-			go l.loopUdpInOOb()
-		} else {
-			go l.loopUdpIn()
+			if l.options.UDPBatchSize > 1 {
+				w.batchConn, err = NewBatchConn(conn, l.options.UDPBatchSize, l.options.UDPBufferSize, true)
+				if err != nil {
+					l.logger.WarnContext(l.ctx, "batch udp io is unavailable, fallback",
+						slog.String("error", err.Error()))
+				} else {
+					gro, gso := w.batchConn.Offload()
+					l.logger.DebugContext(l.ctx, "batch udp io enabled",
+						slog.Int("size", l.options.UDPBatchSize), slog.Bool("gro", gro), slog.Bool("gso", gso))
+				}
+			}
+
+			switch {
+			case w.batchConn != nil:
+				go w.loopUdpInBatch()
+			case l.packetHandlerOOb != nil:
+				go w.loopUdpInOOb()
+			default:
+				go w.loopUdpIn()
+			}
+			l.logger.InfoContext(l.ctx, "new udp server started at",
+				slog.String("address", conn.LocalAddr().String()), slog.Int("worker", i))
+			// go l.loopUdpOut()
 		}
-		l.logger.InfoContext(l.ctx, "new udp server started at",
-			slog.String("address", l.tcpListener.Addr().String()))
-		// go l.loopUdpOut()
 	}
 	return nil
 }
 
+// cpu returns the cpu the worker with index should be pinned to.
+func (l *Listener) cpu(index int) int {
+	return index % runtime.NumCPU()
+}
+
+// pin locks the calling goroutine to the cpu of worker index if cpu affinity is enabled.
+func (l *Listener) pin(index int) {
+	if !l.options.CPUAffinity {
+		return
+	}
+	if err := pinToCPU(l.cpu(index)); err != nil {
+		l.logger.WarnContext(l.ctx, "set cpu affinity failed",
+			slog.Int("worker", index), slog.String("error", err.Error()))
+	}
+}
+
 func (l *Listener) ListenUDP() (*net.UDPConn, error) {
 	var (
 		listenConfig net.ListenConfig
@@ -136,9 +244,13 @@ func (l *Listener) ListenUDP() (*net.UDPConn, error) {
 	if l.options.ReuseAddr {
 		listenConfig.Control = control.Append(listenConfig.Control, control.ReuseAddr())
 	}
+	if l.options.Workers > 1 {
+		listenConfig.Control = control.Append(listenConfig.Control, reusePort())
+	}
 	if !l.options.UDPFragment {
 		listenConfig.Control = control.Append(listenConfig.Control, control.DisableUDPFragment())
 	}
+	listenConfig.Control = control.Append(listenConfig.Control, l.options.Socket.Control())
 	var (
 		bindAddress = netip.AddrPortFrom(l.options.Address, l.options.Port).String()
 		network     string
@@ -157,8 +269,7 @@ func (l *Listener) ListenUDP() (*net.UDPConn, error) {
 		return nil, fmt.Errorf("listen: %w", err)
 	}
 
-	l.udpConn = packetConn.(*net.UDPConn)
-	return l.udpConn, nil
+	return packetConn.(*net.UDPConn), nil
 }
 
 func (l *Listener) ListenTCP() (net.Listener, error) {
@@ -174,13 +285,11 @@ func (l *Listener) ListenTCP() (net.Listener, error) {
 	if l.options.ReuseAddr {
 		listenConfig.Control = control.Append(listenConfig.Control, control.ReuseAddr())
 	}
-	// TODO: customize keepAlive(listen)
-	listenConfig.KeepAliveConfig = net.KeepAliveConfig{
-		Enable:   true,
-		Idle:     constant.KeepAliveInitial,
-		Interval: constant.KeepAliveInterval,
-		Count:    constant.KeepAliveProbeCount,
+	if l.options.Workers > 1 {
+		listenConfig.Control = control.Append(listenConfig.Control, reusePort())
 	}
+	listenConfig.Control = control.Append(listenConfig.Control, l.options.Socket.Control())
+	listenConfig.KeepAliveConfig = l.options.Socket.KeepAliveConfig()
 	if l.options.MPTCP {
 		listenConfig.SetMultipathTCP(true)
 	}
@@ -209,25 +318,26 @@ func (l *Listener) ListenTCP() (net.Listener, error) {
 		return nil, fmt.Errorf("listen: %w", err)
 	}
 
-	l.tcpListener = listener
 	return listener, nil
 }
 
 func (l *Listener) Close() error {
 	l.cancel()
-	if l.tcpListener != nil {
-		l.tcpListener.Close()
+	for _, listener := range l.tcpListeners {
+		listener.Close()
 	}
-	if l.udpConn != nil {
-		l.udpConn.Close()
+	for _, w := range l.udpWorkers {
+		w.conn.Close()
 	}
 	return nil
 }
 
-func (l *Listener) loopUdpIn() {
+func (w *udpWorker) loopUdpIn() {
+	l := w.l
+	l.pin(w.index)
 	buf := make([]byte, l.options.UDPBufferSize)
-	for l.udpConn != nil {
-		n, remote, err := l.udpConn.ReadFromUDPAddrPort(buf[0:l.options.UDPBufferSize])
+	for w.conn != nil {
+		n, remote, err := w.conn.ReadFromUDPAddrPort(buf[0:l.options.UDPBufferSize])
 		if err != nil {
 			if common.Done(l.ctx) {
 				return
@@ -239,15 +349,39 @@ func (l *Listener) loopUdpIn() {
 		//	l.logger.Warn("read a zero size udp message without error")
 		//	continue
 		//}
-		l.packetHandler.HandlePacket(buf[:n], remote, l)
+		l.packetHandler.HandlePacket(buf[:n], remote, w)
 	}
 }
 
-func (l *Listener) loopUdpInOOb() {
+func (w *udpWorker) loopUdpInBatch() {
+	l := w.l
+	l.pin(w.index)
+	handle := func(p []byte, oob []byte, remote netip.AddrPort) {
+		if l.packetHandlerOOb != nil {
+			l.packetHandlerOOb.HandlePacketOOb(oob, p, remote, w)
+		} else {
+			l.packetHandler.HandlePacket(p, remote, w)
+		}
+	}
+	for w.batchConn != nil {
+		err := w.batchConn.ReadBatch(handle)
+		if err != nil {
+			if common.Done(l.ctx) {
+				return
+			}
+			l.logger.Error("read udp message", slog.String("error", err.Error()))
+			continue
+		}
+	}
+}
+
+func (w *udpWorker) loopUdpInOOb() {
+	l := w.l
+	l.pin(w.index)
 	buf := make([]byte, l.options.UDPBufferSize)
 	oob := make([]byte, 4096)
-	for l.udpConn != nil {
-		n, oobN, _, remote, err := l.udpConn.ReadMsgUDPAddrPort(buf[0:l.options.UDPBufferSize], oob[0:len(oob)])
+	for w.conn != nil {
+		n, oobN, _, remote, err := w.conn.ReadMsgUDPAddrPort(buf[0:l.options.UDPBufferSize], oob[0:len(oob)])
 		if err != nil {
 			if common.Done(l.ctx) {
 				return
@@ -259,7 +393,7 @@ func (l *Listener) loopUdpInOOb() {
 			l.logger.Warn("read a zero size udp message without error")
 			continue
 		}
-		l.packetHandlerOOb.HandlePacketOOb(oob[:oobN], buf[:n], remote, l)
+		l.packetHandlerOOb.HandlePacketOOb(oob[:oobN], buf[:n], remote, w)
 	}
 }
 
@@ -276,7 +410,7 @@ func (l *Listener) loopUdpInOOb() {
 //			nn, err := l.udpConn.WriteToUDPAddrPort(pp.Data, pp.Remote)
 //			_ = nn
 //			if err != nil {
-//				l.logger.ErrorContext(l.ctx, "write udp message", err)
+//				l.logger.ErrorContext(l.ctx, "write udp message", slog.String("error", err.Error()))
 //			}
 //		case <-l.ctx.Done():
 //			for pp := range l.packetWriter {
@@ -287,20 +421,60 @@ func (l *Listener) loopUdpInOOb() {
 //	}
 //}
 
-func (l *Listener) WritePacket(bs []byte, remote netip.AddrPort) {
+func (w *udpWorker) WritePacket(bs []byte, remote netip.AddrPort) {
+	l := w.l
 	if common.Done(l.ctx) {
 		return
 	}
-	nn, err := l.udpConn.WriteToUDPAddrPort(bs, remote)
+	nn, err := w.conn.WriteToUDPAddrPort(bs, remote)
 	_ = nn
 	if err != nil {
-		l.logger.ErrorContext(l.ctx, "write udp message", err)
+		l.logger.ErrorContext(l.ctx, "write udp message", slog.String("error", err.Error()))
 	}
 }
 
-func (l *Listener) loopTcp() {
-	for l.tcpListener != nil {
-		conn, err := l.tcpListener.Accept()
+func (w *udpWorker) WritePackets(bs [][]byte, remote netip.AddrPort) {
+	l := w.l
+	if common.Done(l.ctx) {
+		return
+	}
+	if w.batchConn == nil {
+		for _, p := range bs {
+			w.WritePacket(p, remote)
+		}
+		return
+	}
+	err := w.batchConn.WriteBatch(bs, nil, remote)
+	if err != nil {
+		l.logger.ErrorContext(l.ctx, "write udp message", slog.String("error", err.Error()))
+	}
+}
+
+func (w *udpWorker) WritePacketsFrom(bs [][]byte, remote netip.AddrPort, info PacketInfo) {
+	l := w.l
+	if common.Done(l.ctx) {
+		return
+	}
+	oob := marshalPacketInfo(info)
+	if w.batchConn != nil {
+		err := w.batchConn.WriteBatch(bs, oob, remote)
+		if err != nil {
+			l.logger.ErrorContext(l.ctx, "write udp message", slog.String("error", err.Error()))
+		}
+		return
+	}
+	for _, p := range bs {
+		_, _, err := w.conn.WriteMsgUDPAddrPort(p, oob, remote)
+		if err != nil {
+			l.logger.ErrorContext(l.ctx, "write udp message", slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (l *Listener) loopTcp(index int, listener net.Listener) {
+	l.pin(index)
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
 			if common.Done(l.ctx) {
 				return
@@ -309,6 +483,9 @@ func (l *Listener) loopTcp() {
 				slog.String("error", err.Error()))
 			continue
 		}
+		if err = l.options.Socket.Apply(conn); err != nil {
+			l.logger.WarnContext(l.ctx, "set socket options failed", slog.String("error", err.Error()))
+		}
 		go l.connHandler.HandleConn(l.ctx, conn)
 	}
 }
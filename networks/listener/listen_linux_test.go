@@ -0,0 +1,122 @@
+package listener
+
+import (
+	"context"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestListenerStartClosesOnFailure(t *testing.T) {
+	// the udp port is taken without SO_REUSEPORT, so the udp workers fail after the tcp ones started
+	taken := listenLoopback(t)
+	port := taken.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+
+	l := NewListener(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), ListenOptions{
+		Network:       constant.ProtocolTCPUDP.ToProtocolList(),
+		Address:       netip.MustParseAddr("127.0.0.1"),
+		Port:          port,
+		Workers:       2,
+		UDPBufferSize: 2048,
+		ConnHandler: FuncConnHandler(func(ctx context.Context, conn net.Conn) {
+			conn.Close()
+		}),
+		PacketHandler: FuncPacketHandler(func(p []byte, remote netip.AddrPort, pw PacketWriter) {}),
+	})
+	if err := l.Start(); err == nil {
+		l.Close()
+		t.Fatal("start succeeded on a taken udp port")
+	}
+	// a listener without SO_REUSEPORT only binds if the tcp workers are closed
+	listener, err := net.Listen("tcp4", netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port).String())
+	if err != nil {
+		t.Fatalf("tcp workers are still open: %v", err)
+	}
+	listener.Close()
+}
+
+func TestListenerRepliesFromWorker(t *testing.T) {
+	free := listenLoopback(t)
+	port := free.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+	free.Close()
+	l := NewListener(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), ListenOptions{
+		Network:       constant.ProtocolUDP.ToProtocolList(),
+		Address:       netip.MustParseAddr("127.0.0.1"),
+		Port:          port,
+		Workers:       2,
+		CPUAffinity:   true,
+		UDPBufferSize: 2048,
+		PacketHandler: FuncPacketHandler(func(p []byte, remote netip.AddrPort, pw PacketWriter) {
+			if _, ok := pw.(*udpWorker); !ok {
+				t.Errorf("packet writer is %T, want the worker that read the packet", pw)
+			}
+			pw.WritePacket(p, remote)
+		}),
+	})
+	if err := l.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client := listenLoopback(t)
+	to := l.udpWorkers[0].conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	if _, err := client.WriteToUDPAddrPort([]byte("ping"), to); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, from, err := client.ReadFromUDPAddrPort(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" || from != to {
+		t.Errorf("reply %q from %s, want %q from %s", buf[:n], from, "ping", to)
+	}
+}
+
+// TestListenerRepliesFromTargetedAddress sends to 127.0.0.2 on a wildcard bind, the reply has to
+// leave from 127.0.0.2 rather than from the address the kernel picks for the client, 127.0.0.1.
+func TestListenerRepliesFromTargetedAddress(t *testing.T) {
+	for _, batch := range []int{0, 8} {
+		free := listenLoopback(t)
+		port := free.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+		free.Close()
+		l := NewListener(context.Background(), slog.New(slog.NewTextHandler(io.Discard, nil)), ListenOptions{
+			Network:       constant.ProtocolUDP.ToProtocolList(),
+			Address:       netip.IPv4Unspecified(),
+			Port:          port,
+			UDPBufferSize: 2048,
+			UDPBatchSize:  batch,
+			PacketHandlerOOb: FuncPacketHandlerOOb(func(oob []byte, p []byte, remote netip.AddrPort, pw PacketWriter) {
+				info := ParsePacketInfo(oob)
+				if !info.IsValid() {
+					t.Errorf("batch %d: no packet info of the datagram", batch)
+				}
+				pw.(PacketInfoWriter).WritePacketsFrom([][]byte{p}, remote, info)
+			}),
+		})
+		if err := l.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		client := listenLoopback(t)
+		to := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), port)
+		if _, err := client.WriteToUDPAddrPort([]byte("ping"), to); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 16)
+		n, from, err := client.ReadFromUDPAddrPort(buf)
+		l.Close()
+		if err != nil {
+			t.Fatalf("batch %d: %v", batch, err)
+		}
+		if string(buf[:n]) != "ping" || from != to {
+			t.Errorf("batch %d: reply %q from %s, want %q from %s", batch, buf[:n], from, "ping", to)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package listener
+
+import (
+	"github.com/sagernet/sing/common/control"
+	"golang.org/x/sys/unix"
+	"net/netip"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// enablePacketInfo asks the kernel to report the local address of every received datagram.
+func enablePacketInfo(conn syscall.Conn) error {
+	return control.Conn(conn, func(fd uintptr) error {
+		domain, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_DOMAIN)
+		if err != nil {
+			return os.NewSyscallError("getsockopt", err)
+		}
+		if domain == unix.AF_INET {
+			return os.NewSyscallError("setsockopt",
+				unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1))
+		}
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_RECVPKTINFO, 1)
+		if err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+		// for ipv4-mapped clients of a dual stack socket, fails on ipv6 only sockets
+		_ = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_PKTINFO, 1)
+		return nil
+	})
+}
+
+// ParsePacketInfo extracts the local address a datagram was received on from oob.
+func ParsePacketInfo(oob []byte) PacketInfo {
+	for len(oob) > 0 {
+		header, data, remainder, err := unix.ParseOneSocketControlMessage(oob)
+		if err != nil {
+			return PacketInfo{}
+		}
+		oob = remainder
+		switch {
+		case header.Level == unix.IPPROTO_IP && header.Type == unix.IP_PKTINFO &&
+			len(data) >= unix.SizeofInet4Pktinfo:
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&data[0]))
+			return PacketInfo{
+				Local:     netip.AddrFrom4(info.Spec_dst),
+				Interface: int(info.Ifindex),
+			}
+		case header.Level == unix.IPPROTO_IPV6 && header.Type == unix.IPV6_PKTINFO &&
+			len(data) >= unix.SizeofInet6Pktinfo:
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&data[0]))
+			return PacketInfo{
+				Local:     netip.AddrFrom16(info.Addr),
+				Interface: int(info.Ifindex),
+			}
+		}
+	}
+	return PacketInfo{}
+}
+
+// marshalPacketInfo builds the control message to send a datagram from info.Local.
+func marshalPacketInfo(info PacketInfo) []byte {
+	if !info.IsValid() {
+		return nil
+	}
+	local := info.Local.Unmap()
+	if local.Is4() {
+		oob := make([]byte, unix.CmsgSpace(unix.SizeofInet4Pktinfo))
+		header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+		header.Level = unix.IPPROTO_IP
+		header.Type = unix.IP_PKTINFO
+		header.SetLen(unix.CmsgLen(unix.SizeofInet4Pktinfo))
+		pktinfo := (*unix.Inet4Pktinfo)(unsafe.Pointer(&oob[unix.CmsgLen(0)]))
+		pktinfo.Spec_dst = local.As4()
+		return oob
+	}
+	oob := make([]byte, unix.CmsgSpace(unix.SizeofInet6Pktinfo))
+	header := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	header.Level = unix.IPPROTO_IPV6
+	header.Type = unix.IPV6_PKTINFO
+	header.SetLen(unix.CmsgLen(unix.SizeofInet6Pktinfo))
+	pktinfo := (*unix.Inet6Pktinfo)(unsafe.Pointer(&oob[unix.CmsgLen(0)]))
+	pktinfo.Addr = local.As16()
+	if local.IsLinkLocalUnicast() {
+		// link local source addresses are only valid on the receiving interface
+		pktinfo.Ifindex = uint32(info.Interface)
+	}
+	return oob
+}
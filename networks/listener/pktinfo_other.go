@@ -0,0 +1,20 @@
+//go:build !linux
+
+package listener
+
+import (
+	"errors"
+	"syscall"
+)
+
+func enablePacketInfo(conn syscall.Conn) error {
+	return errors.ErrUnsupported
+}
+
+func ParsePacketInfo(oob []byte) PacketInfo {
+	return PacketInfo{}
+}
+
+func marshalPacketInfo(info PacketInfo) []byte {
+	return nil
+}
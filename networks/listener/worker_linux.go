@@ -0,0 +1,34 @@
+package listener
+
+import (
+	"github.com/sagernet/sing/common/control"
+	"golang.org/x/sys/unix"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+func reusePort() control.Func {
+	return func(network, address string, conn syscall.RawConn) error {
+		return control.Raw(conn, func(fd uintptr) error {
+			return os.NewSyscallError("setsockopt",
+				unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1))
+		})
+	}
+}
+
+// setIncomingCPU hints the kernel to steer the packets of conn to the given cpu.
+func setIncomingCPU(conn syscall.Conn, cpu int) error {
+	return control.Conn(conn, func(fd uintptr) error {
+		return os.NewSyscallError("setsockopt",
+			unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_INCOMING_CPU, cpu))
+	})
+}
+
+// pinToCPU locks the calling goroutine to its os thread and binds the thread to cpu.
+func pinToCPU(cpu int) error {
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Set(cpu)
+	return os.NewSyscallError("sched_setaffinity", unix.SchedSetaffinity(0, &set))
+}
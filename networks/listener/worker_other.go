@@ -0,0 +1,20 @@
+//go:build !linux
+
+package listener
+
+import (
+	"github.com/sagernet/sing/common/control"
+	"syscall"
+)
+
+func reusePort() control.Func {
+	return nil
+}
+
+func setIncomingCPU(conn syscall.Conn, cpu int) error {
+	return nil
+}
+
+func pinToCPU(cpu int) error {
+	return nil
+}
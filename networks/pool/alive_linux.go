@@ -0,0 +1,34 @@
+package pool
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"net"
+	"syscall"
+)
+
+// alive peeks the socket without blocking, a connection is dead if the remote
+// closed or reset it. Data sent by the remote stays in the socket.
+func alive(conn net.Conn) bool {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return true
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var result = true
+	err = raw.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		n, _, err := unix.Recvfrom(int(fd), buf[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		switch {
+		case errors.Is(err, unix.EAGAIN), errors.Is(err, unix.EINTR):
+		case err != nil, n == 0:
+			result = false
+		}
+		// do not wait for readability
+		return true
+	})
+	return err == nil && result
+}
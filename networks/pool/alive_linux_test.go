@@ -0,0 +1,54 @@
+package pool
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAlive(t *testing.T) {
+	s := newServer(t)
+	conn, err := s.dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := s.accept(t)
+	if !alive(conn) {
+		t.Fatal("an idle connection is dead")
+	}
+
+	// data of the peer is peeked and stays in the socket
+	if _, err = peer.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the data", func() bool { return alive(conn) })
+	buf := make([]byte, 1)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(buf); n != 1 || err != nil || buf[0] != 'x' {
+		t.Fatalf("read %q, %v, want the data of the peer", buf[:n], err)
+	}
+
+	peer.Close()
+	waitFor(t, "the FIN of the peer", func() bool { return !alive(conn) })
+}
+
+// TestPoolEvictsClosed checks that Get skips a connection the peer closed.
+func TestPoolEvictsClosed(t *testing.T) {
+	s := newServer(t)
+	p := New(context.Background(), s.dial, Options{Size: 1})
+	defer p.Close()
+	p.Start()
+	waitFor(t, "the pool to fill", func() bool { return p.idleCount() == 1 })
+	s.accept(t).Close()
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if stats := p.Stats(); stats.Evicted != 1 || stats.Misses != 1 || stats.Hits != 0 {
+		t.Errorf("stats %+v, want the closed connection evicted and a miss", stats)
+	}
+}
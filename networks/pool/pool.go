@@ -0,0 +1,207 @@
+package pool
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type DialFunc func(ctx context.Context) (net.Conn, error)
+
+type Options struct {
+	// Size is the number of idle connections kept ready
+	Size int
+	// IdleTimeout is how long a connection may stay idle in the pool,
+	// older connections are replaced before the remote closes them.
+	IdleTimeout time.Duration
+}
+
+// Stats are the counters of a pool.
+type Stats struct {
+	// Hits is the number of connections taken from the pool
+	Hits uint64
+	// Misses is the number of connections dialed because the pool was empty
+	Misses uint64
+	// Evicted is the number of idle connections closed because they were stale or dead
+	Evicted uint64
+}
+
+type idleConn struct {
+	net.Conn
+	since time.Time
+}
+
+// Pool keeps pre-established connections to a remote.
+type Pool struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	dial    DialFunc
+	options Options
+
+	access sync.Mutex
+	idle   []idleConn
+	refill chan struct{}
+
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+	evicted atomic.Uint64
+}
+
+func New(ctx context.Context, dial DialFunc, options Options) *Pool {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Pool{
+		ctx:     ctx,
+		cancel:  cancel,
+		dial:    dial,
+		options: options,
+		refill:  make(chan struct{}, 1),
+	}
+}
+
+// Start fills the pool in background until Close.
+func (p *Pool) Start() {
+	go p.loop()
+}
+
+// Get returns a ready connection from the pool, or dials a new one if none is left.
+func (p *Pool) Get(ctx context.Context) (net.Conn, error) {
+	defer p.wake()
+	for {
+		conn, ok := p.pop()
+		if !ok {
+			break
+		}
+		if p.usable(conn) {
+			p.hits.Add(1)
+			return conn.Conn, nil
+		}
+		p.evicted.Add(1)
+		conn.Close()
+	}
+	p.misses.Add(1)
+	return p.dial(ctx)
+}
+
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Hits:    p.hits.Load(),
+		Misses:  p.misses.Load(),
+		Evicted: p.evicted.Load(),
+	}
+}
+
+// Close stops filling the pool and closes the idle connections.
+func (p *Pool) Close() error {
+	p.cancel()
+	p.access.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.access.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+	}
+	return nil
+}
+
+func (p *Pool) wake() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// pop takes the most recently added connection, it is the least likely to be closed by the remote.
+func (p *Pool) pop() (idleConn, bool) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if len(p.idle) == 0 {
+		return idleConn{}, false
+	}
+	conn := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return conn, true
+}
+
+func (p *Pool) push(conn net.Conn) bool {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.ctx.Err() != nil || len(p.idle) >= p.options.Size {
+		return false
+	}
+	p.idle = append(p.idle, idleConn{Conn: conn, since: time.Now()})
+	return true
+}
+
+func (p *Pool) usable(conn idleConn) bool {
+	if p.options.IdleTimeout > 0 && time.Since(conn.since) >= p.options.IdleTimeout {
+		return false
+	}
+	return alive(conn.Conn)
+}
+
+func (p *Pool) loop() {
+	interval := time.Minute
+	if p.options.IdleTimeout > 0 {
+		interval = p.options.IdleTimeout / 4
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.evict()
+		p.fill()
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.refill:
+		case <-ticker.C:
+		}
+	}
+}
+
+// evict closes the connections that are stale, or will be stale before the next check.
+func (p *Pool) evict() {
+	var margin time.Duration
+	if p.options.IdleTimeout > 0 {
+		margin = p.options.IdleTimeout / 4
+	}
+	p.access.Lock()
+	kept := p.idle[:0]
+	var stale []idleConn
+	for _, conn := range p.idle {
+		if p.options.IdleTimeout > 0 && time.Since(conn.since)+margin >= p.options.IdleTimeout || !alive(conn.Conn) {
+			stale = append(stale, conn)
+			continue
+		}
+		kept = append(kept, conn)
+	}
+	clear(p.idle[len(kept):])
+	p.idle = kept
+	p.access.Unlock()
+
+	for _, conn := range stale {
+		p.evicted.Add(1)
+		conn.Close()
+	}
+}
+
+// fill dials until the pool is full, it gives up until the next check on a dial error.
+func (p *Pool) fill() {
+	for {
+		p.access.Lock()
+		missing := p.options.Size - len(p.idle)
+		p.access.Unlock()
+		if missing <= 0 {
+			return
+		}
+		conn, err := p.dial(p.ctx)
+		if err != nil {
+			return
+		}
+		if !p.push(conn) {
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package pool
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// server accepts loopback connections and hands them to the test.
+type server struct {
+	listener net.Listener
+	accepted chan net.Conn
+	dials    atomic.Int32
+}
+
+func newServer(t *testing.T) *server {
+	t.Helper()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{listener: listener, accepted: make(chan net.Conn, 64)}
+	stopped := make(chan struct{})
+	t.Cleanup(func() {
+		listener.Close()
+		<-stopped
+		close(s.accepted)
+		for conn := range s.accepted {
+			conn.Close()
+		}
+	})
+	go func() {
+		defer close(stopped)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.accepted <- conn
+		}
+	}()
+	return s
+}
+
+func (s *server) dial(ctx context.Context) (net.Conn, error) {
+	s.dials.Add(1)
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp4", s.listener.Addr().String())
+}
+
+func (s *server) accept(t *testing.T) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-s.accepted:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection accepted")
+		return nil
+	}
+}
+
+func (p *Pool) idleCount() int {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return len(p.idle)
+}
+
+// waitFor polls cond until it holds or a few seconds passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolRefill(t *testing.T) {
+	s := newServer(t)
+	p := New(context.Background(), s.dial, Options{Size: 3})
+	defer p.Close()
+	p.Start()
+	waitFor(t, "the pool to fill", func() bool { return p.idleCount() == 3 })
+
+	for range 2 {
+		conn, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	// every Get makes the pool dial the connection it took again
+	waitFor(t, "the pool to refill", func() bool { return p.idleCount() == 3 && s.dials.Load() == 5 })
+	if stats := p.Stats(); stats != (Stats{Hits: 2}) {
+		t.Errorf("stats %+v, want 2 hits", stats)
+	}
+}
+
+func TestPoolMiss(t *testing.T) {
+	s := newServer(t)
+	p := New(context.Background(), s.dial, Options{Size: 1})
+	defer p.Close()
+	// not started, so the pool is empty
+	conn, err := p.Get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if stats := p.Stats(); stats != (Stats{Misses: 1}) {
+		t.Errorf("stats %+v, want 1 miss", stats)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	s := newServer(t)
+	p := New(context.Background(), s.dial, Options{Size: 2, IdleTimeout: idle})
+	defer p.Close()
+	p.Start()
+	waitFor(t, "the pool to fill", func() bool { return p.idleCount() == 2 })
+	first := []net.Conn{s.accept(t), s.accept(t)}
+
+	// the connections are replaced before they are idle for the timeout
+	waitFor(t, "the stale connections to be evicted", func() bool { return p.Stats().Evicted >= 2 })
+	for _, conn := range first {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Errorf("evicted connection is not closed: %v", err)
+		}
+	}
+	waitFor(t, "the pool to refill", func() bool { return p.idleCount() == 2 })
+	if stats := p.Stats(); stats.Hits != 0 || stats.Misses != 0 {
+		t.Errorf("stats %+v, want evictions only", stats)
+	}
+}
+
+func TestPoolClose(t *testing.T) {
+	s := newServer(t)
+	p := New(context.Background(), s.dial, Options{Size: 2})
+	p.Start()
+	waitFor(t, "the pool to fill", func() bool { return p.idleCount() == 2 })
+	accepted := []net.Conn{s.accept(t), s.accept(t)}
+	p.Close()
+
+	for _, conn := range accepted {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadAll(conn); err != nil {
+			t.Errorf("idle connection is not closed: %v", err)
+		}
+	}
+	if n := p.idleCount(); n != 0 {
+		t.Errorf("%d idle connections after close", n)
+	}
+	// a closed pool no longer fills
+	p.wake()
+	time.Sleep(50 * time.Millisecond)
+	if dials := s.dials.Load(); dials != 2 {
+		t.Errorf("%d dials, want the 2 of the fill before close", dials)
+	}
+}
@@ -0,0 +1,241 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const bufferSize = 32 * 1024
+
+var (
+	ErrIdleTimeout = errors.New("relay: idle timeout")
+	ErrMaxLifetime = errors.New("relay: max lifetime reached")
+)
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+type Options struct {
+	// IdleTimeout closes the relay when neither direction has moved bytes for the interval.
+	IdleTimeout time.Duration
+	// MaxLifetime closes the relay once it has been running for the duration.
+	MaxLifetime time.Duration
+	// LifetimeGrace is the time given to both sides to finish after MaxLifetime.
+	// Both sides receive a FIN when MaxLifetime is reached and are closed after the grace period.
+	LifetimeGrace time.Duration
+}
+
+// Result is the outcome of a relay.
+type Result struct {
+	// Upload is the number of bytes copied from a to b
+	Upload int64
+	// Download is the number of bytes copied from b to a
+	Download int64
+}
+
+type relayer struct {
+	a, b    net.Conn
+	options Options
+
+	once     sync.Once
+	firstErr error
+	expired  atomic.Bool
+	// lastActivity is the unix nano time bytes were last moved in any direction
+	lastActivity atomic.Int64
+}
+
+// Relay copies data between a and b in both directions until both directions are done
+// or ctx is canceled.
+// When one side finishes sending, the FIN is propagated to the other side with CloseWrite
+// and the opposite direction keeps running. Any other error tears down both sides.
+// The caller still owns a and b and must close them.
+func Relay(ctx context.Context, a, b net.Conn, options Options) (Result, error) {
+	var (
+		result Result
+		wg     sync.WaitGroup
+		r      = &relayer{a: a, b: b, options: options}
+	)
+	r.touch()
+	stop := context.AfterFunc(ctx, func() {
+		r.abort(ctx.Err())
+	})
+	defer stop()
+
+	if options.MaxLifetime > 0 {
+		var grace atomic.Pointer[time.Timer]
+		lifetime := time.AfterFunc(options.MaxLifetime, func() {
+			r.expired.Store(true)
+			if options.LifetimeGrace <= 0 {
+				r.abort(ErrMaxLifetime)
+				return
+			}
+			grace.Store(time.AfterFunc(options.LifetimeGrace, func() {
+				r.abort(ErrMaxLifetime)
+			}))
+			r.closeWrite(a)
+			r.closeWrite(b)
+		})
+		defer func() {
+			lifetime.Stop()
+			if timer := grace.Load(); timer != nil {
+				timer.Stop()
+			}
+		}()
+	}
+
+	if options.IdleTimeout > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go r.watchIdle(done)
+	}
+
+	wg.Add(2)
+	go r.half(b, a, &result.Upload, &wg)
+	go r.half(a, b, &result.Download, &wg)
+	wg.Wait()
+
+	if errors.Is(r.firstErr, net.ErrClosed) {
+		r.firstErr = nil
+	}
+	if r.firstErr == nil && r.expired.Load() {
+		// both sides finished in the grace period
+		r.firstErr = ErrMaxLifetime
+	}
+	return result, r.firstErr
+}
+
+func (r *relayer) touch() {
+	r.lastActivity.Store(time.Now().UnixNano())
+}
+
+// watchIdle aborts the relay once no bytes were moved for the idle timeout.
+func (r *relayer) watchIdle(done <-chan struct{}) {
+	idle := r.options.IdleTimeout
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+			elapsed := time.Since(time.Unix(0, r.lastActivity.Load()))
+			if elapsed >= idle {
+				r.abort(ErrIdleTimeout)
+				return
+			}
+			timer.Reset(idle - elapsed)
+		}
+	}
+}
+
+func (r *relayer) abort(err error) {
+	if err != nil && r.expired.Load() {
+		// errors after the lifetime are caused by closing
+		err = ErrMaxLifetime
+	}
+	r.once.Do(func() {
+		r.firstErr = err
+		r.a.Close()
+		r.b.Close()
+	})
+}
+
+func (r *relayer) closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		if err := cw.CloseWrite(); err != nil {
+			r.abort(err)
+		}
+	} else if r.expired.Load() {
+		// a conn that can not half-close ends the relay at the lifetime
+		r.abort(ErrMaxLifetime)
+	} else {
+		r.abort(nil)
+	}
+}
+
+func (r *relayer) half(dst, src net.Conn, total *int64, wg *sync.WaitGroup) {
+	defer wg.Done()
+	idle := r.options.IdleTimeout
+	for {
+		if idle > 0 {
+			// splice records no activity until it returns, the deadline makes it return
+			// a few times per idle timeout. The idle timeout itself is up to watchIdle.
+			_ = src.SetReadDeadline(time.Now().Add(idle / 4))
+		}
+		n, err := copyConn(dst, src, r.touch)
+		*total += n
+		if n > 0 {
+			r.touch()
+		}
+		if err == nil {
+			// src sent FIN, pass it on and leave the other direction alone
+			r.closeWrite(dst)
+			return
+		}
+		if idle > 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			continue
+		}
+		r.abort(err)
+		return
+	}
+}
+
+// Copy copies from src to dst until EOF.
+// If both are tcp sockets the kernel moves the data with splice(2) through a pipe on Linux,
+// otherwise a pooled buffer is used.
+func Copy(dst, src net.Conn) (int64, error) {
+	return copyConn(dst, src, nil)
+}
+
+// copyConn is Copy, on the buffer path it calls touch after every read that returned bytes.
+func copyConn(dst, src net.Conn, touch func()) (int64, error) {
+	if tcpDst, ok := dst.(*net.TCPConn); ok {
+		if _, ok = src.(*net.TCPConn); ok {
+			// (*net.TCPConn).ReadFrom uses splice when src is a *net.TCPConn
+			return tcpDst.ReadFrom(src)
+		}
+	}
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	// hide ReaderFrom/WriterTo, they would allocate their own buffer
+	var reader io.Reader = readerOnly{src}
+	if touch != nil {
+		reader = activityReader{Reader: src, touch: touch}
+	}
+	return io.CopyBuffer(writerOnly{dst}, reader, *buf)
+}
+
+type activityReader struct {
+	io.Reader
+	touch func()
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+	return n, err
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+type readerOnly struct {
+	io.Reader
+}
@@ -0,0 +1,251 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/sagernet/sing/common/bufio"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback tcp connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// bufferedConn hides the *net.TCPConn type from Copy, so that it takes the buffer path.
+type bufferedConn struct {
+	*net.TCPConn
+}
+
+type relayFunc func(ctx context.Context, a, b net.Conn) error
+
+var relays = []struct {
+	name  string
+	wrap  bool
+	relay relayFunc
+}{
+	{"splice", false, relayConn},
+	{"buffer", true, relayConn},
+	{"sing-bufio", false, func(ctx context.Context, a, b net.Conn) error {
+		return bufio.CopyConn(ctx, a, b)
+	}},
+}
+
+func relayConn(ctx context.Context, a, b net.Conn) error {
+	_, err := Relay(ctx, a, b, Options{})
+	return err
+}
+
+// startRelay relays between the two returned conns, client and server.
+func startRelay(t testing.TB, wrap bool, relay relayFunc) (client, server *net.TCPConn, done <-chan error) {
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	var relayA, relayB net.Conn = a, b
+	if wrap {
+		relayA, relayB = bufferedConn{a}, bufferedConn{b}
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- relay(context.Background(), relayA, relayB)
+	}()
+	return client, server, result
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	for _, mode := range relays[:2] {
+		t.Run(mode.name, func(t *testing.T) {
+			client, server, done := startRelay(t, mode.wrap, mode.relay)
+			if _, err := client.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			// the server sees the FIN of the client and still answers
+			if err := client.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			request, err := io.ReadAll(server)
+			if err != nil || string(request) != "request" {
+				t.Fatalf("server read %q, %v", request, err)
+			}
+			if _, err = server.Write([]byte("response")); err != nil {
+				t.Fatal(err)
+			}
+			_ = server.CloseWrite()
+			_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			response, err := io.ReadAll(client)
+			if err != nil || string(response) != "response" {
+				t.Fatalf("client read %q, %v", response, err)
+			}
+			select {
+			case err = <-done:
+				if err != nil {
+					t.Fatalf("relay: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("relay did not finish after both sides closed")
+			}
+		})
+	}
+}
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	_ = syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// BenchmarkRelay compares the splice and buffer paths of Relay with bufio.CopyConn
+// of sing over loopback, an op moves 64KiB from the client to the server.
+// cpu-ns/op is the cpu time of the whole process, the client and the server included.
+func BenchmarkRelay(b *testing.B) {
+	chunk := bytes.Repeat([]byte{'x'}, 64*1024)
+	for _, mode := range relays {
+		b.Run(mode.name, func(b *testing.B) {
+			client, server, done := startRelay(b, mode.wrap, mode.relay)
+			received := make(chan int64, 1)
+			go func() {
+				n, _ := io.Copy(io.Discard, server)
+				server.CloseWrite()
+				received <- n
+			}()
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			start := cpuTime()
+			for range b.N {
+				if _, err := client.Write(chunk); err != nil {
+					b.Fatal(err)
+				}
+			}
+			_ = client.CloseWrite()
+			n := <-received
+			<-done
+			b.StopTimer()
+			b.ReportMetric(float64(cpuTime()-start)/float64(b.N), "cpu-ns/op")
+			if n != int64(b.N*len(chunk)) {
+				b.Fatalf("server received %d bytes, want %d", n, b.N*len(chunk))
+			}
+		})
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	const idle = 200 * time.Millisecond
+	for _, mode := range relays[:2] {
+		t.Run(mode.name, func(t *testing.T) {
+			client, server, done := startRelay(t, mode.wrap, func(ctx context.Context, a, b net.Conn) error {
+				_, err := Relay(ctx, a, b, Options{IdleTimeout: idle})
+				return err
+			})
+			go io.Copy(io.Discard, server)
+			// a slow transfer in one direction keeps the relay alive well past the idle timeout
+			for deadline := time.Now().Add(5 * idle); time.Now().Before(deadline); {
+				if _, err := client.Write([]byte{'x'}); err != nil {
+					t.Fatalf("relay closed during a transfer: %v", err)
+				}
+				select {
+				case err := <-done:
+					t.Fatalf("relay closed during a transfer: %v", err)
+				case <-time.After(idle / 5):
+				}
+			}
+			start := time.Now()
+			select {
+			case err := <-done:
+				if !errors.Is(err, ErrIdleTimeout) {
+					t.Fatalf("relay: %v, want %v", err, ErrIdleTimeout)
+				}
+				if elapsed := time.Since(start); elapsed > 2*idle {
+					t.Errorf("relay closed %s after the transfer, idle timeout is %s", elapsed, idle)
+				}
+			case <-time.After(10 * idle):
+				t.Fatal("relay is not closed by the idle timeout")
+			}
+		})
+	}
+}
+
+// plainConn hides CloseWrite, so that the relay can not half-close.
+type plainConn struct {
+	net.Conn
+}
+
+func TestRelayMaxLifetime(t *testing.T) {
+	const lifetime = 200 * time.Millisecond
+	tests := []struct {
+		name  string
+		grace time.Duration
+		plain bool
+		// finish closes both sides once they read the FIN of the relay
+		finish bool
+		// want is the earliest time the relay ends
+		want time.Duration
+	}{
+		{"no grace", 0, false, false, lifetime},
+		{"grace", lifetime, false, false, 2 * lifetime},
+		{"finish in grace", 10 * lifetime, false, true, lifetime},
+		{"grace without half-close", lifetime, true, false, lifetime},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server, done := startRelay(t, false, func(ctx context.Context, a, b net.Conn) error {
+				if tt.plain {
+					a, b = plainConn{a}, plainConn{b}
+				}
+				_, err := Relay(ctx, a, b, Options{MaxLifetime: lifetime, LifetimeGrace: tt.grace})
+				return err
+			})
+			start := time.Now()
+			for _, conn := range []*net.TCPConn{client, server} {
+				_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				_, err := io.ReadAll(conn)
+				if elapsed := time.Since(start); elapsed < lifetime {
+					t.Errorf("closed after %s, before the lifetime", elapsed)
+				}
+				if tt.grace > 0 && !tt.plain && err != nil {
+					t.Errorf("read: %v, want a FIN", err)
+				}
+				if tt.finish {
+					_ = conn.CloseWrite()
+				}
+			}
+			select {
+			case err := <-done:
+				if !errors.Is(err, ErrMaxLifetime) {
+					t.Errorf("relay: %v, want %v", err, ErrMaxLifetime)
+				}
+				elapsed := time.Since(start)
+				if elapsed < tt.want {
+					t.Errorf("relay ended after %s, want %s", elapsed, tt.want)
+				}
+				if tt.finish && elapsed >= tt.grace {
+					t.Errorf("relay ended after %s, not when both sides finished", elapsed)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("relay is not closed by the max lifetime")
+			}
+		})
+	}
+}
@@ -7,90 +7,175 @@ import (
 	"github.com/miekg/dns"
 	"github.com/sagernet/sing/common/cache"
 	"github.com/sagernet/sing/common/task"
+	"github.com/woshikedayaa/traffics/networks/constant"
 	"net/netip"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
-type cacheResult struct {
-	A    []netip.Addr
-	AAAA []netip.Addr
+type CacheOptions struct {
+	// Size is the max number of cached answers, 0 for constant.ResolverCacheSize
+	Size int
+	// MinTTL and MaxTTL bound the ttl of cached answers, MaxTTL is one day if 0
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// StaleTTL is how long an expired answer is kept to be served
+	// when the upstream fails (RFC 8767), 0 to disable
+	StaleTTL time.Duration
+	// Prefetch refreshes answers in background before they expire, if they are hit often
+	Prefetch bool
+}
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+// cacheEntry is an answer of a question, it is negative if it has no address (RFC 2308):
+// rcode is NXDOMAIN for a name that does not exist, success for a name without records of the type.
+type cacheEntry struct {
+	addresses []netip.Addr
+	rcode     int
+	ttl       time.Duration
+	expire    time.Time
+
+	hits        atomic.Uint32
+	prefetching atomic.Bool
+}
+
+func (e *cacheEntry) result(now time.Time) ([]netip.Addr, time.Duration, error) {
+	ttl := e.expire.Sub(now)
+	if e.rcode != dns.RcodeSuccess {
+		return nil, ttl, RcodeError(e.rcode)
+	}
+	return e.addresses, ttl, nil
 }
 
 type CachedResolver struct {
-	client Exchanger
-	cache  *cache.LruCache[string, cacheResult]
+	client  Exchanger
+	options CacheOptions
+	cache   *cache.LruCache[cacheKey, *cacheEntry]
 }
 
-func NewCachedResolver(client Exchanger, size int) *CachedResolver {
+func NewCachedResolver(client Exchanger, options CacheOptions) *CachedResolver {
+	if options.Size <= 0 {
+		options.Size = constant.ResolverCacheSize
+	}
+	if options.MaxTTL <= 0 {
+		options.MaxTTL = constant.ResolverCacheMaxTTL
+	}
+	options.MinTTL = min(options.MinTTL, options.MaxTTL)
 	return &CachedResolver{
-		client: client,
-		cache: cache.New[string, cacheResult](
-			cache.WithSize[string, cacheResult](size),
-			cache.WithAge[string, cacheResult](86400), // one day
+		client:  client,
+		options: options,
+		cache: cache.New[cacheKey, *cacheEntry](
+			cache.WithSize[cacheKey, *cacheEntry](options.Size),
+			// entries expire at the time they are stored with
+			cache.WithAge[cacheKey, *cacheEntry](max(int64(options.MaxTTL/time.Second), 1)),
 		),
 	}
 }
+
 func NewCachedResolverDefault(client Exchanger) *CachedResolver {
-	return NewCachedResolver(client, 1024)
+	return NewCachedResolver(client, CacheOptions{})
 }
 
 func (c *CachedResolver) Lookup(ctx context.Context, fqdn string, strategy Strategy) (A []netip.Addr, AAAA []netip.Addr, err error) {
-	if fqdn == "" {
-		return nil, nil, errors.New("resolve: empty resolve fqdn")
-	}
-	fqdn = dns.Fqdn(fqdn)
-
-	a, aaaa := c.load(fqdn)
-	A, AAAA = FilterAddress(a, aaaa, strategy)
+	A, AAAA, _, err = c.LookupTTL(ctx, fqdn, strategy)
+	return A, AAAA, err
+}
 
-	if len(A) != 0 || len(AAAA) != 0 {
-		return A, AAAA, nil
+// LookupTTL reports the shortest remaining ttl of the answers.
+func (c *CachedResolver) LookupTTL(ctx context.Context, fqdn string, strategy Strategy) (A []netip.Addr, AAAA []netip.Addr, ttl time.Duration, err error) {
+	if fqdn == "" {
+		return nil, nil, 0, errors.New("resolve: empty resolve fqdn")
 	}
+	fqdn = strings.ToLower(dns.Fqdn(fqdn))
 
-	// get from upstream
-	group := task.Group{}
-
+	var (
+		group          = task.Group{}
+		ttl4, ttl6     time.Duration
+		errIPv4, errV6 error
+	)
+	// a failed family does not fail the other
 	if strategy != StrategyIPv6Only {
 		group.Append0(func(ctx context.Context) error {
-			resp, internal := c.lookupToExchange(ctx, fqdn, dns.TypeA)
-			if internal != nil || resp == nil {
-				return internal
-			}
-			A = append(A, randomSortAddresses(resp)...)
+			A, ttl4, errIPv4 = c.query(ctx, cacheKey{name: fqdn, qtype: dns.TypeA})
 			return nil
 		})
 	}
 	if strategy != StrategyIPv4Only {
 		group.Append0(func(ctx context.Context) error {
-			resp, internal := c.lookupToExchange(ctx, fqdn, dns.TypeAAAA)
-			if internal != nil || resp == nil {
-				return internal
-			}
-			AAAA = append(AAAA, randomSortAddresses(resp)...)
+			AAAA, ttl6, errV6 = c.query(ctx, cacheKey{name: fqdn, qtype: dns.TypeAAAA})
 			return nil
 		})
 	}
-
-	err = group.Run(ctx)
-	if err != nil {
-		return nil, nil, fmt.Errorf("resolve: %w", err)
-	}
+	_ = group.Run(ctx)
 
 	A, AAAA = FilterAddress(A, AAAA, strategy)
 	if len(A) == 0 && len(AAAA) == 0 {
-		return nil, nil, errors.New(fmt.Sprintf("resolve: no available address found for %s", fqdn))
+		// the errors tell they come from resolving already
+		if err = errors.Join(errIPv4, errV6); err != nil {
+			return nil, nil, 0, err
+		}
+		return nil, nil, 0, fmt.Errorf("resolve: no available address found for %s", fqdn)
+	}
+	switch {
+	case len(A) == 0:
+		ttl = ttl6
+	case len(AAAA) == 0:
+		ttl = ttl4
+	default:
+		ttl = min(ttl4, ttl6)
 	}
-	return A, AAAA, nil
+	return A, AAAA, max(ttl, 0), nil
 }
 
-func (c *CachedResolver) lookupToExchange(ctx context.Context, fqdn string, queryType uint16) ([]netip.Addr, error) {
+// query answers from the cache, or asks the upstream on a miss. An expired answer is
+// served if the upstream fails, a popular answer is refreshed before it expires.
+func (c *CachedResolver) query(ctx context.Context, key cacheKey) ([]netip.Addr, time.Duration, error) {
+	entry, ok := c.cache.Load(key)
+	if !ok {
+		return c.exchange(ctx, key)
+	}
+	now := time.Now()
+	if now.Before(entry.expire) {
+		hits := entry.hits.Add(1)
+		if c.options.Prefetch && hits >= constant.ResolverPrefetchHits &&
+			entry.expire.Sub(now) < entry.ttl/10 && entry.prefetching.CompareAndSwap(false, true) {
+			go c.prefetch(key, entry)
+		}
+		return entry.result(now)
+	}
+	addresses, ttl, err := c.exchange(ctx, key)
+	var rcodeErr RcodeError
+	if err != nil && now.Before(entry.expire.Add(c.options.StaleTTL)) &&
+		!(errors.As(err, &rcodeErr) && int(rcodeErr) == dns.RcodeNameError) {
+		// the upstream failed, serve stale (RFC 8767 section 4)
+		addresses, _, staleErr := entry.result(now)
+		return addresses, constant.ResolverStaleAnswerTTL, staleErr
+	}
+	return addresses, ttl, err
+}
+
+func (c *CachedResolver) prefetch(key cacheKey, entry *cacheEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), constant.ResolverDefaultReadTimeout)
+	defer cancel()
+	if _, _, err := c.exchange(ctx, key); err != nil {
+		// let a later hit try again
+		entry.prefetching.Store(false)
+	}
+}
+
+func (c *CachedResolver) exchange(ctx context.Context, key cacheKey) ([]netip.Addr, time.Duration, error) {
 	question := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Id:               dns.Id(),
 			RecursionDesired: true,
 		},
 		Question: []dns.Question{
-			{Name: fqdn, Qtype: queryType, Qclass: dns.ClassINET},
+			{Name: key.name, Qtype: key.qtype, Qclass: dns.ClassINET},
 		},
 	}
 
@@ -99,84 +184,78 @@ func (c *CachedResolver) lookupToExchange(ctx context.Context, fqdn string, quer
 		question,
 	)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	if resp == nil {
 		panic("client return a nil dns message without error")
 	}
-	if resp.Rcode != dns.RcodeSuccess {
-		return nil, RcodeError(resp.Rcode)
-	}
 	if resp.Id != question.Id {
-		return nil, errors.New("incorrect id")
+		return nil, 0, errors.New("incorrect id")
 	}
 	if resp.Truncated {
-		return nil, errors.New("truncated")
-	}
-
-	err = c.store(resp)
-	if err != nil {
-		return nil, err
+		return nil, 0, errors.New("truncated")
 	}
-	return MessageToAddresses(resp)
-}
-
-func (c *CachedResolver) store(msg *dns.Msg) error {
-	if msg == nil || len(msg.Question) != 1 || len(msg.Answer) == 0 {
-		return errors.New("resolve: store a bad message")
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		// server failures are not cached
+		return nil, 0, RcodeError(resp.Rcode)
 	}
 
-	minTTL := uint32(0)
-	result := cacheResult{}
-	// for _, R := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} { // ignore NS and Extra
-	for _, rr := range msg.Answer {
-		overrideTTL := minTTL == 0 || rr.Header().Ttl > 0 && rr.Header().Ttl < minTTL
-		switch record := rr.(type) {
-		case *dns.A:
-			if overrideTTL {
-				minTTL = record.Header().Ttl
-			}
-			record.Header().Ttl = minTTL
-			a, _ := netip.AddrFromSlice(record.A)
-			result.A = append(result.A, a)
-		case *dns.AAAA:
-			if overrideTTL {
-				minTTL = record.Header().Ttl
-			}
-			record.Header().Ttl = minTTL
-			a, _ := netip.AddrFromSlice(record.AAAA)
-			result.AAAA = append(result.AAAA, a)
-		default:
-			// discard
+	entry := &cacheEntry{rcode: resp.Rcode}
+	if resp.Rcode == dns.RcodeSuccess {
+		addresses, err := MessageToAddresses(resp)
+		if err != nil {
+			return nil, 0, err
 		}
+		// in the order of the answer, the dialer orders them
+		entry.addresses = addresses
 	}
-	if minTTL == 0 {
-		return nil
+	if len(entry.addresses) > 0 {
+		entry.ttl = answerTTL(resp, key.qtype)
+	} else {
+		entry.ttl = negativeTTL(resp)
 	}
-	now := time.Now()
-	expire := now.Add(time.Duration(minTTL) * time.Second)
-	if now.After(expire) {
-		return nil
+	if entry.ttl >= 0 {
+		entry.ttl = min(max(entry.ttl, c.options.MinTTL), c.options.MaxTTL)
 	}
-	c.cache.StoreWithExpire(msg.Question[0].Name, result, expire)
+	if entry.ttl > 0 {
+		entry.expire = time.Now().Add(entry.ttl)
+		storeEntry(c.cache, key, entry, entry.expire.Add(c.options.StaleTTL))
+	}
+	addresses, _, err := entry.result(time.Now())
+	return addresses, max(entry.ttl, 0), err
+}
 
-	return nil
+// storeEntry stores value at key. The cache overwrites a stored value in place while Load
+// reads it without the lock, so a value that is replaced, by a prefetch for one, is deleted first.
+func storeEntry[K comparable, V any](c *cache.LruCache[K, V], key K, value V, expire time.Time) {
+	c.Delete(key)
+	c.StoreWithExpire(key, value, expire)
 }
 
-func (c *CachedResolver) load(question string) (A []netip.Addr, AAAA []netip.Addr) {
-	response, expire, ok := c.cache.LoadWithExpire(question)
-	if !ok {
-		return nil, nil
-	}
-	now := time.Now()
-	if now.After(expire) {
-		c.cache.Delete(question)
-		return nil, nil
+// answerTTL returns the shortest ttl of the records of the answer, CNAME records included.
+func answerTTL(msg *dns.Msg, qtype uint16) time.Duration {
+	var ttl uint32
+	first := true
+	for _, rr := range msg.Answer {
+		if rrType := rr.Header().Rrtype; rrType != qtype && rrType != dns.TypeCNAME {
+			continue
+		}
+		if first || rr.Header().Ttl < ttl {
+			ttl, first = rr.Header().Ttl, false
+		}
 	}
-	if len(response.A) == 0 && len(response.AAAA) == 0 { // invalid cache
-		c.cache.Delete(question)
-		return nil, nil
+	return time.Duration(ttl) * time.Second
+}
+
+// negativeTTL returns the ttl of a negative answer, the lesser of the ttl and the minimum
+// field of the SOA record (RFC 2308 section 5). It is -1 without SOA, such answers are not cached.
+func negativeTTL(msg *dns.Msg) time.Duration {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			return min(ttl, constant.ResolverNegativeMaxTTL)
+		}
 	}
-	return response.A, response.AAAA
+	return -1
 }
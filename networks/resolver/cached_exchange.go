@@ -0,0 +1,201 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/sagernet/sing/common/cache"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type messageKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	// answers differ by the EDNS0 record, the DO and CD bits of the query
+	edns         bool
+	dnssecOK     bool
+	checkingOff  bool
+	recursionOff bool
+}
+
+type messageEntry struct {
+	answer *dns.Msg
+	ttl    time.Duration
+	stored time.Time
+	expire time.Time
+
+	hits        atomic.Uint32
+	prefetching atomic.Bool
+}
+
+// reply returns a copy of the answer for request, with the ttl of the records lowered
+// by the time spent in the cache, or set to ttl if it is not 0.
+func (e *messageEntry) reply(request *dns.Msg, now time.Time, ttl time.Duration) *dns.Msg {
+	answer := e.answer.Copy()
+	answer.Id = request.Id
+	// the name as the client spelled it
+	answer.Question = slices.Clone(request.Question)
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, records := range [][]dns.RR{answer.Answer, answer.Ns, answer.Extra} {
+		for _, rr := range records {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if ttl > 0 {
+				header.Ttl = uint32(ttl / time.Second)
+			} else if header.Ttl > elapsed {
+				header.Ttl -= elapsed
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+	return answer
+}
+
+// CachedExchanger caches the answers of an Exchanger like CachedResolver does,
+// for any query of a single question. Other queries are passed through.
+// Queries are sent upstream with an id of their own, so that queries of many
+// clients with the same id do not collide on the connections of the Exchanger.
+type CachedExchanger struct {
+	client  Exchanger
+	options CacheOptions
+	cache   *cache.LruCache[messageKey, *messageEntry]
+}
+
+func NewCachedExchanger(client Exchanger, options CacheOptions) *CachedExchanger {
+	if options.Size <= 0 {
+		options.Size = constant.ResolverCacheSize
+	}
+	if options.MaxTTL <= 0 {
+		options.MaxTTL = constant.ResolverCacheMaxTTL
+	}
+	options.MinTTL = min(options.MinTTL, options.MaxTTL)
+	return &CachedExchanger{
+		client:  client,
+		options: options,
+		cache: cache.New[messageKey, *messageEntry](
+			cache.WithSize[messageKey, *messageEntry](options.Size),
+			cache.WithAge[messageKey, *messageEntry](max(int64(options.MaxTTL/time.Second), 1)),
+		),
+	}
+}
+
+func (c *CachedExchanger) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	if request.Opcode != dns.OpcodeQuery || len(request.Question) != 1 {
+		return c.exchange(ctx, request)
+	}
+	question := request.Question[0]
+	key := messageKey{
+		name:         strings.ToLower(question.Name),
+		qtype:        question.Qtype,
+		qclass:       question.Qclass,
+		checkingOff:  request.CheckingDisabled,
+		recursionOff: !request.RecursionDesired,
+	}
+	if opt := request.IsEdns0(); opt != nil {
+		key.edns, key.dnssecOK = true, opt.Do()
+	}
+
+	entry, ok := c.cache.Load(key)
+	if !ok {
+		return c.exchangeStore(ctx, key, request)
+	}
+	now := time.Now()
+	if now.Before(entry.expire) {
+		hits := entry.hits.Add(1)
+		if c.options.Prefetch && hits >= constant.ResolverPrefetchHits &&
+			entry.expire.Sub(now) < entry.ttl/10 && entry.prefetching.CompareAndSwap(false, true) {
+			go c.prefetch(key, request.Copy(), entry)
+		}
+		return entry.reply(request, now, 0), nil
+	}
+	answer, err := c.exchangeStore(ctx, key, request)
+	if err != nil && now.Before(entry.expire.Add(c.options.StaleTTL)) {
+		// the upstream failed, serve stale (RFC 8767 section 4)
+		return entry.reply(request, now, constant.ResolverStaleAnswerTTL), nil
+	}
+	return answer, err
+}
+
+func (c *CachedExchanger) prefetch(key messageKey, request *dns.Msg, entry *messageEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), constant.ResolverDefaultReadTimeout)
+	defer cancel()
+	if _, err := c.exchangeStore(ctx, key, request); err != nil {
+		// let a later hit try again
+		entry.prefetching.Store(false)
+	}
+}
+
+// exchangeStore exchanges request and caches the answer if it can be.
+func (c *CachedExchanger) exchangeStore(ctx context.Context, key messageKey, request *dns.Msg) (*dns.Msg, error) {
+	answer, err := c.exchange(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if serverFailed(answer.Rcode) {
+		// server failures are not cached, a stale answer is better
+		return answer, RcodeError(answer.Rcode)
+	}
+	if answer.Truncated || (answer.Rcode != dns.RcodeSuccess && answer.Rcode != dns.RcodeNameError) {
+		return answer, nil
+	}
+	ttl := messageTTL(answer)
+	if ttl >= 0 {
+		ttl = min(max(ttl, c.options.MinTTL), c.options.MaxTTL)
+	}
+	if ttl > 0 {
+		// records do not outlive the answer in the cache
+		capTTL(answer, ttl)
+		now := time.Now()
+		entry := &messageEntry{answer: answer.Copy(), ttl: ttl, stored: now, expire: now.Add(ttl)}
+		storeEntry(c.cache, key, entry, entry.expire.Add(c.options.StaleTTL))
+	}
+	return answer, nil
+}
+
+// capTTL lowers the ttl of the records of msg to ttl at most.
+func capTTL(msg *dns.Msg, ttl time.Duration) {
+	limit := uint32(ttl / time.Second)
+	for _, records := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range records {
+			if header := rr.Header(); header.Rrtype != dns.TypeOPT && header.Ttl > limit {
+				header.Ttl = limit
+			}
+		}
+	}
+}
+
+// exchange sends request upstream with a new id, the answer has the id of request.
+func (c *CachedExchanger) exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	query := request.Copy()
+	query.Id = dns.Id()
+	answer, err := c.client.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if answer == nil {
+		return nil, errors.New("resolve: nil answer")
+	}
+	answer.Id = request.Id
+	return answer, nil
+}
+
+// messageTTL returns the shortest ttl of the records of the answer,
+// or the ttl of a negative answer if it has no record.
+func messageTTL(msg *dns.Msg) time.Duration {
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) == 0 {
+		return negativeTTL(msg)
+	}
+	ttl := msg.Answer[0].Header().Ttl
+	for _, rr := range msg.Answer[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return time.Duration(ttl) * time.Second
+}
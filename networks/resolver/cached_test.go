@@ -0,0 +1,326 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// answerExchanger answers A and AAAA queries with the addresses of the family, in their order.
+type answerExchanger struct {
+	addresses []netip.Addr
+}
+
+func (e *answerExchanger) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	reply := new(dns.Msg).SetReply(request)
+	question := request.Question[0]
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: 60}
+	for _, addr := range e.addresses {
+		switch {
+		case question.Qtype == dns.TypeA && addr.Is4():
+			reply.Answer = append(reply.Answer, &dns.A{Hdr: hdr, A: net.IP(addr.AsSlice())})
+		case question.Qtype == dns.TypeAAAA && addr.Is6():
+			reply.Answer = append(reply.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IP(addr.AsSlice())})
+		}
+	}
+	return reply, nil
+}
+
+// TestCachedResolverAllAddresses checks that an answer of many addresses comes back whole
+// and in order, from the upstream and from the cache.
+func TestCachedResolverAllAddresses(t *testing.T) {
+	A := []netip.Addr{netip.MustParseAddr("192.0.2.3"), netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")}
+	AAAA := []netip.Addr{netip.MustParseAddr("2001:db8::2"), netip.MustParseAddr("2001:db8::1")}
+	r := NewCachedResolverDefault(&answerExchanger{addresses: slices.Concat(A, AAAA)})
+	for _, from := range []string{"upstream", "cache"} {
+		gotA, gotAAAA, err := r.Lookup(context.Background(), "many.example", StrategyDefault)
+		if err != nil {
+			t.Fatalf("%s: %v", from, err)
+		}
+		if !slices.Equal(gotA, A) || !slices.Equal(gotAAAA, AAAA) {
+			t.Errorf("%s: %v %v, want %v %v", from, gotA, gotAAAA, A, AAAA)
+		}
+	}
+}
+
+// scriptExchanger answers every query with reply, which the test may change.
+type scriptExchanger struct {
+	access  sync.Mutex
+	reply   func(request *dns.Msg) (*dns.Msg, error)
+	queries atomic.Int32
+}
+
+func (e *scriptExchanger) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	e.queries.Add(1)
+	e.access.Lock()
+	reply := e.reply
+	e.access.Unlock()
+	return reply(request)
+}
+
+func (e *scriptExchanger) setReply(reply func(request *dns.Msg) (*dns.Msg, error)) {
+	e.access.Lock()
+	e.reply = reply
+	e.access.Unlock()
+}
+
+// addressReply answers A queries with 192.0.2.n and AAAA queries with 2001:db8::n.
+func addressReply(n byte, ttl uint32) func(request *dns.Msg) (*dns.Msg, error) {
+	return func(request *dns.Msg) (*dns.Msg, error) {
+		reply := new(dns.Msg).SetReply(request)
+		question := request.Question[0]
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: ttl}
+		switch question.Qtype {
+		case dns.TypeA:
+			reply.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4(192, 0, 2, n).To4()}}
+		case dns.TypeAAAA:
+			reply.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: netip.AddrFrom16([16]byte{0x20, 0x01, 0x0d, 0xb8, 15: n}).AsSlice()}}
+		}
+		return reply, nil
+	}
+}
+
+// negativeReply answers with rcode and no record, with a SOA record if soaTTL is not 0.
+func negativeReply(rcode int, soaTTL, minTTL uint32) func(request *dns.Msg) (*dns.Msg, error) {
+	return func(request *dns.Msg) (*dns.Msg, error) {
+		reply := new(dns.Msg).SetRcode(request, rcode)
+		if soaTTL != 0 {
+			reply.Ns = []dns.RR{&dns.SOA{
+				Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+				Ns:     "ns.example.",
+				Mbox:   "hostmaster.example.",
+				Minttl: minTTL,
+			}}
+		}
+		return reply, nil
+	}
+}
+
+func failReply(request *dns.Msg) (*dns.Msg, error) {
+	return nil, errors.New("upstream failed")
+}
+
+func TestCachedResolverNegative(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    func(request *dns.Msg) (*dns.Msg, error)
+		nxdomain bool
+		// ttl is the cached ttl, 0 if the answer is not cached
+		ttl time.Duration
+	}{
+		{"nxdomain soa minimum", negativeReply(dns.RcodeNameError, 300, 60), true, 60 * time.Second},
+		{"nxdomain soa ttl", negativeReply(dns.RcodeNameError, 20, 60), true, 20 * time.Second},
+		{"nodata", negativeReply(dns.RcodeSuccess, 300, 45), false, 45 * time.Second},
+		{"nxdomain capped", negativeReply(dns.RcodeNameError, 86400, 86400), true, constant.ResolverNegativeMaxTTL},
+		{"no soa", negativeReply(dns.RcodeNameError, 0, 0), true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &scriptExchanger{reply: tt.reply}
+			r := NewCachedResolverDefault(upstream)
+			for range 2 {
+				_, _, err := r.Lookup(context.Background(), "missing.example", StrategyIPv4Only)
+				var rcodeErr RcodeError
+				if isNX := errors.As(err, &rcodeErr) && int(rcodeErr) == dns.RcodeNameError; err == nil || isNX != tt.nxdomain {
+					t.Fatalf("lookup: %v, want nxdomain %v", err, tt.nxdomain)
+				}
+			}
+			entry, ok := r.cache.Load(cacheKey{name: "missing.example.", qtype: dns.TypeA})
+			if tt.ttl == 0 {
+				if ok || upstream.queries.Load() != 2 {
+					t.Errorf("cached %v after %d queries, want no cache", ok, upstream.queries.Load())
+				}
+				return
+			}
+			if !ok || upstream.queries.Load() != 1 {
+				t.Fatalf("cached %v after %d queries, want the second lookup from the cache", ok, upstream.queries.Load())
+			}
+			if entry.ttl != tt.ttl {
+				t.Errorf("ttl %s, want %s", entry.ttl, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestCachedResolverStale(t *testing.T) {
+	const staleTTL = time.Hour
+	upstream := &scriptExchanger{reply: addressReply(1, 60)}
+	r := NewCachedResolver(upstream, CacheOptions{StaleTTL: staleTTL})
+	key := cacheKey{name: "stale.example.", qtype: dns.TypeA}
+	lookup := func() ([]netip.Addr, time.Duration, error) {
+		A, _, ttl, err := r.LookupTTL(context.Background(), "stale.example", StrategyIPv4Only)
+		return A, ttl, err
+	}
+	expire := func(ago time.Duration) {
+		entry, ok := r.cache.Load(key)
+		if !ok {
+			t.Fatal("answer is not cached")
+		}
+		entry.expire = time.Now().Add(-ago)
+	}
+	if _, _, err := lookup(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the upstream fails, the expired answer is served
+	upstream.setReply(failReply)
+	expire(time.Second)
+	A, ttl, err := lookup()
+	if err != nil || len(A) != 1 || A[0] != netip.MustParseAddr("192.0.2.1") {
+		t.Fatalf("lookup %v, %v, want the stale answer", A, err)
+	}
+	if ttl != constant.ResolverStaleAnswerTTL {
+		t.Errorf("stale ttl %s, want %s", ttl, constant.ResolverStaleAnswerTTL)
+	}
+
+	// not after the stale ttl
+	expire(2 * staleTTL)
+	if A, _, err = lookup(); err == nil {
+		t.Errorf("lookup %v, want the error of the upstream", A)
+	}
+
+	// a name that no longer exists is not served stale
+	expire(time.Second)
+	upstream.setReply(negativeReply(dns.RcodeNameError, 0, 0))
+	var rcodeErr RcodeError
+	if A, _, err = lookup(); !errors.As(err, &rcodeErr) || int(rcodeErr) != dns.RcodeNameError {
+		t.Errorf("lookup %v, %v, want nxdomain", A, err)
+	}
+}
+
+func TestCachedResolverPrefetch(t *testing.T) {
+	upstream := &scriptExchanger{reply: addressReply(1, 100)}
+	r := NewCachedResolver(upstream, CacheOptions{Prefetch: true})
+	key := cacheKey{name: "hot.example.", qtype: dns.TypeA}
+	lookup := func() []netip.Addr {
+		A, _, err := r.Lookup(context.Background(), "hot.example", StrategyIPv4Only)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return A
+	}
+	lookup()
+	entry, _ := r.cache.Load(key)
+	// hits of an answer far from its expiry do not prefetch
+	for range constant.ResolverPrefetchHits {
+		lookup()
+	}
+	if n := upstream.queries.Load(); n != 1 {
+		t.Fatalf("%d queries, want no prefetch", n)
+	}
+
+	upstream.setReply(addressReply(2, 100))
+	// in the last tenth of the ttl
+	entry.expire = time.Now().Add(5 * time.Second)
+	if A := lookup(); A[0] != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("lookup %v, want the cached answer while prefetching", A)
+	}
+	waitFor := time.Now().Add(5 * time.Second)
+	for {
+		if refreshed, _ := r.cache.Load(key); refreshed != entry {
+			break
+		}
+		if time.Now().After(waitFor) {
+			t.Fatal("answer is not prefetched")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if A := lookup(); A[0] != netip.MustParseAddr("192.0.2.2") {
+		t.Errorf("lookup %v, want the prefetched answer", A)
+	}
+	if n := upstream.queries.Load(); n != 2 {
+		t.Errorf("%d queries, want 1 prefetch", n)
+	}
+}
+
+func TestCachedResolverTTLBounds(t *testing.T) {
+	options := CacheOptions{MinTTL: 2 * time.Minute, MaxTTL: 10 * time.Minute}
+	tests := []struct {
+		ttl  uint32
+		want time.Duration
+	}{
+		{10, options.MinTTL},
+		{300, 300 * time.Second},
+		{86400, options.MaxTTL},
+	}
+	for _, tt := range tests {
+		r := NewCachedResolver(&scriptExchanger{reply: addressReply(1, tt.ttl)}, options)
+		for _, from := range []string{"upstream", "cache"} {
+			_, _, ttl, err := r.LookupTTL(context.Background(), "bounded.example", StrategyIPv4Only)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the cache reports the remaining ttl
+			if ttl > tt.want || ttl < tt.want-time.Second {
+				t.Errorf("ttl %d from %s: %s, want %s", tt.ttl, from, ttl, tt.want)
+			}
+		}
+	}
+}
+
+func TestCachedExchanger(t *testing.T) {
+	upstream := &scriptExchanger{reply: addressReply(1, 86400)}
+	c := NewCachedExchanger(upstream, CacheOptions{MinTTL: 2 * time.Minute, MaxTTL: 10 * time.Minute, StaleTTL: time.Hour})
+	request := new(dns.Msg).SetQuestion("Cached.Example.", dns.TypeA)
+	request.Id = 7
+	key := messageKey{name: "cached.example.", qtype: dns.TypeA, qclass: dns.ClassINET}
+	exchange := func() *dns.Msg {
+		t.Helper()
+		answer, err := c.Exchange(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer.Id != request.Id || answer.Question[0].Name != request.Question[0].Name {
+			t.Errorf("answer %v, want the id and question of the request", answer)
+		}
+		return answer
+	}
+	exchange()
+	entry, ok := c.cache.Load(key)
+	if !ok {
+		t.Fatal("answer is not cached")
+	}
+	if entry.ttl != 10*time.Minute {
+		t.Errorf("cached ttl %s, want MaxTTL", entry.ttl)
+	}
+	if answer := exchange(); upstream.queries.Load() != 1 || answer.Answer[0].Header().Ttl > 600 {
+		t.Errorf("ttl %d after %d queries, want a cached answer within MaxTTL", answer.Answer[0].Header().Ttl, upstream.queries.Load())
+	}
+
+	// the upstream fails, the expired answer is served
+	upstream.setReply(failReply)
+	entry.expire = time.Now().Add(-time.Second)
+	if answer := exchange(); len(answer.Answer) != 1 || answer.Answer[0].Header().Ttl != uint32(constant.ResolverStaleAnswerTTL/time.Second) {
+		t.Errorf("answer %v, want the stale answer", answer)
+	}
+
+	// a name that no longer exists replaces the answer, with the SOA ttl
+	upstream.setReply(negativeReply(dns.RcodeNameError, 300, 300))
+	if answer := exchange(); answer.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode %s, want nxdomain", dns.RcodeToString[answer.Rcode])
+	}
+	if entry, _ = c.cache.Load(key); entry.answer.Rcode != dns.RcodeNameError || entry.ttl != 300*time.Second {
+		t.Errorf("cached rcode %s ttl %s, want nxdomain for 300s", dns.RcodeToString[entry.answer.Rcode], entry.ttl)
+	}
+	upstream.setReply(failReply)
+	entry.expire = time.Now().Add(-time.Second)
+	if answer := exchange(); answer.Rcode != dns.RcodeNameError || len(answer.Answer) != 0 {
+		t.Errorf("answer %v, want the stale nxdomain", answer)
+	}
+
+	// a short negative ttl is raised to MinTTL
+	upstream.setReply(negativeReply(dns.RcodeSuccess, 5, 5))
+	entry.expire = time.Now().Add(-2 * time.Hour)
+	exchange()
+	if entry, _ = c.cache.Load(key); entry.ttl != 2*time.Minute {
+		t.Errorf("cached nodata ttl %s, want MinTTL", entry.ttl)
+	}
+}
@@ -11,7 +11,11 @@ import (
 	"io"
 	"net"
 	"net/netip"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -20,23 +24,109 @@ const (
 	maxConn = 8
 )
 
+var readBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, dns.MaxMsgSize)
+		return &buf
+	},
+}
+
 type RawClient struct {
-	dialer      net.Dialer
+	dialer      ContextDialer
 	destination string
+	udpSize     uint16
+	// tcp queries over tcp only
+	tcp bool
 
 	conns chan net.Conn // max = maxConn
 
 	connCount atomic.Int32
 }
 
-func NewRawClient(dialer net.Dialer, destination string) *RawClient {
+// NewRawClient returns a plain udp client, the port of destination defaults to 53.
+// udpSize is the EDNS0 udp payload size advertised to the server, 0 for the default.
+// Truncated answers are queried again over tcp.
+func NewRawClient(dialer ContextDialer, destination string, udpSize uint16) *RawClient {
+	if udpSize == 0 {
+		udpSize = constant.ResolverDefaultUDPSize
+	}
 	return &RawClient{
 		dialer:      dialer,
-		destination: net.JoinHostPort(destination, "53"),
+		destination: withDefaultPort(destination, "53"),
+		udpSize:     max(udpSize, dns.MinMsgSize),
 		conns:       make(chan net.Conn, maxConn),
 	}
 }
 
+// NewTCPClient returns a plain tcp client, the port of destination defaults to 53.
+func NewTCPClient(dialer ContextDialer, destination string) *RawClient {
+	c := NewRawClient(dialer, destination, 0)
+	c.tcp = true
+	return c
+}
+
+// NewClient returns the Exchanger of a dns server, server is one of
+//
+//	1.1.1.1, 1.1.1.1:53 or udp://1.1.1.1:53 for plain dns over udp
+//	tcp://1.1.1.1:53 for plain dns over tcp
+//	tls://1.1.1.1 or tls://dns.example:853 for dns over tls
+//	https://dns.example/dns-query for dns over https
+//
+// udpSize is the EDNS0 udp payload size of plain dns servers.
+func NewClient(dialer ContextDialer, server string, udpSize uint16) (Exchanger, error) {
+	if !strings.Contains(server, "://") {
+		return NewRawClient(dialer, server, udpSize), nil
+	}
+	uu, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("resolve: parse server: %w", err)
+	}
+	if uu.Hostname() == "" {
+		return nil, fmt.Errorf("resolve: no host in server: %s", server)
+	}
+	switch uu.Scheme {
+	case "udp":
+		return NewRawClient(dialer, uu.Host, udpSize), nil
+	case "tcp":
+		return NewTCPClient(dialer, uu.Host), nil
+	case "tls":
+		return NewTLSClient(dialer, withDefaultPort(uu.Host, "853"), uu.Hostname()), nil
+	case "https":
+		return NewHTTPSClient(dialer, uu), nil
+	default:
+		return nil, fmt.Errorf("resolve: unsupported server scheme: %s", uu.Scheme)
+	}
+}
+
+// NewSystemClient returns the Exchanger of the nameservers in /etc/resolv.conf, for queries
+// that the system resolver can not make.
+func NewSystemClient(dialer ContextDialer) (Exchanger, error) {
+	config, err := dns.ClientConfigFromFile(constant.ResolvConfPath)
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	if len(config.Servers) == 0 {
+		return nil, fmt.Errorf("resolve: no nameserver in %s", constant.ResolvConfPath)
+	}
+	clients := make([]Exchanger, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		clients = append(clients, NewRawClient(dialer, net.JoinHostPort(server, config.Port), 0))
+	}
+	if len(clients) == 1 {
+		return clients[0], nil
+	}
+	return NewMultiClient(MultiFailover, clients...), nil
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	// ipv6 literal in brackets without port
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.JoinHostPort(host, port)
+}
+
 func (c *RawClient) Lookup(ctx context.Context, fqdn string, strategy Strategy) (A []netip.Addr, AAAA []netip.Addr, err error) {
 	group := task.Group{}
 
@@ -97,13 +187,60 @@ func (c *RawClient) exchange(ctx context.Context, request *dns.Msg) (answer *dns
 	if common.Done(ctx) {
 		return nil, ctx.Err()
 	}
-	pack, err := request.Pack()
+	// advertise our payload size, the size in the EDNS0 record of a forwarded request
+	// is the one of the hop before
+	query := request
+	opt := request.IsEdns0()
+	if opt == nil {
+		query = request.Copy()
+		query.SetEdns0(c.udpSize, false)
+	} else if opt.UDPSize() != c.udpSize {
+		query = request.Copy()
+		query.IsEdns0().SetUDPSize(c.udpSize)
+	}
+	pack, err := query.Pack()
 	if err != nil {
 		return nil, fmt.Errorf("resolve: %w", err)
 	}
+
+	var deadline time.Time
+	if dead, ok := ctx.Deadline(); ok {
+		if time.Now().After(dead) {
+			return nil, context.DeadlineExceeded
+		}
+		deadline = dead
+	} else {
+		deadline = time.Now().Add(constant.ResolverDefaultReadTimeout)
+	}
+
+	if c.tcp {
+		answer, err = c.exchangeTCP(ctx, query, deadline)
+	} else {
+		answer, err = c.exchangeUDP(ctx, query, pack, deadline)
+	}
+	if err == nil && answer.Truncated && !c.tcp {
+		answer, err = c.exchangeTCP(ctx, query, deadline)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	if opt == nil {
+		// the caller did not ask for EDNS0
+		answer.Extra = slices.DeleteFunc(answer.Extra, func(rr dns.RR) bool {
+			return rr.Header().Rrtype == dns.TypeOPT
+		})
+	}
+	// negative answers are returned as is, their SOA tells how long to cache them
+	return answer, nil
+}
+
+// exchangeUDP sends query over a pooled udp conn. Answers are read into a buffer of the max
+// message size, a server may answer with more than the payload size of the query.
+func (c *RawClient) exchangeUDP(ctx context.Context, query *dns.Msg, pack []byte, deadline time.Time) (*dns.Msg, error) {
 	var (
 		nn    int
 		conn  net.Conn
+		err   error
 		retry int
 	)
 	for {
@@ -113,7 +250,7 @@ func (c *RawClient) exchange(ctx context.Context, request *dns.Msg) (answer *dns
 
 		conn, err = c.newUdpConn(ctx)
 		if err != nil {
-			return nil, fmt.Errorf("resolve: %w", err)
+			return nil, err
 		}
 
 		nn, err = conn.Write(pack[:])
@@ -129,51 +266,73 @@ func (c *RawClient) exchange(ctx context.Context, request *dns.Msg) (answer *dns
 		if nn <= 0 {
 			// wrong conn , close
 			c.closeConn(conn)
-			return nil, fmt.Errorf("resolve: conn return a zero  or negative count: %d", nn)
+			return nil, fmt.Errorf("conn return a zero  or negative count: %d", nn)
 		}
 		break
 	}
-	defer func() { c.conns <- conn }()
 
-	var deadline time.Time
-	if dead, ok := ctx.Deadline(); ok {
-		if time.Now().After(deadline) {
-			return nil, context.DeadlineExceeded
+	_ = conn.SetReadDeadline(deadline)
+	buffer := readBufferPool.Get().(*[]byte)
+	defer readBufferPool.Put(buffer)
+	readBuf := *buffer
+	for {
+		nn, err = conn.Read(readBuf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// the conn is still usable, a late answer is skipped by the next query
+				c.conns <- conn
+			} else {
+				c.closeConn(conn)
+			}
+			return nil, err
 		}
-		deadline = dead
-	} else {
-		deadline = time.Now().Add(constant.ResolverDefaultReadTimeout)
+		answer := new(dns.Msg)
+		if answer.Unpack(readBuf[:nn]) != nil || !matchResponse(query, answer) {
+			// a late answer of an earlier query on this conn, or garbage
+			continue
+		}
+		c.conns <- conn
+		return answer, nil
 	}
+}
 
-	_ = conn.SetReadDeadline(deadline)
-	readBuf := make([]byte, 4096)
-	nn, err = conn.Read(readBuf[:])
-	if err != nil {
-		return nil, fmt.Errorf("resolve: %w", err)
-	}
-	readBuf = readBuf[:nn]
-	answer = new(dns.Msg)
-	err = answer.Unpack(readBuf)
+func (c *RawClient) exchangeTCP(ctx context.Context, query *dns.Msg, deadline time.Time) (*dns.Msg, error) {
+	conn, err := c.dialer.DialContext(ctx, "tcp", c.destination)
 	if err != nil {
-		return nil, fmt.Errorf("resolve: %w", err)
+		return nil, err
 	}
+	defer conn.Close()
+	_ = conn.SetDeadline(deadline)
 
-	if answer == nil {
-		panic("client return a nil dns message without error")
-	}
-	if answer.Rcode != dns.RcodeSuccess {
-		return nil, RcodeError(answer.Rcode)
+	dnsConn := &dns.Conn{Conn: conn}
+	if err = dnsConn.WriteMsg(query); err != nil {
+		return nil, err
 	}
-	if answer.Id != request.Id {
-		return nil, errors.New("incorrect id")
+	answer, err := dnsConn.ReadMsg()
+	if err != nil {
+		return nil, err
 	}
-	if answer.Truncated {
-		return nil, errors.New("truncated")
+	if !matchResponse(query, answer) {
+		return nil, errors.New("mismatched answer over tcp")
 	}
-
 	return answer, nil
 }
 
+// matchResponse reports whether answer is the response of request, by id and question.
+func matchResponse(request *dns.Msg, answer *dns.Msg) bool {
+	if !answer.Response || answer.Id != request.Id || len(answer.Question) != len(request.Question) {
+		return false
+	}
+	for i, q := range request.Question {
+		a := answer.Question[i]
+		if a.Qtype != q.Qtype || a.Qclass != q.Qclass || !strings.EqualFold(a.Name, q.Name) {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *RawClient) closeConn(conn net.Conn) {
 	_ = conn.Close()
 	if c.connCount.Load() > 0 {
@@ -186,14 +345,21 @@ func (c *RawClient) newUdpConn(ctx context.Context) (net.Conn, error) {
 	case conn := <-c.conns:
 		return conn, nil
 	default:
-		if c.connCount.Load() >= maxConn {
+		if c.connCount.Add(1) > maxConn {
+			c.connCount.Add(-1)
 			// wait until available
-			return <-c.conns, nil
+			select {
+			case conn := <-c.conns:
+				return conn, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
 		}
 
 		// new one conn
 		conn, err := c.dialer.DialContext(ctx, "udp", c.destination)
 		if err != nil {
+			c.connCount.Add(-1)
 			return nil, err
 		}
 		return conn, nil
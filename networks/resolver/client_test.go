@@ -0,0 +1,110 @@
+package resolver
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer serves handler over udp and tcp on the same loopback port.
+func startServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	packetConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp4", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		t.Skipf("listen tcp on the udp port: %v", err)
+	}
+	for _, server := range []*dns.Server{{PacketConn: packetConn, Handler: handler}, {Listener: listener, Handler: handler}} {
+		go server.ActivateAndServe()
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return packetConn.LocalAddr().String()
+}
+
+// bigAnswer answers with more records than fit in the default udp payload size.
+func bigAnswer(w dns.ResponseWriter, request *dns.Msg, truncate bool) {
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	for i := range 200 {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, byte(i/256), byte(i)),
+		})
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && truncate {
+		reply.Truncate(dns.MinMsgSize)
+	}
+	_ = w.WriteMsg(reply)
+}
+
+func TestRawClientLargeUDPAnswer(t *testing.T) {
+	var tcpQueries int
+	for _, truncate := range []bool{false, true} {
+		server := startServer(t, func(w dns.ResponseWriter, request *dns.Msg) {
+			if _, tcp := w.RemoteAddr().(*net.TCPAddr); tcp {
+				tcpQueries++
+			}
+			bigAnswer(w, request, truncate)
+		})
+		client := NewRawClient(&net.Dialer{}, server, 0)
+		request := new(dns.Msg)
+		request.SetQuestion("many.example.", dns.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		answer, err := client.Exchange(ctx, request)
+		cancel()
+		if err != nil {
+			t.Fatalf("truncate %v: %v", truncate, err)
+		}
+		if len(answer.Answer) != 200 || answer.Truncated {
+			t.Errorf("truncate %v: %d records, truncated %v, want 200 complete", truncate, len(answer.Answer), answer.Truncated)
+		}
+	}
+	// the oversized udp answer is taken as is, the truncated one is asked again over tcp
+	if tcpQueries != 1 {
+		t.Errorf("%d queries over tcp, want 1", tcpQueries)
+	}
+}
+
+// TestRawClientUDPSize checks that the server is told the payload size of the client,
+// not the one of the request it forwards.
+func TestRawClientUDPSize(t *testing.T) {
+	sizes := make(chan uint16, 1)
+	server := startServer(t, func(w dns.ResponseWriter, request *dns.Msg) {
+		var size uint16
+		if opt := request.IsEdns0(); opt != nil {
+			size = opt.UDPSize()
+		}
+		sizes <- size
+		reply := new(dns.Msg).SetReply(request)
+		reply.SetEdns0(4096, false)
+		_ = w.WriteMsg(reply)
+	})
+	client := NewRawClient(&net.Dialer{}, server, 1400)
+	for _, edns := range []bool{false, true} {
+		request := new(dns.Msg).SetQuestion("example.", dns.TypeA)
+		if edns {
+			request.SetEdns0(4096, true)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		answer, err := client.Exchange(ctx, request)
+		cancel()
+		if err != nil {
+			t.Fatalf("edns %v: %v", edns, err)
+		}
+		if size := <-sizes; size != 1400 {
+			t.Errorf("edns %v: server saw the payload size %d, want 1400", edns, size)
+		}
+		if (answer.IsEdns0() != nil) != edns {
+			t.Errorf("edns %v: answer has an EDNS0 record %v", edns, answer.IsEdns0() != nil)
+		}
+		if edns && (request.IsEdns0().UDPSize() != 4096 || !request.IsEdns0().Do()) {
+			t.Errorf("the request was changed: %v", request.IsEdns0())
+		}
+	}
+}
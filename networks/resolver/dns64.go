@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// NAT64WellKnownPrefix is the prefix of RFC 6052 section 2.1.
+var NAT64WellKnownPrefix = netip.MustParsePrefix("64:ff9b::/96")
+
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// ValidNAT64Prefix reports whether prefix can embed ipv4 addresses (RFC 6052 section 2.2).
+// The bits 64 to 71, the u octet, must be zero, a /96 prefix covers them.
+func ValidNAT64Prefix(prefix netip.Prefix) bool {
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		return false
+	}
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64:
+		return true
+	case 96:
+		return prefix.Masked().Addr().As16()[8] == 0
+	default:
+		return false
+	}
+}
+
+// NAT64Address embeds addr in prefix as RFC 6052 section 2.2 does, the u octet is skipped and left zero.
+// It reports false if addr is not ipv4, or it is not global and prefix is the well known prefix,
+// which must not represent such addresses (RFC 6052 section 3.1).
+func NAT64Address(prefix netip.Prefix, addr netip.Addr) (netip.Addr, bool) {
+	addr = addr.Unmap()
+	if !addr.Is4() || !ValidNAT64Prefix(prefix) {
+		return netip.Addr{}, false
+	}
+	if prefix.Masked() == NAT64WellKnownPrefix && (addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		addr.IsUnspecified() || addr.IsMulticast() || sharedAddressSpace.Contains(addr)) {
+		return netip.Addr{}, false
+	}
+	v6, v4 := prefix.Masked().Addr().As16(), addr.As4()
+	index := prefix.Bits() / 8
+	for _, b := range v4 {
+		if index == 8 {
+			// the u octet
+			index++
+		}
+		v6[index] = b
+		index++
+	}
+	return netip.AddrFrom16(v6), true
+}
+
+// DNS64Resolver synthesizes ipv6 addresses from the ipv4 addresses of names
+// without ipv6 address (RFC 6147), so that an ipv6 only host reaches them through NAT64.
+type DNS64Resolver struct {
+	resolver Resolver
+	prefix   netip.Prefix
+}
+
+func NewDNS64Resolver(resolver Resolver, prefix netip.Prefix) *DNS64Resolver {
+	return &DNS64Resolver{resolver: resolver, prefix: prefix}
+}
+
+func (r *DNS64Resolver) Lookup(ctx context.Context, fqdn string, strategy Strategy) (A []netip.Addr, AAAA []netip.Addr, err error) {
+	A, AAAA, _, err = r.LookupTTL(ctx, fqdn, strategy)
+	return A, AAAA, err
+}
+
+func (r *DNS64Resolver) LookupTTL(ctx context.Context, fqdn string, strategy Strategy) (A []netip.Addr, AAAA []netip.Addr, ttl time.Duration, err error) {
+	queryStrategy := strategy
+	if strategy == StrategyIPv6Only {
+		// the ipv4 addresses are synthesized from
+		queryStrategy = StrategyDefault
+	}
+	if ttlResolver, ok := r.resolver.(TTLResolver); ok {
+		A, AAAA, ttl, err = ttlResolver.LookupTTL(ctx, fqdn, queryStrategy)
+	} else {
+		A, AAAA, err = r.resolver.Lookup(ctx, fqdn, queryStrategy)
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// ipv4-mapped addresses are no ipv6 address (RFC 6147 section 5.1.4),
+	// the answer may be cached, filter a copy
+	AAAA = slices.DeleteFunc(slices.Clone(AAAA), func(addr netip.Addr) bool { return addr.Is4In6() })
+	if len(AAAA) == 0 && strategy != StrategyIPv4Only {
+		for _, addr := range A {
+			if synthesized, ok := NAT64Address(r.prefix, addr); ok {
+				AAAA = append(AAAA, synthesized)
+			}
+		}
+	}
+	A, AAAA = FilterAddress(A, AAAA, strategy)
+	if len(A) == 0 && len(AAAA) == 0 {
+		return nil, nil, 0, fmt.Errorf("resolve: no available address found for %s", fqdn)
+	}
+	return A, AAAA, ttl, nil
+}
@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// TestNAT64Address checks the examples of RFC 6052 section 2.4, 192.0.2.33 in every prefix length.
+func TestNAT64Address(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.33")
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+		// the bits of the prefix address past its length do not leak in
+		{"2001:db8:ffff:ffff:ffff::/32", "2001:db8:c000:221::"},
+	}
+	for _, tt := range tests {
+		got, ok := NAT64Address(netip.MustParsePrefix(tt.prefix), addr)
+		if !ok || got != netip.MustParseAddr(tt.want) {
+			t.Errorf("%s: %s %v, want %s", tt.prefix, got, ok, tt.want)
+		}
+		// an ipv4-mapped address is embedded as its ipv4 address
+		if mapped, _ := NAT64Address(netip.MustParsePrefix(tt.prefix), netip.AddrFrom16(addr.As16())); mapped != got {
+			t.Errorf("%s: mapped %s, want %s", tt.prefix, mapped, got)
+		}
+	}
+}
+
+func TestNAT64AddressRejected(t *testing.T) {
+	wellKnown := NAT64WellKnownPrefix
+	custom := netip.MustParsePrefix("2001:db8:122:344::/96")
+	tests := []struct {
+		prefix netip.Prefix
+		addr   string
+		want   bool
+	}{
+		{wellKnown, "192.0.2.33", true},
+		// not global, RFC 6052 section 3.1
+		{wellKnown, "10.1.2.3", false},
+		{wellKnown, "172.16.0.1", false},
+		{wellKnown, "192.168.1.1", false},
+		{wellKnown, "127.0.0.1", false},
+		{wellKnown, "169.254.1.1", false},
+		{wellKnown, "100.64.0.1", false},
+		{wellKnown, "0.0.0.0", false},
+		{wellKnown, "224.0.0.1", false},
+		{netip.MustParsePrefix("64:ff9b::1/96"), "10.1.2.3", false},
+		// a network specific prefix may represent them
+		{custom, "10.1.2.3", true},
+		{custom, "2001:db8::1", false},
+		// bad prefixes
+		{netip.MustParsePrefix("2001:db8::/36"), "192.0.2.33", false},
+		{netip.MustParsePrefix("2001:db8:122:344:100::/96"), "192.0.2.33", false},
+		{netip.MustParsePrefix("::ffff:0:0/96"), "192.0.2.33", false},
+		{netip.MustParsePrefix("10.0.0.0/8"), "192.0.2.33", false},
+	}
+	for _, tt := range tests {
+		if _, ok := NAT64Address(tt.prefix, netip.MustParseAddr(tt.addr)); ok != tt.want {
+			t.Errorf("%s in %s: %v, want %v", tt.addr, tt.prefix, ok, tt.want)
+		}
+	}
+}
+
+func TestDNS64Resolver(t *testing.T) {
+	v4 := []netip.Addr{netip.MustParseAddr("192.0.2.33"), netip.MustParseAddr("10.1.2.3")}
+	v6 := []netip.Addr{netip.MustParseAddr("2001:db8::1")}
+	mapped := []netip.Addr{netip.MustParseAddr("::ffff:192.0.2.1")}
+	tests := []struct {
+		name     string
+		A, AAAA  []netip.Addr
+		strategy Strategy
+		wantA    []string
+		wantAAAA []string
+	}{
+		{"synthesized", v4, nil, StrategyDefault, []string{"192.0.2.33", "10.1.2.3"}, []string{"64:ff9b::c000:221"}},
+		{"ipv6 only", v4, nil, StrategyIPv6Only, nil, []string{"64:ff9b::c000:221"}},
+		{"ipv4 only", v4, nil, StrategyIPv4Only, []string{"192.0.2.33", "10.1.2.3"}, nil},
+		{"has ipv6", v4, v6, StrategyIPv6Only, nil, []string{"2001:db8::1"}},
+		// an ipv4-mapped address is no ipv6 address
+		{"mapped", v4, mapped, StrategyIPv6Only, nil, []string{"64:ff9b::c000:221"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeResolver{A: tt.A, AAAA: tt.AAAA}
+			A, AAAA, err := NewDNS64Resolver(upstream, NAT64WellKnownPrefix).Lookup(context.Background(), "example.", tt.strategy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := joinAddresses(A); got != joinAddresses(parseAddrs(tt.wantA)) {
+				t.Errorf("A %s, want %v", got, tt.wantA)
+			}
+			if got := joinAddresses(AAAA); got != joinAddresses(parseAddrs(tt.wantAAAA)) {
+				t.Errorf("AAAA %s, want %v", got, tt.wantAAAA)
+			}
+			if !slices.Equal(upstream.AAAA, tt.AAAA) {
+				t.Errorf("the answer of the upstream was changed: %v", upstream.AAAA)
+			}
+		})
+	}
+
+	// nothing to synthesize from
+	upstream := &fakeResolver{A: []netip.Addr{netip.MustParseAddr("10.1.2.3")}}
+	if _, AAAA, err := NewDNS64Resolver(upstream, NAT64WellKnownPrefix).Lookup(context.Background(), "example.", StrategyIPv6Only); err == nil {
+		t.Errorf("lookup %v, want an error for no address", AAAA)
+	}
+}
+
+func parseAddrs(addresses []string) []netip.Addr {
+	var parsed []netip.Addr
+	for _, addr := range addresses {
+		parsed = append(parsed, netip.MustParseAddr(addr))
+	}
+	return parsed
+}
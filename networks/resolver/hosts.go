@@ -0,0 +1,170 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"io"
+	"io/fs"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hosts maps names to addresses, from a static table and a hosts file in /etc/hosts format.
+// The file is checked for changes at most once every constant.HostsCheckInterval, on lookup.
+type Hosts struct {
+	static map[string][]netip.Addr
+	path   string
+
+	file    atomic.Pointer[map[string][]netip.Addr]
+	checked atomic.Int64 // unix nano
+	access  sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewHosts returns the table of static and the hosts file at path, path may be empty.
+func NewHosts(path string, static map[string][]netip.Addr) (*Hosts, error) {
+	h := &Hosts{
+		static: make(map[string][]netip.Addr, len(static)),
+		path:   path,
+	}
+	for name, addresses := range static {
+		name = canonicalName(name)
+		h.static[name] = append(h.static[name], addresses...)
+	}
+	if path != "" {
+		if err := h.reload(); err != nil {
+			return nil, fmt.Errorf("resolve: load hosts: %w", err)
+		}
+		h.checked.Store(time.Now().UnixNano())
+	}
+	return h, nil
+}
+
+// Lookup returns the addresses of name, static ones first.
+func (h *Hosts) Lookup(name string) []netip.Addr {
+	name = canonicalName(name)
+	addresses := h.static[name]
+	if h.path == "" {
+		return addresses
+	}
+	now := time.Now().UnixNano()
+	if checked := h.checked.Load(); now-checked >= int64(constant.HostsCheckInterval) && h.checked.CompareAndSwap(checked, now) {
+		// a broken file keeps the last table
+		_ = h.reload()
+	}
+	if file := h.file.Load(); file != nil {
+		addresses = append(addresses[:len(addresses):len(addresses)], (*file)[name]...)
+	}
+	return addresses
+}
+
+func (h *Hosts) reload() error {
+	h.access.Lock()
+	defer h.access.Unlock()
+	info, err := os.Stat(h.path)
+	if errors.Is(err, fs.ErrNotExist) && h.file.Load() != nil {
+		// removed, drop its entries
+		h.file.Store(&map[string][]netip.Addr{})
+		h.modTime, h.size = time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if h.file.Load() != nil && info.ModTime().Equal(h.modTime) && info.Size() == h.size {
+		return nil
+	}
+	file, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	table, err := parseHosts(file)
+	if err != nil {
+		return err
+	}
+	h.file.Store(&table)
+	h.modTime, h.size = info.ModTime(), info.Size()
+	return nil
+}
+
+// parseHosts parses the hosts file format: an address followed by its names, # starts a comment.
+func parseHosts(r io.Reader) (map[string][]netip.Addr, error) {
+	table := make(map[string][]netip.Addr)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			// skip the line like other resolvers do
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = canonicalName(name)
+			table[name] = append(table[name], addr)
+		}
+	}
+	return table, scanner.Err()
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// HostsResolver answers from hosts tables before it asks the resolver.
+// The tables are consulted in order, the first one with an address of the strategy wins.
+type HostsResolver struct {
+	hosts    []*Hosts
+	resolver Resolver
+}
+
+func NewHostsResolver(resolver Resolver, hosts ...*Hosts) *HostsResolver {
+	r := &HostsResolver{resolver: resolver}
+	for _, h := range hosts {
+		if h != nil {
+			r.hosts = append(r.hosts, h)
+		}
+	}
+	return r
+}
+
+func (r *HostsResolver) Lookup(ctx context.Context, fqdn string, strategy Strategy) (A []netip.Addr, AAAA []netip.Addr, err error) {
+	A, AAAA, _, err = r.LookupTTL(ctx, fqdn, strategy)
+	return A, AAAA, err
+}
+
+// LookupTTL reports the check interval of hosts files as the ttl of hosts answers.
+func (r *HostsResolver) LookupTTL(ctx context.Context, fqdn string, strategy Strategy) (A []netip.Addr, AAAA []netip.Addr, ttl time.Duration, err error) {
+	for _, h := range r.hosts {
+		for _, addr := range h.Lookup(fqdn) {
+			addr = addr.Unmap()
+			if addr.Is4() {
+				A = append(A, addr)
+			} else {
+				AAAA = append(AAAA, addr)
+			}
+		}
+		A, AAAA = FilterAddress(A, AAAA, strategy)
+		if len(A) != 0 || len(AAAA) != 0 {
+			return A, AAAA, constant.HostsCheckInterval, nil
+		}
+	}
+	if ttlResolver, ok := r.resolver.(TTLResolver); ok {
+		return ttlResolver.LookupTTL(ctx, fqdn, strategy)
+	}
+	A, AAAA, err = r.resolver.Lookup(ctx, fqdn, strategy)
+	return A, AAAA, 0, err
+}
@@ -0,0 +1,174 @@
+package resolver
+
+import (
+	"context"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseHosts(t *testing.T) {
+	const file = `# comment line
+127.0.0.1	localhost Local.Example
+::1 localhost # trailing comment
+192.0.2.1 web.example. www.example
+not-an-address broken.example
+192.0.2.2
+  # indented comment 192.0.2.3 commented.example
+192.0.2.4 web.example
+`
+	table, err := parseHosts(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]netip.Addr{
+		"localhost.":     {netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")},
+		"local.example.": {netip.MustParseAddr("127.0.0.1")},
+		"web.example.":   {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.4")},
+		"www.example.":   {netip.MustParseAddr("192.0.2.1")},
+	}
+	if len(table) != len(want) {
+		t.Errorf("table %v, want %v", table, want)
+	}
+	for name, addresses := range want {
+		if !slices.Equal(table[name], addresses) {
+			t.Errorf("%s: %v, want %v", name, table[name], addresses)
+		}
+	}
+}
+
+func writeHosts(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHostsReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	writeHosts(t, path, "192.0.2.1 file.example\n")
+	static := netip.MustParseAddr("192.0.2.100")
+	hosts, err := NewHosts(path, map[string][]netip.Addr{"FILE.example": {static}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(want ...string) {
+		t.Helper()
+		var addresses []string
+		for _, addr := range hosts.Lookup("file.example") {
+			addresses = append(addresses, addr.String())
+		}
+		if !slices.Equal(addresses, want) {
+			t.Errorf("lookup %v, want %v", addresses, want)
+		}
+	}
+	// static entries come before the file
+	lookup("192.0.2.100", "192.0.2.1")
+
+	writeHosts(t, path, "192.0.2.2 file.example\n192.0.2.3 file.example\n")
+	// checked at most once every constant.HostsCheckInterval
+	lookup("192.0.2.100", "192.0.2.1")
+	hosts.checked.Store(0)
+	lookup("192.0.2.100", "192.0.2.2", "192.0.2.3")
+
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	hosts.checked.Store(0)
+	lookup("192.0.2.100")
+
+	writeHosts(t, path, "192.0.2.4 file.example\n")
+	hosts.checked.Store(0)
+	lookup("192.0.2.100", "192.0.2.4")
+
+	// a file that can not be read keeps the last table
+	if err = os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	hosts.checked.Store(0)
+	lookup("192.0.2.100", "192.0.2.4")
+}
+
+func TestNewHostsMissingFile(t *testing.T) {
+	if _, err := NewHosts(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Error("no error for a missing hosts file")
+	}
+}
+
+// fakeResolver answers every lookup with its addresses.
+type fakeResolver struct {
+	A, AAAA []netip.Addr
+	lookups int
+}
+
+func (r *fakeResolver) Lookup(ctx context.Context, fqdn string, strategy Strategy) ([]netip.Addr, []netip.Addr, error) {
+	r.lookups++
+	A, AAAA := FilterAddress(r.A, r.AAAA, strategy)
+	return A, AAAA, nil
+}
+
+func TestHostsResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	writeHosts(t, path, "192.0.2.1 dual.example v4.example\n2001:db8::1 dual.example v6.example\n")
+	file, err := NewHosts(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	static, err := NewHosts("", map[string][]netip.Addr{"v6.example": {netip.MustParseAddr("2001:db8::2")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &fakeResolver{A: []netip.Addr{netip.MustParseAddr("198.51.100.1")}}
+	resolver := NewHostsResolver(upstream, static, nil, file)
+
+	tests := []struct {
+		name     string
+		strategy Strategy
+		A, AAAA  string
+		upstream bool
+	}{
+		{"dual.example", StrategyDefault, "192.0.2.1", "2001:db8::1", false},
+		{"dual.example", StrategyIPv4Only, "192.0.2.1", "", false},
+		{"dual.example", StrategyIPv6Only, "", "2001:db8::1", false},
+		// the first table with an address wins
+		{"v6.example", StrategyDefault, "", "2001:db8::2", false},
+		// no address of the strategy, asked upstream
+		{"v6.example", StrategyIPv4Only, "198.51.100.1", "", true},
+		{"v4.example", StrategyIPv6Only, "", "", true},
+		{"other.example", StrategyDefault, "198.51.100.1", "", true},
+	}
+	for _, tt := range tests {
+		lookups := upstream.lookups
+		A, AAAA, ttl, err := resolver.LookupTTL(context.Background(), tt.name, tt.strategy)
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.name, tt.strategy, err)
+		}
+		if got := joinAddresses(A); got != tt.A {
+			t.Errorf("%s %s: A %s, want %s", tt.name, tt.strategy, got, tt.A)
+		}
+		if got := joinAddresses(AAAA); got != tt.AAAA {
+			t.Errorf("%s %s: AAAA %s, want %s", tt.name, tt.strategy, got, tt.AAAA)
+		}
+		if asked := upstream.lookups != lookups; asked != tt.upstream {
+			t.Errorf("%s %s: asked upstream %v, want %v", tt.name, tt.strategy, asked, tt.upstream)
+		}
+		if !tt.upstream && ttl != constant.HostsCheckInterval {
+			t.Errorf("%s %s: ttl %s, want %s", tt.name, tt.strategy, ttl, constant.HostsCheckInterval)
+		}
+	}
+}
+
+func joinAddresses(addresses []netip.Addr) string {
+	var s []string
+	for _, addr := range addresses {
+		s = append(s, addr.String())
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,102 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	dnsMessageType = "application/dns-message"
+	// maxGetURLLength is the longest url sent with GET, larger queries are sent with POST
+	maxGetURLLength = 2048
+)
+
+// HTTPSClient is a DNS over HTTPS (RFC 8484) Exchanger.
+// Queries are sent with GET so that they can be cached by HTTP caches, or with POST
+// if they are too large for a url. HTTP/2 is used if the server supports it.
+type HTTPSClient struct {
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func NewHTTPSClient(dialer ContextDialer, endpoint *url.URL) *HTTPSClient {
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     &tls.Config{ServerName: endpoint.Hostname()},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: constant.ResolverDefaultReadTimeout,
+	}
+	return &HTTPSClient{
+		endpoint: endpoint,
+		client:   &http.Client{Transport: transport},
+	}
+}
+
+func (c *HTTPSClient) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, constant.ResolverDefaultReadTimeout)
+		defer cancel()
+	}
+	// RFC 8484 section 4.1, the id should be 0 to be cache friendly
+	query := request.Copy()
+	query.Id = 0
+	pack, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+
+	var httpRequest *http.Request
+	endpoint := *c.endpoint
+	values := endpoint.Query()
+	values.Set("dns", base64.RawURLEncoding.EncodeToString(pack))
+	endpoint.RawQuery = values.Encode()
+	if len(endpoint.String()) <= maxGetURLLength {
+		httpRequest, err = http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	} else {
+		httpRequest, err = http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint.String(), bytes.NewReader(pack))
+		if err == nil {
+			httpRequest.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	httpRequest.Header.Set("Accept", dnsMessageType)
+
+	response, err := c.client.Do(httpRequest)
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolve: server return http status %s", response.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	answer := new(dns.Msg)
+	if err = answer.Unpack(body); err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	answer.Id = request.Id
+	return answer, nil
+}
+
+// Close closes the idle connections.
+func (c *HTTPSClient) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
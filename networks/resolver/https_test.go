@@ -0,0 +1,85 @@
+package resolver
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHTTPSClient(t *testing.T) {
+	var methods []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" {
+			http.NotFound(w, r)
+			return
+		}
+		var pack []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			pack, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dnsMessageType {
+				http.Error(w, "content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			pack, err = io.ReadAll(r.Body)
+		}
+		query := new(dns.Msg)
+		if err == nil {
+			err = query.Unpack(pack)
+		}
+		if err != nil || query.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		methods = append(methods, r.Method)
+		answer, _ := replyA(query, 1).Pack()
+		w.Header().Set("Content-Type", dnsMessageType)
+		_, _ = w.Write(answer)
+	}))
+	defer server.Close()
+	endpoint, _ := url.Parse(server.URL + "/dns-query")
+	client := NewHTTPSClient(&net.Dialer{}, endpoint)
+	defer client.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	client.client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+
+	small := new(dns.Msg).SetQuestion("example.", dns.TypeA)
+	small.Id = 1
+	// padding makes the query too large for a GET url
+	large := new(dns.Msg).SetQuestion("example.", dns.TypeA)
+	large.Id = 2
+	large.SetEdns0(1232, false)
+	large.IsEdns0().Option = append(large.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, maxGetURLLength)})
+	for _, request := range []*dns.Msg{small, large} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		answer, err := client.Exchange(ctx, request)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if answer.Id != request.Id || len(answer.Answer) != 1 {
+			t.Errorf("answer %v, want the id %d and one record", answer, request.Id)
+		}
+	}
+	if len(methods) != 2 || methods[0] != http.MethodGet || methods[1] != http.MethodPost {
+		t.Errorf("methods %v, want GET then POST", methods)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client.endpoint.Path = "/missing"
+	if _, err := client.Exchange(ctx, small); err == nil {
+		t.Error("no error for a http status 404")
+	}
+}
@@ -0,0 +1,205 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"io"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// MultiMode decides how the servers of a MultiClient are queried.
+type MultiMode string
+
+const (
+	// MultiFailover queries the servers one by one in the given order until one answers.
+	MultiFailover MultiMode = "failover"
+	// MultiRace queries all servers at the same time, the first answer wins.
+	MultiRace MultiMode = "race"
+	// MultiRoundRobin starts from the next server on every query, and fails over to the others.
+	MultiRoundRobin MultiMode = "round_robin"
+)
+
+func (m MultiMode) IsValid() bool {
+	switch m {
+	case "", MultiFailover, MultiRace, MultiRoundRobin:
+		return true
+	default:
+		return false
+	}
+}
+
+// upstream is a server of a MultiClient with its health.
+type upstream struct {
+	client Exchanger
+
+	failures  atomic.Int32
+	downUntil atomic.Int64 // unix nano
+	latency   atomic.Int64 // moving average in nanoseconds, 0 if unknown
+}
+
+func (u *upstream) healthy(now time.Time) bool {
+	return now.UnixNano() >= u.downUntil.Load()
+}
+
+// report records the result of a query. A failed server is skipped for a while,
+// the while doubles on every failure in a row.
+func (u *upstream) report(err error, rtt time.Duration) {
+	if err != nil {
+		failures := u.failures.Add(1)
+		down := constant.ResolverServerDownTime << min(failures-1, 6)
+		u.downUntil.Store(time.Now().Add(min(down, constant.ResolverServerDownTimeMax)).UnixNano())
+		return
+	}
+	u.failures.Store(0)
+	u.downUntil.Store(0)
+	if old := u.latency.Load(); old > 0 {
+		u.latency.Store(old + (int64(rtt)-old)/8)
+	} else {
+		u.latency.Store(int64(rtt))
+	}
+}
+
+// timeout returns how long a query to the server is waited before the next server is tried.
+func (u *upstream) timeout() time.Duration {
+	latency := time.Duration(u.latency.Load())
+	if latency == 0 {
+		return constant.ResolverServerTimeout
+	}
+	return min(max(4*latency, constant.ResolverServerMinTimeout), constant.ResolverServerTimeout)
+}
+
+func (u *upstream) exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	answer, err := u.client.Exchange(ctx, request)
+	if err == nil && answer != nil && serverFailed(answer.Rcode) {
+		err = RcodeError(answer.Rcode)
+	}
+	var rcodeErr RcodeError
+	switch {
+	case errors.As(err, &rcodeErr) && !serverFailed(int(rcodeErr)):
+		// the server answered, nxdomain and so on are the same on every server
+		u.report(nil, time.Since(start))
+	case err != nil && ctx.Err() != nil && !errors.Is(ctx.Err(), context.DeadlineExceeded):
+		// canceled by the caller, or another server won the race
+	default:
+		u.report(err, time.Since(start))
+	}
+	return answer, err
+}
+
+func serverFailed(rcode int) bool {
+	return rcode == dns.RcodeServerFailure || rcode == dns.RcodeRefused
+}
+
+// MultiClient is an Exchanger of many servers. It tracks the health and latency of the servers,
+// servers that failed recently are queried after the others.
+type MultiClient struct {
+	mode      MultiMode
+	upstreams []*upstream
+	next      atomic.Uint32
+}
+
+func NewMultiClient(mode MultiMode, clients ...Exchanger) *MultiClient {
+	c := &MultiClient{mode: mode}
+	for _, client := range clients {
+		c.upstreams = append(c.upstreams, &upstream{client: client})
+	}
+	return c
+}
+
+func (c *MultiClient) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	if len(c.upstreams) == 0 {
+		return nil, errors.New("resolve: no dns server")
+	}
+	upstreams := c.candidates()
+	if c.mode == MultiRace {
+		return c.race(ctx, request, upstreams)
+	}
+
+	var errs []error
+	for i, u := range upstreams {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if i < len(upstreams)-1 {
+			// leave time for the next server
+			attemptCtx, cancel = context.WithTimeout(ctx, u.timeout())
+		}
+		answer, err := u.exchange(attemptCtx, request)
+		cancel()
+		var rcodeErr RcodeError
+		if err == nil || errors.As(err, &rcodeErr) && !serverFailed(int(rcodeErr)) {
+			return answer, err
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("resolve: all dns servers failed: %w", errors.Join(errs...))
+}
+
+// candidates returns all servers in the order to query, healthy servers first.
+func (c *MultiClient) candidates() []*upstream {
+	upstreams := c.upstreams
+	if c.mode == MultiRoundRobin {
+		start := int(c.next.Add(1)-1) % len(upstreams)
+		upstreams = slices.Concat(upstreams[start:], upstreams[:start])
+	}
+	now := time.Now()
+	var healthy, down []*upstream
+	for _, u := range upstreams {
+		if u.healthy(now) {
+			healthy = append(healthy, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	// the servers that are down are still tried after the healthy ones,
+	// the one that is back soonest first
+	slices.SortStableFunc(down, func(a, b *upstream) int {
+		return int(a.downUntil.Load() - b.downUntil.Load())
+	})
+	return append(healthy, down...)
+}
+
+func (c *MultiClient) race(ctx context.Context, request *dns.Msg, upstreams []*upstream) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		answer *dns.Msg
+		err    error
+	}
+	results := make(chan result, len(upstreams))
+	for _, u := range upstreams {
+		go func() {
+			answer, err := u.exchange(ctx, request.Copy())
+			results <- result{answer: answer, err: err}
+		}()
+	}
+	var errs []error
+	for range upstreams {
+		r := <-results
+		var rcodeErr RcodeError
+		if r.err == nil || errors.As(r.err, &rcodeErr) && !serverFailed(int(rcodeErr)) {
+			return r.answer, r.err
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, fmt.Errorf("resolve: all dns servers failed: %w", errors.Join(errs...))
+}
+
+// Close closes the servers.
+func (c *MultiClient) Close() error {
+	var errs []error
+	for _, u := range c.upstreams {
+		if closer, ok := u.client.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
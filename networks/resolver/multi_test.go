@@ -0,0 +1,48 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+// fakeExchanger answers every query with err, or with a reply if err is nil.
+type fakeExchanger struct {
+	err     error
+	queries int
+}
+
+func (e *fakeExchanger) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	e.queries++
+	if e.err != nil {
+		return nil, e.err
+	}
+	return new(dns.Msg).SetReply(request), nil
+}
+
+// TestMultiClientDownServer checks that a server that is down is still queried
+// once the healthy servers fail.
+func TestMultiClientDownServer(t *testing.T) {
+	for _, mode := range []MultiMode{MultiFailover, MultiRoundRobin} {
+		t.Run(string(mode), func(t *testing.T) {
+			down, healthy := &fakeExchanger{err: errors.New("down")}, &fakeExchanger{}
+			client := NewMultiClient(mode, down, healthy)
+			request := new(dns.Msg).SetQuestion("example.", dns.TypeA)
+			// the first server fails and is down from now on
+			for range 2 {
+				if _, err := client.Exchange(context.Background(), request); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if down.queries == 0 {
+				t.Fatal("the first server was never queried")
+			}
+
+			down.err, healthy.err = nil, errors.New("down")
+			if _, err := client.Exchange(context.Background(), request); err != nil {
+				t.Fatalf("the server that is down was not tried after the healthy one failed: %v", err)
+			}
+		})
+	}
+}
@@ -5,9 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"github.com/miekg/dns"
-	"math/rand/v2"
 	"net"
 	"net/netip"
+	"time"
 )
 
 type Strategy uint8
@@ -63,6 +63,18 @@ type Resolver interface {
 	Lookup(ctx context.Context, fqdn string, strategy Strategy) (A []netip.Addr, AAAA []netip.Addr, err error)
 }
 
+// TTLResolver is a Resolver that also reports how long its answer is valid,
+// ttl is 0 if unknown.
+type TTLResolver interface {
+	Resolver
+	LookupTTL(ctx context.Context, fqdn string, strategy Strategy) (A []netip.Addr, AAAA []netip.Addr, ttl time.Duration, err error)
+}
+
+// ContextDialer dials the connections to dns servers, such as *net.Dialer.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
 type Exchanger interface {
 	Exchange(ctx context.Context, msg *dns.Msg) (answer *dns.Msg, err error)
 }
@@ -103,7 +115,7 @@ func (s *SystemResolver) Lookup(ctx context.Context, fqdn string, strategy Strat
 			AAAA = append(AAAA, netipip)
 		}
 	}
-	return randomSortAddresses(A), randomSortAddresses(AAAA), nil
+	return A, AAAA, nil
 }
 
 func MessageToAddresses(response *dns.Msg) (address []netip.Addr, err error) {
@@ -170,18 +182,6 @@ func FqdnToQuestion(fqdn string, strategy Strategy) []dns.Question {
 	}
 }
 
-func randomSortAddresses(raw []netip.Addr) []netip.Addr {
-	if len(raw) <= 1 {
-		return raw
-	}
-	var copied []netip.Addr
-	copy(copied, raw)
-	rand.Shuffle(len(copied), func(i, j int) {
-		copied[i], copied[j] = copied[j], copied[i]
-	})
-	return copied
-}
-
 type RcodeError int
 
 func (e RcodeError) Error() string {
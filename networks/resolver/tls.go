@@ -0,0 +1,276 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"io"
+	"net"
+	"sync"
+)
+
+// TLSClient is a DNS over TLS (RFC 7858) Exchanger.
+// Queries share one connection and are pipelined, responses are matched by id.
+type TLSClient struct {
+	dialer      ContextDialer
+	destination string
+	config      *tls.Config
+	// ctx bounds the dials, it is canceled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	access  sync.Mutex
+	conn    *pipelineConn
+	dialing *tlsDial
+}
+
+// tlsDial is a dial in progress, the callers of getConn share it.
+type tlsDial struct {
+	done chan struct{}
+	conn *pipelineConn
+	err  error
+}
+
+func NewTLSClient(dialer ContextDialer, destination string, serverName string) *TLSClient {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TLSClient{
+		dialer:      dialer,
+		destination: destination,
+		config: &tls.Config{
+			ServerName: serverName,
+			NextProtos: []string{"dot"},
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (c *TLSClient) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, constant.ResolverDefaultReadTimeout)
+		defer cancel()
+	}
+	conn, reused, err := c.getConn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	answer, err := conn.exchange(ctx, request)
+	if err != nil && reused && errors.Is(err, errConnClosed) {
+		// the server closed an idle connection, retry on a new one
+		conn, _, err = c.getConn(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("resolve: %w", err)
+		}
+		answer, err = conn.exchange(ctx, request)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolve: %w", err)
+	}
+	return answer, nil
+}
+
+// getConn returns the shared connection, it dials a new one if there is none or it is closed.
+// The dial runs without the lock and is shared by the callers that wait for it,
+// a caller that gives up does not cancel it for the others.
+func (c *TLSClient) getConn(ctx context.Context) (*pipelineConn, bool, error) {
+	c.access.Lock()
+	if c.conn != nil && !c.conn.isClosed() {
+		c.access.Unlock()
+		return c.conn, true, nil
+	}
+	if c.ctx.Err() != nil {
+		c.access.Unlock()
+		return nil, false, net.ErrClosed
+	}
+	call := c.dialing
+	if call == nil {
+		call = &tlsDial{done: make(chan struct{})}
+		c.dialing = call
+		go c.dial(call)
+	}
+	c.access.Unlock()
+	select {
+	case <-call.done:
+		return call.conn, false, call.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+func (c *TLSClient) dial(call *tlsDial) {
+	defer close(call.done)
+	ctx, cancel := context.WithTimeout(c.ctx, constant.ResolverDefaultReadTimeout)
+	defer cancel()
+	var tlsConn *tls.Conn
+	raw, err := c.dialer.DialContext(ctx, "tcp", c.destination)
+	if err == nil {
+		tlsConn = tls.Client(raw, c.config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+		}
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.dialing = nil
+	if err != nil {
+		call.err = err
+		return
+	}
+	if c.ctx.Err() != nil {
+		// closed during the dial
+		tlsConn.Close()
+		call.err = net.ErrClosed
+		return
+	}
+	c.conn = newPipelineConn(tlsConn)
+	call.conn = c.conn
+}
+
+var errConnClosed = errors.New("connection closed")
+
+// pipelineConn sends length prefixed dns messages (RFC 1035 section 4.2.2) over a stream,
+// many queries may be in flight.
+type pipelineConn struct {
+	conn net.Conn
+
+	writeAccess sync.Mutex
+
+	access  sync.Mutex
+	pending map[uint16]chan *dns.Msg
+	nextId  uint16
+	closed  chan struct{}
+	err     error
+}
+
+func newPipelineConn(conn net.Conn) *pipelineConn {
+	c := &pipelineConn{
+		conn:    conn,
+		pending: make(map[uint16]chan *dns.Msg),
+		nextId:  dns.Id(),
+		closed:  make(chan struct{}),
+	}
+	go c.loopRead()
+	return c
+}
+
+func (c *pipelineConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *pipelineConn) exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	// ids of the client are unique per connection only, use our own
+	query := request.Copy()
+	result := make(chan *dns.Msg, 1)
+	c.access.Lock()
+	if c.isClosed() {
+		c.access.Unlock()
+		return nil, errConnClosed
+	}
+	for {
+		c.nextId++
+		if _, ok := c.pending[c.nextId]; !ok {
+			break
+		}
+	}
+	query.Id = c.nextId
+	c.pending[query.Id] = result
+	c.access.Unlock()
+	defer func() {
+		c.access.Lock()
+		delete(c.pending, query.Id)
+		c.access.Unlock()
+	}()
+
+	pack, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	frame := make([]byte, 2+len(pack))
+	binary.BigEndian.PutUint16(frame, uint16(len(pack)))
+	copy(frame[2:], pack)
+
+	c.writeAccess.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetWriteDeadline(deadline)
+	}
+	_, err = c.conn.Write(frame)
+	c.writeAccess.Unlock()
+	if err != nil {
+		c.close(err)
+		return nil, errConnClosed
+	}
+
+	select {
+	case answer := <-result:
+		answer.Id = request.Id
+		return answer, nil
+	case <-c.closed:
+		return nil, errors.Join(errConnClosed, c.err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *pipelineConn) loopRead() {
+	var err error
+	defer func() {
+		c.close(err)
+	}()
+	var length [2]byte
+	for {
+		if _, err = io.ReadFull(c.conn, length[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err = io.ReadFull(c.conn, buf); err != nil {
+			return
+		}
+		answer := new(dns.Msg)
+		if err = answer.Unpack(buf); err != nil {
+			return
+		}
+		c.access.Lock()
+		result, ok := c.pending[answer.Id]
+		c.access.Unlock()
+		if ok {
+			// buffered, the waiter may be gone already
+			select {
+			case result <- answer:
+			default:
+			}
+		}
+	}
+}
+
+func (c *pipelineConn) close(err error) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.isClosed() {
+		return
+	}
+	c.err = err
+	close(c.closed)
+	_ = c.conn.Close()
+}
+
+// Close closes the shared connection.
+func (c *TLSClient) Close() error {
+	c.cancel()
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.conn != nil {
+		c.conn.close(net.ErrClosed)
+		c.conn = nil
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"github.com/miekg/dns"
+	"io"
+	"math/big"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for 127.0.0.1 and the pool that trusts it.
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots
+}
+
+// startTLSServer serves every accepted connection with serve, n counts the connections from 0.
+func startTLSServer(t *testing.T, serve func(conn net.Conn, n int)) (*TLSClient, *atomic.Int32) {
+	t.Helper()
+	certificate, roots := testCertificate(t)
+	listener, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{certificate}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn, int(accepted.Add(1)-1))
+			}()
+		}
+	}()
+	client := NewTLSClient(&net.Dialer{}, listener.Addr().String(), "127.0.0.1")
+	client.config.RootCAs = roots
+	t.Cleanup(func() { client.Close() })
+	return client, &accepted
+}
+
+func readFrame(conn net.Conn) (*dns.Msg, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	message := new(dns.Msg)
+	return message, message.Unpack(buf)
+}
+
+func writeFrame(conn net.Conn, message *dns.Msg) error {
+	pack, err := message.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(pack))))
+	if err == nil {
+		_, err = conn.Write(pack)
+	}
+	return err
+}
+
+// replyA answers request with one A record, the address is 192.0.2.n.
+func replyA(request *dns.Msg, n byte) *dns.Msg {
+	reply := new(dns.Msg).SetReply(request)
+	reply.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, n),
+	}}
+	return reply
+}
+
+func answerAddr(t *testing.T, answer *dns.Msg) netip.Addr {
+	t.Helper()
+	if len(answer.Answer) != 1 {
+		t.Fatalf("%d answers, want 1", len(answer.Answer))
+	}
+	addr, _ := netip.AddrFromSlice(answer.Answer[0].(*dns.A).A)
+	return addr.Unmap()
+}
+
+// TestTLSClientPipeline sends two queries with the same id on one connection,
+// the server answers them in reverse order.
+func TestTLSClientPipeline(t *testing.T) {
+	client, accepted := startTLSServer(t, func(conn net.Conn, n int) {
+		var queries []*dns.Msg
+		for range 2 {
+			query, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			queries = append(queries, query)
+		}
+		if queries[0].Id == queries[1].Id {
+			// the answers could not be told apart
+			return
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			// the name tells the address of the answer
+			_ = writeFrame(conn, replyA(queries[i], byte(len(queries[i].Question[0].Name))))
+		}
+	})
+	names := []string{"a.example.", "bb.example."}
+	results := make(chan error, len(names))
+	for _, name := range names {
+		go func() {
+			request := new(dns.Msg).SetQuestion(name, dns.TypeA)
+			request.Id = 1
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			answer, err := client.Exchange(ctx, request)
+			if err == nil && (answer.Id != 1 || answer.Question[0].Name != name || len(answer.Answer) != 1 ||
+				!answer.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, byte(len(name))))) {
+				err = errors.New("answer of " + name + " does not match: " + answer.String())
+			}
+			results <- err
+		}()
+	}
+	for range names {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("%d connections, want the queries pipelined on 1", n)
+	}
+}
+
+// TestTLSClientRetryClosed checks that a query is sent again on a new connection
+// when the server closed the idle one.
+func TestTLSClientRetryClosed(t *testing.T) {
+	client, accepted := startTLSServer(t, func(conn net.Conn, n int) {
+		for i := 0; ; i++ {
+			query, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			if n == 0 && i == 1 {
+				// the idle timeout of the server, the query is dropped
+				return
+			}
+			_ = writeFrame(conn, replyA(query, byte(n+1)))
+		}
+	})
+	for i, want := range []byte{1, 2} {
+		request := new(dns.Msg).SetQuestion("example.", dns.TypeA)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		answer, err := client.Exchange(ctx, request)
+		cancel()
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if addr := answerAddr(t, answer); addr != netip.AddrFrom4([4]byte{192, 0, 2, want}) {
+			t.Errorf("query %d answered with %s, want the connection %d", i, addr, want)
+		}
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+// gatedDialer holds the dials until gate is closed.
+type gatedDialer struct {
+	gate  chan struct{}
+	dials atomic.Int32
+}
+
+func (d *gatedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dials.Add(1)
+	<-d.gate
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+// TestTLSClientSharedDial checks that concurrent queries share one dial,
+// and that the dial survives the caller that started it giving up.
+func TestTLSClientSharedDial(t *testing.T) {
+	client, accepted := startTLSServer(t, func(conn net.Conn, n int) {
+		for {
+			query, err := readFrame(conn)
+			if err != nil {
+				return
+			}
+			_ = writeFrame(conn, replyA(query, 1))
+		}
+	})
+	dialer := &gatedDialer{gate: make(chan struct{})}
+	client.dialer = dialer
+	request := new(dns.Msg).SetQuestion("example.", dns.TypeA)
+
+	first, cancel := context.WithCancel(context.Background())
+	failed := make(chan error, 1)
+	go func() {
+		_, err := client.Exchange(first, request)
+		failed <- err
+	}()
+	for dialer.dials.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	results := make(chan error, 3)
+	for range cap(results) {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_, err := client.Exchange(ctx, request)
+			results <- err
+		}()
+	}
+	cancel()
+	if err := <-failed; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled query: %v, want %v", err, context.Canceled)
+	}
+	close(dialer.gate)
+	for range cap(results) {
+		if err := <-results; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := dialer.dials.Load(); n != 1 {
+		t.Errorf("%d dials, want 1", n)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
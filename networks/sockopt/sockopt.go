@@ -0,0 +1,71 @@
+package sockopt
+
+import (
+	"cmp"
+	"github.com/sagernet/sing/common/control"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"net"
+	"strings"
+	"time"
+)
+
+// Options are the socket level options shared by listeners and dialers.
+// Zero values leave the kernel or Go defaults untouched.
+type Options struct {
+	// tcp keepalive, zero values fall back to constant.KeepAlive*
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+
+	// NoDelay overrides TCP_NODELAY, which Go enables by default
+	NoDelay *bool
+	// SO_RCVBUF/SO_SNDBUF in bytes
+	ReceiveBuffer int
+	SendBuffer    int
+	// TCP_USER_TIMEOUT
+	UserTimeout time.Duration
+	// TCP_CONGESTION, e.g: bbr
+	Congestion string
+	// TCP_NOTSENT_LOWAT in bytes
+	NotSentLowat int
+	// IP_TOS/IPV6_TCLASS, the DSCP value is TOS >> 2
+	TOS int
+}
+
+func (o Options) KeepAliveConfig() net.KeepAliveConfig {
+	return net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     cmp.Or(o.KeepAliveIdle, constant.KeepAliveInitial),
+		Interval: cmp.Or(o.KeepAliveInterval, constant.KeepAliveInterval),
+		Count:    cmp.Or(o.KeepAliveCount, constant.KeepAliveProbeCount),
+	}
+}
+
+// Control returns the control function setting the options before bind or connect,
+// or nil if there is nothing to set.
+func (o Options) Control() control.Func {
+	if o.ReceiveBuffer == 0 && o.SendBuffer == 0 && o.UserTimeout == 0 &&
+		o.Congestion == "" && o.NotSentLowat == 0 && o.TOS == 0 {
+		return nil
+	}
+	return o.control
+}
+
+// Apply sets the options which Go overrides after a connection is created.
+func (o Options) Apply(conn net.Conn) error {
+	if o.NoDelay == nil {
+		return nil
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		return tcpConn.SetNoDelay(*o.NoDelay)
+	}
+	return nil
+}
+
+func isTCP(network string) bool {
+	return strings.HasPrefix(network, "tcp")
+}
+
+func isIPv6(network string) bool {
+	return strings.HasSuffix(network, "6")
+}
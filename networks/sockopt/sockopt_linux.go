@@ -0,0 +1,50 @@
+package sockopt
+
+import (
+	"github.com/sagernet/sing/common/control"
+	"golang.org/x/sys/unix"
+	"os"
+	"syscall"
+)
+
+func (o Options) control(network, address string, conn syscall.RawConn) error {
+	return control.Raw(conn, func(fd uintptr) error {
+		var (
+			sock = int(fd)
+			err  error
+		)
+		set := func(level, name, value int) {
+			if err == nil {
+				err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(sock, level, name, value))
+			}
+		}
+		if o.ReceiveBuffer > 0 {
+			set(unix.SOL_SOCKET, unix.SO_RCVBUF, o.ReceiveBuffer)
+		}
+		if o.SendBuffer > 0 {
+			set(unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer)
+		}
+		if o.TOS > 0 {
+			if isIPv6(network) {
+				set(unix.IPPROTO_IPV6, unix.IPV6_TCLASS, o.TOS)
+				// ipv4-mapped traffic of a dual stack socket, fails on ipv6 only sockets
+				_ = unix.SetsockoptInt(sock, unix.IPPROTO_IP, unix.IP_TOS, o.TOS)
+			} else {
+				set(unix.IPPROTO_IP, unix.IP_TOS, o.TOS)
+			}
+		}
+		if !isTCP(network) {
+			return err
+		}
+		if o.UserTimeout > 0 {
+			set(unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.UserTimeout.Milliseconds()))
+		}
+		if o.NotSentLowat > 0 {
+			set(unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT, o.NotSentLowat)
+		}
+		if o.Congestion != "" && err == nil {
+			err = os.NewSyscallError("setsockopt", unix.SetsockoptString(sock, unix.IPPROTO_TCP, unix.TCP_CONGESTION, o.Congestion))
+		}
+		return err
+	})
+}
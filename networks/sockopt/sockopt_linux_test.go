@@ -0,0 +1,204 @@
+package sockopt_test
+
+import (
+	"context"
+	"errors"
+	"github.com/woshikedayaa/traffics/networks/dialer"
+	"github.com/woshikedayaa/traffics/networks/sockopt"
+	"golang.org/x/sys/unix"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func getsockopt(t *testing.T, conn net.Conn, get func(fd int) (int, error)) int {
+	t.Helper()
+	raw, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	if cerr := raw.Control(func(fd uintptr) { value, err = get(int(fd)) }); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func getInt(level, name int) func(fd int) (int, error) {
+	return func(fd int) (int, error) {
+		return unix.GetsockoptInt(fd, level, name)
+	}
+}
+
+// TestDialerOptions checks that every option of a dialer reaches the sockets of both families,
+// the interface is checked by TestDialerInterface.
+func TestDialerOptions(t *testing.T) {
+	noDelay := false
+	config := dialer.DialConfig{
+		BindAddress4: netip.MustParseAddr("127.0.0.1"),
+		BindAddress6: netip.MustParseAddr("::1"),
+		FwMark:       0x1234,
+		Socket: sockopt.Options{
+			KeepAliveIdle:     42 * time.Second,
+			KeepAliveInterval: 7 * time.Second,
+			KeepAliveCount:    5,
+			NoDelay:           &noDelay,
+			ReceiveBuffer:     64 * 1024,
+			SendBuffer:        64 * 1024,
+			UserTimeout:       3 * time.Second,
+			Congestion:        "reno",
+			NotSentLowat:      16 * 1024,
+			TOS:               0xb8,
+		},
+	}
+	d, err := dialer.NewDefault(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range []struct {
+		network string
+		address string
+		bind    netip.Addr
+		tos     func(fd int) (int, error)
+	}{
+		{"4", "127.0.0.1", config.BindAddress4, getInt(unix.IPPROTO_IP, unix.IP_TOS)},
+		{"6", "::1", config.BindAddress6, getInt(unix.IPPROTO_IPV6, unix.IPV6_TCLASS)},
+	} {
+		t.Run("tcp"+family.network, func(t *testing.T) {
+			listener, err := net.Listen("tcp"+family.network, net.JoinHostPort(family.address, "0"))
+			if err != nil {
+				t.Skipf("listen: %v", err)
+			}
+			defer listener.Close()
+			conn, err := d.DialContext(context.Background(), "tcp"+family.network, listener.Addr().String())
+			if errors.Is(err, unix.EPERM) {
+				t.Skipf("dial needs CAP_NET_ADMIN for the fwmark: %v", err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err = config.Socket.Apply(conn); err != nil {
+				t.Fatal(err)
+			}
+			checkCommon(t, conn, family.bind, config, family.tos)
+			for _, tt := range []struct {
+				name  string
+				get   func(fd int) (int, error)
+				check func(int) bool
+			}{
+				{"SO_KEEPALIVE", getInt(unix.SOL_SOCKET, unix.SO_KEEPALIVE), equal(1)},
+				{"TCP_KEEPIDLE", getInt(unix.IPPROTO_TCP, unix.TCP_KEEPIDLE), equal(42)},
+				{"TCP_KEEPINTVL", getInt(unix.IPPROTO_TCP, unix.TCP_KEEPINTVL), equal(7)},
+				{"TCP_KEEPCNT", getInt(unix.IPPROTO_TCP, unix.TCP_KEEPCNT), equal(5)},
+				{"TCP_NODELAY", getInt(unix.IPPROTO_TCP, unix.TCP_NODELAY), equal(0)},
+				{"TCP_USER_TIMEOUT", getInt(unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT), equal(3000)},
+				{"TCP_NOTSENT_LOWAT", getInt(unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT), equal(16 * 1024)},
+			} {
+				if value := getsockopt(t, conn, tt.get); !tt.check(value) {
+					t.Errorf("%s is %d", tt.name, value)
+				}
+			}
+			raw, _ := conn.(syscall.Conn).SyscallConn()
+			var congestion string
+			_ = raw.Control(func(fd uintptr) {
+				congestion, err = unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+			})
+			if err != nil || congestion != config.Socket.Congestion {
+				t.Errorf("TCP_CONGESTION is %q, %v", congestion, err)
+			}
+		})
+		t.Run("udp"+family.network, func(t *testing.T) {
+			conn, err := d.DialContext(context.Background(), "udp"+family.network, net.JoinHostPort(family.address, "53"))
+			if errors.Is(err, unix.EPERM) {
+				t.Skipf("dial needs CAP_NET_ADMIN for the fwmark: %v", err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			checkCommon(t, conn, family.bind, config, family.tos)
+		})
+	}
+}
+
+func equal(want int) func(int) bool {
+	return func(value int) bool { return value == want }
+}
+
+// checkCommon checks the options of tcp and udp sockets.
+func checkCommon(t *testing.T, conn net.Conn, bind netip.Addr, config dialer.DialConfig, tos func(fd int) (int, error)) {
+	t.Helper()
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil || local.Addr().Unmap() != bind {
+		t.Errorf("local address is %s, want %s", conn.LocalAddr(), bind)
+	}
+	for _, tt := range []struct {
+		name  string
+		get   func(fd int) (int, error)
+		check func(int) bool
+	}{
+		{"SO_MARK", getInt(unix.SOL_SOCKET, unix.SO_MARK), equal(int(config.FwMark))},
+		// the kernel doubles the buffer sizes for its bookkeeping
+		{"SO_RCVBUF", getInt(unix.SOL_SOCKET, unix.SO_RCVBUF), equal(2 * config.Socket.ReceiveBuffer)},
+		{"SO_SNDBUF", getInt(unix.SOL_SOCKET, unix.SO_SNDBUF), equal(2 * config.Socket.SendBuffer)},
+		{"IP_TOS", tos, equal(config.Socket.TOS)},
+	} {
+		if value := getsockopt(t, conn, tt.get); !tt.check(value) {
+			t.Errorf("%s is %d", tt.name, value)
+		}
+	}
+}
+
+// TestDialerInterface checks that the sockets of a dialer are bound to its interface.
+// Loopback destinations are never bound, so a neighbour of the first interface with
+// an address is dialed over udp, whose connect sends nothing.
+func TestDialerInterface(t *testing.T) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, iif := range interfaces {
+		if iif.Flags&net.FlagUp == 0 || iif.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addresses, _ := iif.Addrs()
+		for _, address := range addresses {
+			prefix, err := netip.ParsePrefix(address.String())
+			if err != nil || !prefix.Addr().Is4() || prefix.Bits() > 30 {
+				continue
+			}
+			neighbour := prefix.Masked().Addr().Next()
+			if neighbour == prefix.Addr() {
+				neighbour = neighbour.Next()
+			}
+			d, err := dialer.NewDefault(dialer.DialConfig{Interface: iif.Name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := d.DialContext(context.Background(), "udp4", netip.AddrPortFrom(neighbour, 53).String())
+			if errors.Is(err, unix.EPERM) {
+				t.Skipf("dial needs CAP_NET_RAW to bind to an interface: %v", err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			raw, _ := conn.(syscall.Conn).SyscallConn()
+			var device string
+			_ = raw.Control(func(fd uintptr) {
+				device, err = unix.GetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE)
+			})
+			if err != nil || device != iif.Name {
+				t.Errorf("SO_BINDTODEVICE is %q, %v, want %s", device, err, iif.Name)
+			}
+			return
+		}
+	}
+	t.Skip("no interface with an ipv4 address to bind to")
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package sockopt
+
+import (
+	"errors"
+	"syscall"
+)
+
+func (o Options) control(network, address string, conn syscall.RawConn) error {
+	return errors.New("socket options other than keepalive and nodelay are only supported on Linux")
+}
@@ -5,16 +5,20 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/sagernet/sing/common/bufio"
+	"github.com/woshikedayaa/traffics/networks/backend"
 	"github.com/woshikedayaa/traffics/networks/constant"
 	"github.com/woshikedayaa/traffics/networks/dialer"
 	"github.com/woshikedayaa/traffics/networks/listener"
+	"github.com/woshikedayaa/traffics/networks/pool"
+	"github.com/woshikedayaa/traffics/networks/relay"
 	"github.com/woshikedayaa/traffics/networks/resolver"
+	"io"
 	"log/slog"
 	"math/rand"
 	"net"
 	"net/netip"
 	"os"
+	"slices"
 	"strconv"
 	"sync"
 	"syscall"
@@ -32,9 +36,13 @@ type Traffics struct {
 	listeners *ListenManager
 
 	nameToDialer map[string]struct {
-		address string
-		dialer  dialer.Dialer
+		address  string
+		dialer   dialer.Dialer
+		pool     *pool.Pool
+		backends *backend.Set
 	}
+	// dnsUpstreams is the caching Exchanger of the remotes of dns binds, by remote name
+	dnsUpstreams map[string]*resolver.CachedExchanger
 
 	// udpConnTrack *cache.LruCache[netip.AddrPort, *net.UDPConn]
 	udpConnTrack *sync.Map
@@ -47,9 +55,12 @@ func NewTraffics(ctx context.Context, config Config) (*Traffics, error) {
 	t.cancel = cancel
 	t.config = config
 	t.nameToDialer = make(map[string]struct {
-		address string
-		dialer  dialer.Dialer
+		address  string
+		dialer   dialer.Dialer
+		pool     *pool.Pool
+		backends *backend.Set
 	})
+	t.dnsUpstreams = make(map[string]*resolver.CachedExchanger)
 	t.listeners = NewListenManager()
 	t.udpConnTrack = &sync.Map{}
 
@@ -69,9 +80,19 @@ func NewTraffics(ctx context.Context, config Config) (*Traffics, error) {
 func (t *Traffics) Close() error {
 	t.cancel()
 	t.listeners.CloseAll()
+	for name, remote := range t.nameToDialer {
+		if remote.backends != nil {
+			remote.backends.Close()
+		}
+		if remote.pool == nil {
+			continue
+		}
+		remote.pool.Close()
+		t.logPoolStats("connection pool closed", name, remote.pool.Stats())
+	}
 	t.udpConnTrack.Range(func(key, value any) bool {
-		if conn, ok := value.(*net.UDPConn); ok {
-			conn.Close()
+		if session, ok := value.(*udpSession); ok {
+			session.Close()
 		}
 		return true
 	})
@@ -89,6 +110,30 @@ func (t *Traffics) Start() error {
 
 func (t *Traffics) initDialer() error {
 	var systemResolver resolver.Resolver = resolver.NewSystemResolver()
+	var globalHosts *resolver.Hosts
+	if t.config.Hosts.File != "" || len(t.config.Hosts.Static) > 0 {
+		hosts, err := resolver.NewHosts(t.config.Hosts.File, t.config.Hosts.Static)
+		if err != nil {
+			return err
+		}
+		globalHosts = hosts
+	}
+	if err := t.config.DNSCache.valid(); err != nil {
+		return err
+	}
+	// remotes with the same dns servers share the cache
+	type cachedDNS struct {
+		exchanger resolver.Exchanger
+		resolver  *resolver.CachedResolver
+	}
+	caches := make(map[string]cachedDNS)
+	// connection pools only serve tcp forwards
+	pooled := make(map[string]bool)
+	for _, b := range t.config.Binds {
+		if b.Mode != constant.BindModeDNS && b.Network.ToProtocolList().Contain(string(constant.ProtocolTCP)) {
+			pooled[b.Remote] = true
+		}
+	}
 	// build dialer first
 	for _, v := range t.config.Remote {
 		if v.Name == "" {
@@ -101,9 +146,41 @@ func (t *Traffics) initDialer() error {
 		}
 		realResolvePolicy := v.ResolveStrategy
 		realResolver := systemResolver
-		if v.DNS != "" {
-			realResolver = resolver.NewCachedResolverDefault(
-				resolver.NewRawClient(net.Dialer{}, v.DNS))
+		var exchanger resolver.Exchanger
+		dnsKey := fmt.Sprint(v.DNS, v.DNSMode, v.DNSUDPSize)
+		if cached, ok := caches[dnsKey]; ok {
+			exchanger, realResolver = cached.exchanger, cached.resolver
+		} else if len(v.DNS) > 0 {
+			clients := make([]resolver.Exchanger, 0, len(v.DNS))
+			for _, server := range v.DNS {
+				client, err := resolver.NewClient(&net.Dialer{}, server, v.DNSUDPSize)
+				if err != nil {
+					return fmt.Errorf("remote %s: %w", v.Name, err)
+				}
+				clients = append(clients, client)
+			}
+			exchanger = clients[0]
+			if len(clients) > 1 {
+				exchanger = resolver.NewMultiClient(v.DNSMode, clients...)
+			}
+			cachedResolver := resolver.NewCachedResolver(exchanger, t.config.DNSCache.Options())
+			caches[dnsKey] = cachedDNS{exchanger: exchanger, resolver: cachedResolver}
+			realResolver = cachedResolver
+		}
+		if len(v.Hosts) > 0 || globalHosts != nil {
+			var remoteHosts *resolver.Hosts
+			if len(v.Hosts) > 0 {
+				// a static table never fails to load
+				remoteHosts, _ = resolver.NewHosts("", v.Hosts)
+			}
+			realResolver = resolver.NewHostsResolver(realResolver, remoteHosts, globalHosts)
+		}
+		nat64Prefix := cmp.Or(v.NAT64Prefix, resolver.NAT64WellKnownPrefix)
+		if v.DNS64 {
+			realResolver = resolver.NewDNS64Resolver(realResolver, nat64Prefix)
+		}
+		if !v.NAT64 {
+			nat64Prefix = netip.Prefix{}
 		}
 		var bind4, bind6 netip.Addr
 		bind4 = v.BindAddress4
@@ -115,24 +192,126 @@ func (t *Traffics) initDialer() error {
 			Interface:       v.Interface,
 			BindAddress4:    bind4,
 			BindAddress6:    bind6,
+			SourcePrefixes4: v.BindAddresses4,
+			SourcePrefixes6: v.BindAddresses6,
+			SourceSelection: v.BindSelect,
 			FwMark:          v.FwMark,
 			ReuseAddr:       v.ReuseAddr,
+			Socket:          v.SocketConfig.Options(),
+			AttemptDelay:    v.AttemptDelay,
+			ResolutionDelay: v.ResolutionDelay,
+			MaxAttempts:     v.MaxAttempts,
+			AddressOrder:    v.AddressOrder,
+			Retries:         v.Retries,
+			AttemptTimeout:  v.AttemptTimeout,
+			RetryBackoff:    v.RetryBackoff,
+			RetryBackoffMax: v.RetryBackoffMax,
 			TFO:             v.TFO,
 			MPTCP:           v.MPTCP,
 			UDPFragment:     v.UDPFragment,
 			ResolveStrategy: realResolvePolicy,
+			NAT64Prefix:     nat64Prefix,
 		})
 		if err != nil {
 			return err
 		}
+		address := net.JoinHostPort(v.Server, strconv.FormatUint(uint64(v.Port), 10))
+		var (
+			remoteDialer dialer.Dialer = dd
+			backends     *backend.Set
+			source       backend.Source
+			healthCheck  = v.HealthCheckInterval
+		)
+		if v.SRV != "" {
+			// the address only names the remote, dials go to the backends
+			address = "srv://" + v.SRV
+			if exchanger == nil {
+				exchanger, err = resolver.NewSystemClient(&net.Dialer{})
+				if err != nil {
+					return fmt.Errorf("remote %s: %w", v.Name, err)
+				}
+			}
+			srv := &backend.SRVSource{Name: v.SRV, Exchanger: exchanger, Resolver: realResolver, Strategy: realResolvePolicy}
+			if protocol := srv.Protocol(); protocol != "tcp" {
+				// active health checks connect over tcp, which says nothing of other services
+				if healthCheck > 0 {
+					t.logger.Warn("active health checks are tcp only, skipped for the srv service",
+						slog.String("remote", v.Name), slog.String("protocol", protocol))
+				}
+				healthCheck = 0
+			}
+			source = srv
+		} else if _, err := netip.ParseAddr(v.Server); v.Backends && err != nil {
+			source = &backend.HostSource{Host: v.Server, Port: v.Port, Resolver: realResolver, Strategy: realResolvePolicy}
+		}
+		if source != nil {
+			name := v.Name
+			backends = backend.New(t.ctx, backend.Options{
+				Source:      source,
+				Fallback:    v.SRV == "",
+				HealthCheck: healthCheck,
+				Check: func(ctx context.Context, addr netip.AddrPort) error {
+					conn, err := dd.DialContext(ctx, string(constant.ProtocolTCP), addr.String())
+					if err == nil {
+						conn.Close()
+					}
+					return err
+				},
+				OnChange: func(_ []netip.AddrPort, removed []netip.AddrPort) {
+					if len(removed) > 0 {
+						t.migrateUdpSessions(name, removed, remoteDialer, address)
+					}
+				},
+				Logger: t.logger.With(slog.String("remote", name)),
+			})
+			remoteDialer = backend.NewDialer(dd, backends, address)
+			backends.Start()
+		}
+		var connPool *pool.Pool
+		if v.PoolSize > 0 && pooled[v.Name] {
+			connPool = pool.New(t.ctx, func(ctx context.Context) (net.Conn, error) {
+				return remoteDialer.DialContext(ctx, string(constant.ProtocolTCP), address)
+			}, pool.Options{
+				Size:        v.PoolSize,
+				IdleTimeout: cmp.Or(v.PoolIdleTimeout, constant.PoolDefaultIdleTimeout),
+			})
+			connPool.Start()
+			go t.watchPool(v.Name, connPool)
+		}
 		t.nameToDialer[v.Name] = struct {
-			address string
-			dialer  dialer.Dialer
-		}{address: net.JoinHostPort(v.Server, strconv.FormatUint(uint64(v.Port), 10)), dialer: dd}
+			address  string
+			dialer   dialer.Dialer
+			pool     *pool.Pool
+			backends *backend.Set
+		}{address: address, dialer: remoteDialer, pool: connPool, backends: backends}
 	}
 	return nil
 }
 
+// watchPool logs the stats of the pool of a remote periodically, if they changed.
+func (t *Traffics) watchPool(name string, p *pool.Pool) {
+	ticker := time.NewTicker(constant.PoolStatsInterval)
+	defer ticker.Stop()
+	var last pool.Stats
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if stats := p.Stats(); stats != last {
+			last = stats
+			t.logPoolStats("connection pool stats", name, stats)
+		}
+	}
+}
+
+func (t *Traffics) logPoolStats(msg string, name string, stats pool.Stats) {
+	t.logger.Info(msg, slog.String("remote", name),
+		slog.Uint64("hits", stats.Hits), slog.Uint64("misses", stats.Misses),
+		slog.Uint64("evicted", stats.Evicted))
+}
+
 func (t *Traffics) initListener() error {
 	// parse listener
 	for _, v := range t.config.Binds {
@@ -154,30 +333,41 @@ func (t *Traffics) initListener() error {
 			return fmt.Errorf("no remote with name: %s", v.Remote)
 		}
 
+		var (
+			enableUDP     = protocols.Contain(string(constant.ProtocolUDP))
+			enableTCP     = protocols.Contain(string(constant.ProtocolTCP))
+			packetHandler listener.PacketHandlerOOb
+			connHandler   listener.ConnHandler
+		)
+		if v.Mode == constant.BindModeDNS {
+			forwarder, err := t.newDNSForwarder(v)
+			if err != nil {
+				return fmt.Errorf("bind %s: %w", name, err)
+			}
+			packetHandler = (*TrafficHandler)(t).DNSPacketHandler(enableUDP, logger, forwarder)
+			connHandler = (*TrafficHandler)(t).DNSConnHandler(enableTCP, logger, v, forwarder)
+		} else {
+			packetHandler = (*TrafficHandler)(t).PacketHandler(enableUDP, logger, v, dial.dialer, dial.address)
+			connHandler = (*TrafficHandler)(t).ConnHandler(enableTCP, logger, v, dial.dialer, dial.address, dial.pool)
+		}
+
 		li := listener.NewListener(t.ctx, logger, listener.ListenOptions{
-			Network:       protocols,
-			Address:       v.Listen,
-			Port:          v.Port,
-			Family:        v.Family,
-			Interface:     v.Interface,
-			ReuseAddr:     v.ReuseAddr,
-			TFO:           v.TFO,
-			MPTCP:         v.MPTCP,
-			UDPFragment:   v.UDPFragment,
-			UDPBufferSize: v.UDPBufferSize,
-			PacketHandler: (*TrafficHandler)(t).PacketHandler(
-				protocols.Contain(string(constant.ProtocolUDP)),
-				logger,
-				v,
-				dial.dialer,
-				dial.address,
-			),
-			ConnHandler: (*TrafficHandler)(t).ConnHandler(
-				protocols.Contain(string(constant.ProtocolTCP)),
-				logger,
-				dial.dialer,
-				dial.address,
-			),
+			Network:          protocols,
+			Address:          v.Listen,
+			Port:             v.Port,
+			Family:           v.Family,
+			Interface:        v.Interface,
+			ReuseAddr:        v.ReuseAddr,
+			Socket:           v.SocketConfig.Options(),
+			TFO:              v.TFO,
+			MPTCP:            v.MPTCP,
+			UDPFragment:      v.UDPFragment,
+			UDPBufferSize:    v.UDPBufferSize,
+			UDPBatchSize:     v.UDPBatchSize,
+			Workers:          v.Workers,
+			CPUAffinity:      v.CPUAffinity,
+			PacketHandlerOOb: packetHandler,
+			ConnHandler:      connHandler,
 		})
 		t.listeners.Add(li)
 	}
@@ -211,64 +401,102 @@ type TrafficHandler Traffics
 func (t *TrafficHandler) PacketHandler(
 	enable bool, logger *slog.Logger, config BindConfig,
 	dial dialer.Dialer, address string,
-) listener.PacketHandler {
+) listener.PacketHandlerOOb {
 	if !enable {
 		return nil
 	}
 
-	return listener.FuncPacketHandler(func(p []byte, remote netip.AddrPort, pw listener.PacketWriter) {
+	return listener.FuncPacketHandlerOOb(func(oob []byte, p []byte, remote netip.AddrPort, pw listener.PacketWriter) {
 		if !remote.IsValid() {
 			logger.ErrorContext(t.ctx, "invalid address")
-		}
-
-		if raw, hit := t.udpConnTrack.Load(remote); hit {
-			conn := raw.(*net.UDPConn)
-			_, err := conn.Write(p)
-			if err != nil {
-				logger.ErrorContext(t.ctx, "write message error", slog.String("error", err.Error()))
-			}
 			return
 		}
 
-		logger.DebugContext(t.ctx, "try dial new connection", slog.String("address", address))
-		conn, err := dial.DialContext(t.ctx, string(constant.ProtocolUDP), address)
-		if err != nil {
-			logger.ErrorContext(t.ctx, "dial udp conn failed",
-				slog.String("error", err.Error()), slog.String("remote", address))
+		raw, loaded := t.udpConnTrack.Load(remote)
+		if !loaded {
+			// remember the local address the client targeted, to reply from it
+			info := listener.ParsePacketInfo(oob)
+			raw, loaded = t.udpConnTrack.LoadOrStore(remote, newUdpSession(constant.UDPSessionPendingSize, info, config.UDPFilter, config.Remote))
+		}
+		session := raw.(*udpSession)
+		written, err := session.Write(p)
+		if errors.Is(err, net.ErrClosed) {
+			// the session expired or failed to dial, the next datagram starts a new one
+			logger.DebugContext(t.ctx, "udp session is closed, drop message",
+				slog.String("source", remote.String()))
+		} else if err != nil {
+			logger.ErrorContext(t.ctx, "write message error", slog.String("error", err.Error()))
+		} else if !written {
+			logger.WarnContext(t.ctx, "udp session pending queue is full, drop message",
+				slog.String("source", remote.String()))
+		}
+		if loaded {
 			return
 		}
-		var id = rand.Int63()
-		logger = logger.With(slog.Int64("id", id))
-		if udpConn, ok := conn.(*net.UDPConn); ok {
-			t.udpConnTrack.Store(remote, udpConn)
-			go t.newUdpLoop(logger, remote, udpConn, pw, config)
-			logger.DebugContext(t.ctx, "new udp connection established",
-				slog.String("source", remote.String()),
-				slog.String("remote", udpConn.RemoteAddr().String()))
 
-			_, err = udpConn.Write(p)
-			if err != nil {
-				logger.ErrorContext(t.ctx, "write udp message failed", slog.String("error", err.Error()))
-			}
-		} else {
-			panic("DialContext in udp network returned a non-udpConn")
-		}
+		// dial in background, so that a slow dial or resolve
+		// will not block other sessions of this listener
+		go t.newUdpSession(logger, remote, session, pw, config, dial, address)
 	})
 }
 
-func (t *TrafficHandler) newUdpLoop(logger *slog.Logger, client netip.AddrPort, proxyConn *net.UDPConn,
-	pw listener.PacketWriter, config BindConfig) {
+func (t *TrafficHandler) newUdpSession(logger *slog.Logger, client netip.AddrPort, session *udpSession,
+	pw listener.PacketWriter, config BindConfig, dial dialer.Dialer, address string) {
+	logger.DebugContext(t.ctx, "try dial new connection", slog.String("address", address))
+	udpConn, target, err := dialUDP(dialer.WithClient(t.ctx, client.Addr()), dial, address, config.UDPFilter != "")
+	if err != nil {
+		t.udpConnTrack.CompareAndDelete(client, session)
+		session.Close()
+		logger.ErrorContext(t.ctx, "dial udp conn failed",
+			slog.String("error", err.Error()), slog.String("remote", address))
+		return
+	}
+
+	var id = rand.Int63()
+	logger = logger.With(slog.Int64("id", id))
+	// an unconnected conn has no remote address
+	remote := target.String()
+	if !target.IsValid() {
+		remote = udpConn.RemoteAddr().String()
+	}
+	logger.DebugContext(t.ctx, "new udp connection established",
+		slog.String("source", client.String()),
+		slog.String("remote", remote))
+
+	err = session.Establish(udpConn, target)
+	if errors.Is(err, net.ErrClosed) {
+		t.udpConnTrack.CompareAndDelete(client, session)
+		return
+	}
+	if err != nil {
+		logger.ErrorContext(t.ctx, "write udp message failed", slog.String("error", err.Error()))
+	}
+	t.newUdpLoop(logger, client, session, udpConn, pw, config)
+}
+
+func (t *TrafficHandler) newUdpLoop(logger *slog.Logger, client netip.AddrPort, session *udpSession,
+	proxyConn *net.UDPConn, pw listener.PacketWriter, config BindConfig) {
 	defer func() {
-		t.udpConnTrack.Delete(client)
-		proxyConn.Close()
+		t.udpConnTrack.CompareAndDelete(client, session)
+		session.Close()
 		logger.DebugContext(t.ctx, "udp connection closed")
 	}()
 
+	if config.UDPBatchSize > 1 {
+		batchConn, err := listener.NewBatchConn(proxyConn, config.UDPBatchSize, config.UDPBufferSize, false)
+		if err == nil {
+			t.newUdpBatchLoop(client, session, proxyConn, batchConn, pw, config)
+			return
+		}
+		logger.DebugContext(t.ctx, "batch udp io is unavailable, fallback", slog.String("error", err.Error()))
+	}
+
 	readBuf := make([]byte, config.UDPBufferSize)
+	packet := make([][]byte, 1)
 	for {
 		proxyConn.SetReadDeadline(time.Now().Add(config.UDPKeepaliveTTL))
 	again:
-		read, err := proxyConn.Read(readBuf)
+		read, from, err := proxyConn.ReadFromUDPAddrPort(readBuf)
 		if err != nil {
 			var ope *net.OpError
 			if errors.As(err, &ope) && errors.Is(ope.Err, syscall.ECONNREFUSED) {
@@ -279,22 +507,132 @@ func (t *TrafficHandler) newUdpLoop(logger *slog.Logger, client netip.AddrPort,
 				// expires:
 				goto again
 			}
+			if errors.Is(err, os.ErrDeadlineExceeded) && !session.Expired(config.UDPKeepaliveTTL) {
+				// the client is still sending
+				continue
+			}
 			return
 		}
+		if !session.Accept(from) {
+			// filtered datagrams do not refresh the session
+			goto again
+		}
+		session.Touch()
 		if read != 0 {
-			pw.WritePacket(readBuf[:read], client)
+			packet[0] = readBuf[:read]
+			session.WriteBack(pw, packet, client)
+		}
+	}
+}
+
+func (t *TrafficHandler) newUdpBatchLoop(client netip.AddrPort, session *udpSession, proxyConn *net.UDPConn,
+	batchConn *listener.BatchConn, pw listener.PacketWriter, config BindConfig) {
+	packets := make([][]byte, 0, config.UDPBatchSize)
+	collect := func(p []byte, _ []byte, from netip.AddrPort) {
+		if len(p) != 0 && session.Accept(from) {
+			packets = append(packets, p)
+		}
+	}
+	for {
+		proxyConn.SetReadDeadline(time.Now().Add(config.UDPKeepaliveTTL))
+	again:
+		packets = packets[:0]
+		err := batchConn.ReadBatch(collect)
+		if err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				// see newUdpLoop
+				goto again
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) && !session.Expired(config.UDPKeepaliveTTL) {
+				continue
+			}
+			return
+		}
+		if len(packets) == 0 {
+			goto again
+		}
+		session.Touch()
+		session.WriteBack(pw, packets, client)
+	}
+}
+
+// migrateUdpSessions moves the udp sessions of remote away from the removed backends.
+// An unconnected session is sent to another backend of the same family, a connected one
+// is closed and the next datagram of its client starts a new session.
+func (t *Traffics) migrateUdpSessions(remote string, removed []netip.AddrPort, dial dialer.Dialer, address string) {
+	gone := func(addr netip.AddrPort) bool {
+		return slices.ContainsFunc(removed, func(r netip.AddrPort) bool {
+			return r.Addr() == addr.Addr().Unmap() && r.Port() == addr.Port()
+		})
+	}
+	t.udpConnTrack.Range(func(key, value any) bool {
+		session, ok := value.(*udpSession)
+		if !ok || session.remote != remote {
+			return true
 		}
+		upstream := session.Upstream()
+		if !upstream.IsValid() || !gone(upstream) {
+			return true
+		}
+		client := key.(netip.AddrPort)
+		network := string(constant.ProtocolUDP) + constant.FamilyIPv6
+		if upstream.Addr().Unmap().Is4() {
+			network = string(constant.ProtocolUDP) + constant.FamilyIPv4
+		}
+		target, err := dial.Resolve(dialer.WithClient(t.ctx, client.Addr()), network, address)
+		if err == nil && !gone(target) && session.Migrate(target) {
+			t.logger.Info("udp session migrated", slog.String("remote", remote),
+				slog.String("source", client.String()),
+				slog.String("from", upstream.String()), slog.String("to", target.String()))
+			return true
+		}
+		t.udpConnTrack.CompareAndDelete(client, session)
+		session.Close()
+		t.logger.Info("udp session closed, its backend is gone", slog.String("remote", remote),
+			slog.String("source", client.String()), slog.String("backend", upstream.String()))
+		return true
+	})
+}
+
+// dialUDP returns a connected socket to address, or an unconnected one
+// and the address to send to if unconnected is true.
+func dialUDP(ctx context.Context, dial dialer.Dialer, address string, unconnected bool) (*net.UDPConn, netip.AddrPort, error) {
+	if unconnected {
+		target, err := dial.Resolve(ctx, string(constant.ProtocolUDP), address)
+		if err != nil {
+			return nil, netip.AddrPort{}, err
+		}
+		conn, err := dial.ListenPacket(ctx, netip.Addr{}, target.String())
+		if err != nil {
+			return nil, netip.AddrPort{}, err
+		}
+		return conn, target, nil
 	}
+	conn, err := dial.DialContext(ctx, string(constant.ProtocolUDP), address)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		panic("DialContext in udp network returned a non-udpConn")
+	}
+	return udpConn, netip.AddrPort{}, nil
 }
 
 func (t *TrafficHandler) ConnHandler(
-	enable bool, logger *slog.Logger,
-	dial dialer.Dialer, address string,
+	enable bool, logger *slog.Logger, config BindConfig,
+	dial dialer.Dialer, address string, connPool *pool.Pool,
 ) listener.ConnHandler {
 	if !enable {
 		return nil
 	}
 
+	relayOptions := relay.Options{
+		IdleTimeout:   config.TCPIdleTimeout,
+		MaxLifetime:   config.TCPMaxLifetime,
+		LifetimeGrace: config.TCPLifetimeGrace,
+	}
+
 	return listener.FuncConnHandler(func(ctx context.Context, local net.Conn) {
 		defer local.Close()
 		var (
@@ -302,7 +640,11 @@ func (t *TrafficHandler) ConnHandler(
 			err    error
 			id     = rand.Int63()
 		)
-		if remote, err = dial.DialContext(t.ctx, string(constant.ProtocolTCP), address); err != nil {
+		dialCtx := t.ctx
+		if client, ok := local.RemoteAddr().(*net.TCPAddr); ok {
+			dialCtx = dialer.WithClient(dialCtx, client.AddrPort().Addr())
+		}
+		if remote, err = dialTCP(dialCtx, local, dial, address, connPool); err != nil {
 			logger.Error("dial new connection failed", slog.String("error", err.Error()))
 			return
 		}
@@ -315,14 +657,44 @@ func (t *TrafficHandler) ConnHandler(
 			slog.Int64("id", id),
 		)
 
-		if err = bufio.CopyConn(ctx, local, remote); err != nil {
-			logger.Error("copy connections failed", slog.String("error", err.Error()))
+		result, err := relay.Relay(ctx, local, remote, relayOptions)
+		if errors.Is(err, relay.ErrIdleTimeout) || errors.Is(err, relay.ErrMaxLifetime) {
+			logger.InfoContext(ctx, "tcp connection closed", slog.String("reason", err.Error()),
+				slog.Int64("id", id), slog.Int64("upload", result.Upload), slog.Int64("download", result.Download))
+			return
+		}
+		if err != nil {
+			logger.Error("copy connections failed", slog.String("error", err.Error()), slog.Int64("id", id))
 			return
 		}
-		logger.DebugContext(ctx, "copyConn finished", slog.Int64("id", id))
+		logger.DebugContext(ctx, "copyConn finished", slog.Int64("id", id),
+			slog.Int64("upload", result.Upload), slog.Int64("download", result.Download))
 	})
 }
 
+// dialTCP dials address for local. A connection of connPool is used if available.
+// If the dialer uses TCP Fast Open, the connect is deferred until the first bytes
+// of local are available, so they are sent in the SYN.
+func dialTCP(ctx context.Context, local net.Conn, dial dialer.Dialer, address string, connPool *pool.Pool) (net.Conn, error) {
+	if connPool != nil {
+		return connPool.Get(ctx)
+	}
+	early, ok := dial.(dialer.EarlyDataDialer)
+	if !ok || !early.TFO() {
+		return dial.DialContext(ctx, string(constant.ProtocolTCP), address)
+	}
+
+	data := make([]byte, constant.TFOEarlyDataSize)
+	_ = local.SetReadDeadline(time.Now().Add(constant.TFOEarlyDataTimeout))
+	n, err := local.Read(data)
+	_ = local.SetReadDeadline(time.Time{})
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	// n is 0 for server first protocols, connect without early data
+	return early.DialContextEarly(ctx, string(constant.ProtocolTCP), address, data[:n])
+}
+
 type ListenManager struct {
 	listeners []*listener.Listener
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"github.com/woshikedayaa/traffics/networks/listener"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpSession tracks a client's upstream udp connection.
+// While the upstream is being dialed, datagrams from the client are
+// buffered in pending (bounded) instead of blocking the listener.
+type udpSession struct {
+	conn atomic.Pointer[net.UDPConn]
+	// info is the local address the client sent the first datagram to
+	info listener.PacketInfo
+	// remote is the name of the remote the session is forwarded to
+	remote string
+	// target is the remote of an unconnected conn, it is set before conn
+	target atomic.Pointer[netip.AddrPort]
+	filter constant.UDPFilter
+	// lastActivity is the unix nano time a datagram was last relayed in any direction
+	lastActivity atomic.Int64
+
+	access  sync.Mutex
+	pending [][]byte
+	limit   int
+	closed  bool
+}
+
+func newUdpSession(limit int, info listener.PacketInfo, filter constant.UDPFilter, remote string) *udpSession {
+	s := &udpSession{limit: limit, info: info, filter: filter, remote: remote}
+	s.Touch()
+	return s
+}
+
+// Touch refreshes the session, both outbound and inbound datagrams keep it alive (RFC 4787 REQ-6).
+func (s *udpSession) Touch() {
+	s.lastActivity.Store(time.Now().UnixNano())
+}
+
+// Expired reports whether nothing was relayed for ttl.
+func (s *udpSession) Expired(ttl time.Duration) bool {
+	return time.Since(time.Unix(0, s.lastActivity.Load())) >= ttl
+}
+
+// Write sends p to the upstream if the session is established,
+// otherwise p is copied into the pending queue.
+// It reports false if the datagram was dropped because the pending queue is full,
+// and net.ErrClosed if the session is closed.
+func (s *udpSession) Write(p []byte) (bool, error) {
+	s.Touch()
+	if conn := s.conn.Load(); conn != nil {
+		return true, s.send(conn, p)
+	}
+
+	s.access.Lock()
+	// double check, the session may be established while waiting for the lock
+	if conn := s.conn.Load(); conn != nil {
+		s.access.Unlock()
+		return true, s.send(conn, p)
+	}
+	defer s.access.Unlock()
+	if s.closed {
+		return false, net.ErrClosed
+	}
+	if len(s.pending) >= s.limit {
+		return false, nil
+	}
+	s.pending = append(s.pending, append([]byte(nil), p...))
+	return true, nil
+}
+
+func (s *udpSession) send(conn *net.UDPConn, p []byte) error {
+	var err error
+	if target := s.Target(); target.IsValid() {
+		_, err = conn.WriteToUDPAddrPort(p, target)
+	} else {
+		_, err = conn.Write(p)
+	}
+	return err
+}
+
+// Establish binds conn to the session and flushes the pending datagrams.
+// If conn is unconnected, target is the address datagrams are sent to.
+func (s *udpSession) Establish(conn *net.UDPConn, target netip.AddrPort) error {
+	s.access.Lock()
+	defer s.access.Unlock()
+	if s.closed {
+		conn.Close()
+		return net.ErrClosed
+	}
+	s.target.Store(&target)
+	var lastErr error
+	for _, p := range s.pending {
+		if err := s.send(conn, p); err != nil {
+			lastErr = err
+		}
+	}
+	s.pending = nil
+	s.conn.Store(conn)
+	return lastErr
+}
+
+// Target returns the remote of an unconnected conn.
+func (s *udpSession) Target() netip.AddrPort {
+	if target := s.target.Load(); target != nil {
+		return *target
+	}
+	return netip.AddrPort{}
+}
+
+// Upstream returns the address datagrams are sent to, it is invalid until the session is established.
+func (s *udpSession) Upstream() netip.AddrPort {
+	if target := s.Target(); target.IsValid() {
+		return target
+	}
+	if conn := s.conn.Load(); conn != nil {
+		if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+			return addr.AddrPort()
+		}
+	}
+	return netip.AddrPort{}
+}
+
+// Migrate sends the following datagrams to target, it reports false if the conn is connected.
+func (s *udpSession) Migrate(target netip.AddrPort) bool {
+	if !s.Target().IsValid() {
+		return false
+	}
+	s.target.Store(&target)
+	return true
+}
+
+// Accept reports whether a datagram received from the upstream socket should be relayed to the client.
+// A connected socket is filtered by the kernel already.
+func (s *udpSession) Accept(from netip.AddrPort) bool {
+	switch s.filter {
+	case constant.UDPFilterEndpointIndependent:
+		return true
+	case constant.UDPFilterAddressDependent:
+		return from.Addr().Unmap() == s.Target().Addr().Unmap()
+	case constant.UDPFilterAddressPortDependent:
+		target := s.Target()
+		return from.Addr().Unmap() == target.Addr().Unmap() && from.Port() == target.Port()
+	default:
+		return true
+	}
+}
+
+// Close drops the pending datagrams and closes the upstream connection if any.
+func (s *udpSession) Close() error {
+	s.access.Lock()
+	s.closed = true
+	s.pending = nil
+	conn := s.conn.Load()
+	s.access.Unlock()
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// WriteBack writes packets from the upstream to client.
+// Replies leave from the local address the session was received on if known.
+func (s *udpSession) WriteBack(pw listener.PacketWriter, packets [][]byte, client netip.AddrPort) {
+	writePackets(pw, packets, client, s.info)
+}
+
+// writePackets writes packets to client, from the local address of info if it is valid.
+func writePackets(pw listener.PacketWriter, packets [][]byte, client netip.AddrPort, info listener.PacketInfo) {
+	if info.IsValid() {
+		if iw, ok := pw.(listener.PacketInfoWriter); ok {
+			iw.WritePacketsFrom(packets, client, info)
+			return
+		}
+	}
+	if len(packets) > 1 {
+		if bw, ok := pw.(listener.PacketBatchWriter); ok {
+			bw.WritePackets(packets, client)
+			return
+		}
+	}
+	for _, p := range packets {
+		pw.WritePacket(p, client)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/woshikedayaa/traffics/networks/constant"
+	"github.com/woshikedayaa/traffics/networks/listener"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func listenUDP(t *testing.T, address string) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort(address)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// TestUDPSessionFilter sends a datagram to the target of a session and replies to it from the target,
+// from another port of its address and from another address, as RFC 4787 section 5 tests filtering.
+func TestUDPSessionFilter(t *testing.T) {
+	tests := []struct {
+		nat  constant.UDPNAT
+		want []string
+	}{
+		{constant.UDPNATSymmetric, []string{"target"}},
+		{constant.UDPNATFullCone, []string{"target", "other port", "other address"}},
+		{constant.UDPNATRestrictedCone, []string{"target", "other port"}},
+		{constant.UDPNATPortRestrictedCone, []string{"target"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.nat), func(t *testing.T) {
+			var (
+				target    = listenUDP(t, "127.0.0.1:0")
+				otherPort = listenUDP(t, "127.0.0.1:0")
+				otherAddr = listenUDP(t, "127.0.0.2:0")
+				filter, _ = tt.nat.Filter()
+				session   = newUdpSession(constant.UDPSessionPendingSize, listener.PacketInfo{}, filter, "remote")
+				to        = target.LocalAddr().(*net.UDPAddr)
+				upstream  *net.UDPConn
+				err       error
+			)
+			defer session.Close()
+			if filter == "" {
+				upstream, err = net.DialUDP("udp4", nil, to)
+				if err == nil {
+					err = session.Establish(upstream, netip.AddrPort{})
+				}
+			} else {
+				upstream, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				if err == nil {
+					err = session.Establish(upstream, to.AddrPort())
+				}
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = session.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 64)
+			_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, mapped, err := target.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, conn := range map[string]*net.UDPConn{
+				"target": target, "other port": otherPort, "other address": otherAddr,
+			} {
+				if _, err = conn.WriteToUDPAddrPort([]byte(name), mapped); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// the replies the session relays to the client, as newUdpLoop does
+			var relayed []string
+			for {
+				_ = upstream.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+				n, from, err := upstream.ReadFromUDPAddrPort(buf)
+				if err != nil {
+					break
+				}
+				if filter == "" || session.Accept(from) {
+					relayed = append(relayed, string(buf[:n]))
+				}
+			}
+			slices.Sort(relayed)
+			want := slices.Sorted(slices.Values(tt.want))
+			if !slices.Equal(relayed, want) {
+				t.Errorf("relayed %q, want %q", relayed, want)
+			}
+		})
+	}
+}
+
+// gatedDialer dials udp once its gate is opened, as a slow resolve or dial would.
+type gatedDialer struct {
+	gate  chan struct{}
+	dials atomic.Int32
+}
+
+func (d *gatedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.dials.Add(1)
+	select {
+	case <-d.gate:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return net.Dial(network, address)
+}
+
+func (d *gatedDialer) ListenPacket(ctx context.Context, source netip.Addr, address string) (*net.UDPConn, error) {
+	return nil, errors.New("unexpected listen")
+}
+
+func (d *gatedDialer) Resolve(ctx context.Context, network, address string) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("unexpected resolve")
+}
+
+// discardWriter drops the replies to the client.
+type discardWriter struct{}
+
+func (discardWriter) WritePacket(bs []byte, remote netip.AddrPort) {}
+
+func newTestHandler(t *testing.T) *TrafficHandler {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &TrafficHandler{ctx: ctx, udpConnTrack: &sync.Map{}}
+	t.Cleanup(func() {
+		cancel()
+		h.udpConnTrack.Range(func(key, value any) bool {
+			value.(*udpSession).Close()
+			return true
+		})
+	})
+	return h
+}
+
+// waitFor polls cond until it holds or a few seconds passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestUDPPendingQueue sends datagrams to a session whose dial is blocked: the ones beyond
+// UDPSessionPendingSize are dropped and the others reach the target in order once it is dialed.
+func TestUDPPendingQueue(t *testing.T) {
+	target := listenUDP(t, "127.0.0.1:0")
+	d := &gatedDialer{gate: make(chan struct{})}
+	h := newTestHandler(t)
+	config := BindConfig{UDPKeepaliveTTL: time.Minute, UDPBufferSize: 2048}
+	handler := h.PacketHandler(true, slog.New(slog.DiscardHandler), config, d, target.LocalAddr().String())
+	client := netip.MustParseAddrPort("192.0.2.1:1000")
+
+	const sent = constant.UDPSessionPendingSize + 10
+	for i := range sent {
+		handler.HandlePacketOOb(nil, []byte(strconv.Itoa(i)), client, discardWriter{})
+	}
+	waitFor(t, "the dial", func() bool { return d.dials.Load() == 1 })
+	close(d.gate)
+
+	buf := make([]byte, 64)
+	for i := range constant.UDPSessionPendingSize {
+		_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := target.Read(buf)
+		if err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+		if string(buf[:n]) != strconv.Itoa(i) {
+			t.Fatalf("datagram %d is %q, want them in order", i, buf[:n])
+		}
+	}
+	_ = target.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := target.Read(buf); err == nil {
+		t.Errorf("received %q beyond the pending queue", buf[:n])
+	}
+
+	// once established, datagrams are sent at once
+	handler.HandlePacketOOb(nil, []byte("after"), client, discardWriter{})
+	_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := target.Read(buf); err != nil || string(buf[:n]) != "after" {
+		t.Errorf("read %q, %v, want after", buf[:n], err)
+	}
+	if dials := d.dials.Load(); dials != 1 {
+		t.Errorf("%d dials, want 1", dials)
+	}
+}
+
+// TestUDPSessionCloseWhileDialing closes a session before its dial finishes: the pending
+// datagrams are dropped, the dialed conn is closed and the next datagram starts a new session.
+func TestUDPSessionCloseWhileDialing(t *testing.T) {
+	target := listenUDP(t, "127.0.0.1:0")
+	d := &gatedDialer{gate: make(chan struct{})}
+	h := newTestHandler(t)
+	config := BindConfig{UDPKeepaliveTTL: time.Minute, UDPBufferSize: 2048}
+	handler := h.PacketHandler(true, slog.New(slog.DiscardHandler), config, d, target.LocalAddr().String())
+	client := netip.MustParseAddrPort("192.0.2.1:1000")
+
+	handler.HandlePacketOOb(nil, []byte("pending"), client, discardWriter{})
+	raw, ok := h.udpConnTrack.Load(client)
+	if !ok {
+		t.Fatal("no session for the client")
+	}
+	session := raw.(*udpSession)
+	session.Close()
+	if _, err := session.Write([]byte("closed")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("write to a closed session: %v, want net.ErrClosed", err)
+	}
+	close(d.gate)
+	waitFor(t, "the closed session to be removed", func() bool {
+		_, ok := h.udpConnTrack.Load(client)
+		return !ok
+	})
+	if session.conn.Load() != nil {
+		t.Error("the closed session was established")
+	}
+	buf := make([]byte, 64)
+	_ = target.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := target.Read(buf); err == nil {
+		t.Errorf("received %q from a closed session", buf[:n])
+	}
+
+	handler.HandlePacketOOb(nil, []byte("again"), client, discardWriter{})
+	_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := target.Read(buf); err != nil || string(buf[:n]) != "again" {
+		t.Errorf("read %q, %v, want again", buf[:n], err)
+	}
+	if dials := d.dials.Load(); dials != 2 {
+		t.Errorf("%d dials, want 2", dials)
+	}
+}